@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nesyor/ratelimiter/internal/conformance"
+)
+
+func TestQuotaLimiterConformance(t *testing.T) {
+	// A daily quota is a fixed window aligned to midnight, where the suite's clock
+	// starts, so up to twice the limit fits around a boundary.
+	spec := conformance.Spec{Burst: 5, Rate: 5 / (24 * time.Hour).Seconds(), MaxBurst: 10}
+	conformance.Run(t, spec, func(clock *conformance.Clock) conformance.Limiter {
+		ql, err := NewQuotaLimiter(Quota{Limit: 5, Period: Day}, nil)
+		if err != nil {
+			t.Fatalf("failed to create quota limiter: %v", err)
+		}
+		ql.now = clock.Now
+		return ql
+	})
+}
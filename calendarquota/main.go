@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nesyor/ratelimiter/internal/audit"
+)
+
+// Period is a calendar period over which a quota is counted.
+type Period int
+
+const (
+	Day   Period = iota // Resets at midnight.
+	Week                // Resets at midnight between Sunday and Monday.
+	Month               // Resets at midnight on the first day of the month.
+)
+
+// Quota describes how many requests a key may make per calendar period.
+type Quota struct {
+	Limit       int            // Requests allowed per period.
+	Period      Period         // Calendar period the limit applies to.
+	Location    *time.Location // Time zone period boundaries are computed in; UTC if nil.
+	MaxRollover int            // Most unused requests carried into the next period; 0 disables rollover.
+}
+
+// Counter is the durable per-key state of a quota.
+type Counter struct {
+	PeriodStart time.Time `json:"period_start"` // Start of the period the counter belongs to.
+	Used        int       `json:"used"`         // Requests counted in this period.
+	Carry       int       `json:"carry"`        // Unused requests rolled over from the previous period.
+}
+
+// Store persists quota counters so they survive restarts.
+type Store interface {
+	Load() (map[string]Counter, error)
+	Save(counters map[string]Counter) error
+}
+
+// QuotaLimiter enforces calendar quotas per key, such as "1k per day resetting
+// at midnight in the tenant's time zone".
+type QuotaLimiter struct {
+	audit.Sink // Optional log of decisions, see SetAuditHandler.
+
+	quota     Quota
+	locations map[string]*time.Location // Per-key time zone overrides.
+	counters  map[string]*Counter
+	store     Store
+	now       func() time.Time
+	mu        sync.Mutex
+}
+
+// NewQuotaLimiter creates a quota limiter and loads existing counters from store, if any.
+func NewQuotaLimiter(quota Quota, store Store) (*QuotaLimiter, error) {
+	if quota.Location == nil {
+		quota.Location = time.UTC
+	}
+
+	ql := &QuotaLimiter{
+		quota:     quota,
+		locations: make(map[string]*time.Location),
+		counters:  make(map[string]*Counter),
+		store:     store,
+		now:       time.Now,
+	}
+
+	if store != nil {
+		counters, err := store.Load()
+		if err != nil {
+			return nil, fmt.Errorf("load quota counters: %w", err)
+		}
+		for key, counter := range counters {
+			counter := counter
+			ql.counters[key] = &counter
+		}
+	}
+	return ql, nil
+}
+
+// SetLocation makes period boundaries for key follow the given time zone.
+func (ql *QuotaLimiter) SetLocation(key string, loc *time.Location) {
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+
+	ql.locations[key] = loc
+}
+
+// Allow reports whether key may make one more request in the current period and counts it if so.
+func (ql *QuotaLimiter) Allow(key string) bool {
+	return ql.AllowN(key, 1)
+}
+
+// AllowN reports whether key may make n more requests in the current period and counts them if so.
+// A negative n is always denied, so it cannot be used to hand back quota.
+func (ql *QuotaLimiter) AllowN(key string, n int) bool {
+	if n < 0 {
+		return false
+	}
+
+	logger := ql.AuditLogger()
+	allowed, record := ql.decide(key, n, logger != nil)
+	if record != nil {
+		// Logged after ql.mu is released, since the handler may do I/O.
+		logger.Log(*record)
+	}
+	return allowed
+}
+
+// decide makes the decision for AllowN, describing it in a record if audited.
+func (ql *QuotaLimiter) decide(key string, n int, audited bool) (bool, *audit.Record) {
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+
+	counter := ql.current(key)
+	allowed := counter.Used+n <= ql.quota.Limit+counter.Carry
+	if allowed {
+		counter.Used += n
+	}
+
+	if !audited {
+		return allowed, nil
+	}
+	record := &audit.Record{
+		Key:       key,
+		Rule:      fmt.Sprintf("%d per %s", ql.quota.Limit, ql.quota.Period),
+		Algorithm: "calendarquota",
+		Allowed:   allowed,
+		Remaining: float64(max(ql.quota.Limit+counter.Carry-counter.Used, 0)),
+		Cost:      float64(n),
+	}
+	if !allowed {
+		record.RetryAfter = ql.quota.Period.next(counter.PeriodStart).Sub(ql.now())
+	}
+	return allowed, record
+}
+
+// Remaining returns how many requests key has left in the current period.
+func (ql *QuotaLimiter) Remaining(key string) int {
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+
+	counter := ql.current(key)
+	return max(ql.quota.Limit+counter.Carry-counter.Used, 0)
+}
+
+// ResetTime returns when the current period for key ends.
+func (ql *QuotaLimiter) ResetTime(key string) time.Time {
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+
+	return ql.quota.Period.next(ql.current(key).PeriodStart)
+}
+
+// Flush writes all counters to the store.
+func (ql *QuotaLimiter) Flush() error {
+	ql.mu.Lock()
+	counters := make(map[string]Counter, len(ql.counters))
+	for key, counter := range ql.counters {
+		counters[key] = *counter
+	}
+	ql.mu.Unlock()
+
+	if ql.store == nil {
+		return nil
+	}
+	return ql.store.Save(counters)
+}
+
+// current returns the counter for key, moving it into the current period first.
+// The caller must hold ql.mu.
+func (ql *QuotaLimiter) current(key string) *Counter {
+	loc, ok := ql.locations[key]
+	if !ok {
+		loc = ql.quota.Location
+	}
+	start := ql.quota.Period.start(ql.now().In(loc))
+
+	counter, exists := ql.counters[key]
+	if !exists {
+		counter = &Counter{PeriodStart: start}
+		ql.counters[key] = counter
+		return counter
+	}
+
+	if counter.PeriodStart.After(start) {
+		if counter.PeriodStart.Equal(ql.quota.Period.next(start)) {
+			// The clock went back into the previous period, e.g. after an NTP correction
+			// or when counters were saved on a host whose clock ran ahead. Keep counting
+			// in the later period rather than granting the earlier one afresh.
+			return counter
+		}
+		// A counter further ahead came from a clock that was badly wrong, and would
+		// lock key out until it caught up. Start the current period afresh instead.
+		*counter = Counter{PeriodStart: start}
+	}
+	if !counter.PeriodStart.Equal(start) {
+		carry := 0
+		// Only unused quota from the immediately preceding period rolls over.
+		if ql.quota.MaxRollover > 0 && ql.quota.Period.next(counter.PeriodStart.In(loc)).Equal(start) {
+			carry = min(max(ql.quota.Limit+counter.Carry-counter.Used, 0), ql.quota.MaxRollover)
+		}
+		*counter = Counter{PeriodStart: start, Carry: carry}
+	}
+	return counter
+}
+
+// String returns the name of the period.
+func (p Period) String() string {
+	switch p {
+	case Week:
+		return "week"
+	case Month:
+		return "month"
+	default:
+		return "day"
+	}
+}
+
+// start returns the beginning of the period containing t, in t's location.
+func (p Period) start(t time.Time) time.Time {
+	year, month, day := t.Date()
+	switch p {
+	case Week:
+		// Weeks start on Monday.
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(year, month, day-offset, 0, 0, 0, 0, t.Location())
+	case Month:
+		return time.Date(year, month, 1, 0, 0, 0, 0, t.Location())
+	default:
+		return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+	}
+}
+
+// next returns the beginning of the period following the one starting at start.
+// Adding calendar days rather than fixed durations keeps boundaries correct across DST changes.
+func (p Period) next(start time.Time) time.Time {
+	year, month, day := start.Date()
+	switch p {
+	case Week:
+		return time.Date(year, month, day+7, 0, 0, 0, 0, start.Location())
+	case Month:
+		return time.Date(year, month+1, 1, 0, 0, 0, 0, start.Location())
+	default:
+		return time.Date(year, month, day+1, 0, 0, 0, 0, start.Location())
+	}
+}
+
+// FileStore keeps quota counters in a JSON file.
+type FileStore struct {
+	Path string
+}
+
+// Load reads counters from the file. A missing file yields no counters.
+func (s *FileStore) Load() (map[string]Counter, error) {
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]Counter{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	counters := make(map[string]Counter)
+	if err := json.Unmarshal(data, &counters); err != nil {
+		return nil, err
+	}
+	return counters, nil
+}
+
+// Save atomically replaces the file with the given counters.
+func (s *FileStore) Save(counters map[string]Counter) error {
+	data, err := json.Marshal(counters)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated file behind.
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+func main() {
+	store := &FileStore{Path: filepath.Join(os.TempDir(), "calendarquota.json")}
+	limiter, err := NewQuotaLimiter(Quota{Limit: 5, Period: Day, MaxRollover: 2}, store)
+	if err != nil {
+		fmt.Println("Failed to create quota limiter:", err)
+		return
+	}
+
+	// Tenants reset at midnight in their own time zones.
+	tenants := map[string]string{
+		"acme":    "America/New_York",
+		"globex":  "Europe/Berlin",
+		"initech": "Asia/Tokyo",
+	}
+	for tenant, zone := range tenants {
+		if loc, err := time.LoadLocation(zone); err == nil {
+			limiter.SetLocation(tenant, loc)
+		}
+	}
+
+	for tenant := range tenants {
+		for i := 0; i < 7; i++ {
+			if limiter.Allow(tenant) {
+				fmt.Println("Request from", tenant, "allowed!")
+			} else {
+				fmt.Println("Request from", tenant, "denied until", limiter.ResetTime(tenant))
+			}
+		}
+	}
+
+	if err := limiter.Flush(); err != nil {
+		fmt.Println("Failed to save quota counters:", err)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("failed to load location %s: %v", name, err)
+	}
+	return loc
+}
+
+func TestQuotaLimiter_DailyResetInTimeZone(t *testing.T) {
+	tokyo := mustLoadLocation(t, "Asia/Tokyo")
+	ql, _ := NewQuotaLimiter(Quota{Limit: 2, Period: Day, Location: tokyo}, nil)
+
+	// 23:30 in Tokyo is 14:30 UTC.
+	now := time.Date(2026, 5, 10, 23, 30, 0, 0, tokyo)
+	ql.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if !ql.Allow("tenant") {
+			t.Fatalf("expected request %d to be allowed", i+1)
+		}
+	}
+	if ql.Allow("tenant") {
+		t.Fatal("expected request to be denied after daily quota is used")
+	}
+
+	expectedReset := time.Date(2026, 5, 11, 0, 0, 0, 0, tokyo)
+	if reset := ql.ResetTime("tenant"); !reset.Equal(expectedReset) {
+		t.Fatalf("expected reset at %v but got %v", expectedReset, reset)
+	}
+
+	// Midnight in Tokyo, still the same day in UTC.
+	now = expectedReset
+	if !ql.Allow("tenant") {
+		t.Fatal("expected request to be allowed after midnight in the tenant's time zone")
+	}
+}
+
+func TestQuotaLimiter_PerKeyLocation(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+	ql, _ := NewQuotaLimiter(Quota{Limit: 1, Period: Day}, nil)
+	ql.SetLocation("acme", newYork)
+
+	// 02:00 UTC on May 11 is still May 10 in New York.
+	now := time.Date(2026, 5, 11, 2, 0, 0, 0, time.UTC)
+	ql.now = func() time.Time { return now }
+
+	if reset := ql.ResetTime("acme"); !reset.Equal(time.Date(2026, 5, 11, 0, 0, 0, 0, newYork)) {
+		t.Fatalf("expected acme to reset at midnight New York time but got %v", reset)
+	}
+	if reset := ql.ResetTime("other"); !reset.Equal(time.Date(2026, 5, 12, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected other keys to reset at midnight UTC but got %v", reset)
+	}
+}
+
+func TestQuotaLimiter_DSTBoundaries(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+	ql, _ := NewQuotaLimiter(Quota{Limit: 1, Period: Day, Location: newYork}, nil)
+
+	// March 8 2026 is only 23 hours long in New York.
+	now := time.Date(2026, 3, 8, 12, 0, 0, 0, newYork)
+	ql.now = func() time.Time { return now }
+
+	reset := ql.ResetTime("tenant")
+	if expected := time.Date(2026, 3, 9, 0, 0, 0, 0, newYork); !reset.Equal(expected) {
+		t.Fatalf("expected reset at %v but got %v", expected, reset)
+	}
+	start := time.Date(2026, 3, 8, 0, 0, 0, 0, newYork)
+	if length := reset.Sub(start); length != 23*time.Hour {
+		t.Fatalf("expected the DST day to last 23h but got %v", length)
+	}
+
+	// November 1 2026 is 25 hours long.
+	now = time.Date(2026, 11, 1, 12, 0, 0, 0, newYork)
+	reset = ql.ResetTime("tenant")
+	if length := reset.Sub(time.Date(2026, 11, 1, 0, 0, 0, 0, newYork)); length != 25*time.Hour {
+		t.Fatalf("expected the DST day to last 25h but got %v", length)
+	}
+}
+
+func TestQuotaLimiter_WeeklyAndMonthly(t *testing.T) {
+	// Wednesday May 13 2026.
+	now := time.Date(2026, 5, 13, 15, 0, 0, 0, time.UTC)
+
+	weekly, _ := NewQuotaLimiter(Quota{Limit: 1, Period: Week}, nil)
+	weekly.now = func() time.Time { return now }
+	if reset := weekly.ResetTime("k"); !reset.Equal(time.Date(2026, 5, 18, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected weekly quota to reset on Monday but got %v", reset)
+	}
+
+	monthly, _ := NewQuotaLimiter(Quota{Limit: 1, Period: Month}, nil)
+	monthly.now = func() time.Time { return now }
+	if reset := monthly.ResetTime("k"); !reset.Equal(time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected monthly quota to reset on the 1st but got %v", reset)
+	}
+
+	if !monthly.Allow("k") || monthly.Allow("k") {
+		t.Fatal("expected exactly one request to be allowed this month")
+	}
+	now = time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	if !monthly.Allow("k") {
+		t.Fatal("expected request to be allowed in the next month")
+	}
+}
+
+func TestQuotaLimiter_Rollover(t *testing.T) {
+	ql, _ := NewQuotaLimiter(Quota{Limit: 5, Period: Day, MaxRollover: 3}, nil)
+	now := time.Date(2026, 5, 10, 12, 0, 0, 0, time.UTC)
+	ql.now = func() time.Time { return now }
+
+	// Use 1 of 5, leaving 4 unused; only 3 roll over.
+	ql.Allow("k")
+	now = now.AddDate(0, 0, 1)
+	if remaining := ql.Remaining("k"); remaining != 8 {
+		t.Fatalf("expected 5 + 3 rolled over requests but got %d", remaining)
+	}
+
+	// Skipping a whole day forfeits the carry.
+	now = now.AddDate(0, 0, 2)
+	if remaining := ql.Remaining("k"); remaining != 5 {
+		t.Fatalf("expected no rollover after an idle period but got %d remaining", remaining)
+	}
+}
+
+func TestQuotaLimiter_DurableCounters(t *testing.T) {
+	store := &FileStore{Path: filepath.Join(t.TempDir(), "quota.json")}
+	now := time.Date(2026, 5, 10, 12, 0, 0, 0, time.UTC)
+
+	ql, err := NewQuotaLimiter(Quota{Limit: 3, Period: Day}, store)
+	if err != nil {
+		t.Fatalf("failed to create limiter: %v", err)
+	}
+	ql.now = func() time.Time { return now }
+	ql.Allow("k")
+	ql.Allow("k")
+	if err := ql.Flush(); err != nil {
+		t.Fatalf("failed to flush counters: %v", err)
+	}
+
+	// A new limiter picks up where the old one left off.
+	restored, err := NewQuotaLimiter(Quota{Limit: 3, Period: Day}, store)
+	if err != nil {
+		t.Fatalf("failed to restore limiter: %v", err)
+	}
+	restored.now = func() time.Time { return now }
+	if remaining := restored.Remaining("k"); remaining != 1 {
+		t.Fatalf("expected 1 remaining request after restore but got %d", remaining)
+	}
+}
+
+func TestQuotaLimiter_NegativeN(t *testing.T) {
+	ql, _ := NewQuotaLimiter(Quota{Limit: 2, Period: Day}, nil)
+	ql.now = func() time.Time { return time.Date(2026, 5, 10, 12, 0, 0, 0, time.UTC) }
+
+	ql.AllowN("k", 2)
+	if ql.AllowN("k", -2) {
+		t.Fatal("expected a negative number of requests to be denied")
+	}
+	if remaining := ql.Remaining("k"); remaining != 0 {
+		t.Fatalf("expected a negative number of requests not to refund quota but %d remain", remaining)
+	}
+}
+
+func TestQuotaLimiter_ClockGoesBack(t *testing.T) {
+	store := &FileStore{Path: filepath.Join(t.TempDir(), "quota.json")}
+	now := time.Date(2026, 5, 11, 0, 0, 30, 0, time.UTC)
+
+	ql, _ := NewQuotaLimiter(Quota{Limit: 2, Period: Day}, store)
+	ql.now = func() time.Time { return now }
+	ql.Allow("k")
+	ql.Allow("k")
+	if err := ql.Flush(); err != nil {
+		t.Fatalf("failed to flush counters: %v", err)
+	}
+
+	// A clock stepped back a minute into the previous day does not grant that day's quota afresh...
+	now = now.Add(-time.Minute)
+	if ql.Allow("k") {
+		t.Fatal("expected request to be denied after the clock went back across midnight")
+	}
+	// ...nor does restoring the counters on a host whose clock lags behind.
+	restored, err := NewQuotaLimiter(Quota{Limit: 2, Period: Day}, store)
+	if err != nil {
+		t.Fatalf("failed to restore limiter: %v", err)
+	}
+	restored.now = func() time.Time { return now }
+	if remaining := restored.Remaining("k"); remaining != 0 {
+		t.Fatalf("expected no remaining requests after restoring on a lagging clock but got %d", remaining)
+	}
+
+
+	// The quota resets when the later period ends.
+	expectedReset := time.Date(2026, 5, 12, 0, 0, 0, 0, time.UTC)
+	if reset := ql.ResetTime("k"); !reset.Equal(expectedReset) {
+		t.Fatalf("expected reset at %v but got %v", expectedReset, reset)
+	}
+	now = expectedReset
+	if !ql.Allow("k") {
+		t.Fatal("expected request to be allowed once the later period ended")
+	}
+}
+
+func TestQuotaLimiter_FarFuturePeriod(t *testing.T) {
+	store := &FileStore{Path: filepath.Join(t.TempDir(), "quota.json")}
+	now := time.Date(2026, 5, 11, 12, 0, 0, 0, time.UTC)
+
+	// Counters saved by a host whose clock was years ahead...
+	future := time.Date(2036, 5, 11, 0, 0, 0, 0, time.UTC)
+	if err := store.Save(map[string]Counter{"k": {PeriodStart: future, Used: 2}}); err != nil {
+		t.Fatalf("failed to save counters: %v", err)
+	}
+	ql, err := NewQuotaLimiter(Quota{Limit: 2, Period: Day}, store)
+	if err != nil {
+		t.Fatalf("failed to restore limiter: %v", err)
+	}
+	ql.now = func() time.Time { return now }
+
+	// ...do not lock the key out until then: the current period starts afresh.
+	if !ql.Allow("k") {
+		t.Fatal("expected request to be allowed despite a counter ten years ahead")
+	}
+	expectedReset := time.Date(2026, 5, 12, 0, 0, 0, 0, time.UTC)
+	if reset := ql.ResetTime("k"); !reset.Equal(expectedReset) {
+		t.Fatalf("expected reset at %v but got %v", expectedReset, reset)
+	}
+	if remaining := ql.Remaining("k"); remaining != 1 {
+		t.Fatalf("expected 1 remaining request but got %d", remaining)
+	}
+}
+
+func TestQuotaLimiter_AuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	ql, _ := NewQuotaLimiter(Quota{Limit: 1, Period: Day}, nil)
+	ql.SetAuditHandler(slog.NewJSONHandler(&buf, nil), 0)
+	ql.now = func() time.Time { return time.Date(2026, 5, 10, 12, 0, 0, 0, time.UTC) }
+
+	ql.Allow("k")
+	ql.Allow("k")
+
+	// Only the denial is logged with a sample rate of 0
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("expected a single JSON audit record but got %q", buf.String())
+	}
+	if record["decision"] != "deny" || record["rule"] != "1 per day" || record["retry_after"] != float64(12*time.Hour) {
+		t.Fatalf("unexpected audit record %v", record)
+	}
+}
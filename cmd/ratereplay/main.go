@@ -0,0 +1,185 @@
+// Command ratereplay runs a recorded traffic trace through every rate limiting
+// algorithm using a simulated clock and reports how each one would have decided.
+//
+// Usage:
+//
+//	ratereplay [flags] [trace.jsonl]
+//
+// The trace holds one JSON request per line, e.g. {"time": "2026-10-18T12:00:00Z", "key": "192.168.1.1"},
+// or is an access log in Common Log Format. Without a file argument the trace is read from standard input.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nesyor/ratelimiter/internal/sim"
+	"github.com/nesyor/ratelimiter/internal/trace"
+)
+
+// Report holds the outcome of replaying a trace.
+type Report struct {
+	Algorithms []string
+	Requests   int
+	Denied     map[string]int            // Denied requests per algorithm.
+	Disagree   map[string]map[string]int // Requests two algorithms decided differently.
+	Keys       map[string]*KeyOutcome
+}
+
+// KeyOutcome is the replay outcome for a single key.
+type KeyOutcome struct {
+	Requests int
+	Denied   map[string]int // Denied requests per algorithm.
+}
+
+// replay feeds requests through a fresh limiter per algorithm.
+func replay(requests []trace.Request, algorithms []string, params sim.Params) (*Report, error) {
+	limiters := make([]sim.Limiter, len(algorithms))
+	for i, algorithm := range algorithms {
+		l, err := sim.New(algorithm, params)
+		if err != nil {
+			return nil, err
+		}
+		limiters[i] = l
+	}
+
+	report := &Report{
+		Algorithms: algorithms,
+		Requests:   len(requests),
+		Denied:     make(map[string]int),
+		Disagree:   make(map[string]map[string]int),
+		Keys:       make(map[string]*KeyOutcome),
+	}
+	for _, algorithm := range algorithms {
+		report.Disagree[algorithm] = make(map[string]int)
+	}
+
+	decisions := make([]bool, len(algorithms))
+	for _, req := range requests {
+		outcome, exists := report.Keys[req.Key]
+		if !exists {
+			outcome = &KeyOutcome{Denied: make(map[string]int)}
+			report.Keys[req.Key] = outcome
+		}
+		outcome.Requests++
+
+		for i, l := range limiters {
+			decisions[i] = l.Allow(req.Key, req.Time)
+			if !decisions[i] {
+				report.Denied[algorithms[i]]++
+				outcome.Denied[algorithms[i]]++
+			}
+		}
+
+		for i := range algorithms {
+			for j := range algorithms {
+				if decisions[i] != decisions[j] {
+					report.Disagree[algorithms[i]][algorithms[j]]++
+				}
+			}
+		}
+	}
+	return report, nil
+}
+
+// Write prints the report, including the topKeys keys with the most requests.
+func (r *Report) Write(w io.Writer, topKeys int) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+
+	fmt.Fprintf(w, "%d requests from %d keys\n\n", r.Requests, len(r.Keys))
+	fmt.Fprintln(tw, "algorithm\tallowed\tdenied\tdenied %\t")
+	for _, algorithm := range r.Algorithms {
+		denied := r.Denied[algorithm]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t\n", algorithm, r.Requests-denied, denied, percent(denied, r.Requests))
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w, "\nrequests decided differently")
+	fmt.Fprintf(tw, "\t%s\t\n", strings.Join(r.Algorithms, "\t"))
+	for _, a := range r.Algorithms {
+		fmt.Fprintf(tw, "%s", a)
+		for _, b := range r.Algorithms {
+			fmt.Fprintf(tw, "\t%d", r.Disagree[a][b])
+		}
+		fmt.Fprintln(tw, "\t")
+	}
+	tw.Flush()
+
+	if topKeys <= 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(r.Keys))
+	for key := range r.Keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := r.Keys[keys[i]], r.Keys[keys[j]]
+		if a.Requests != b.Requests {
+			return a.Requests > b.Requests
+		}
+		return keys[i] < keys[j]
+	})
+	keys = keys[:min(topKeys, len(keys))]
+
+	fmt.Fprintln(w, "\ndenied requests per key")
+	fmt.Fprintf(tw, "key\trequests\t%s\t\n", strings.Join(r.Algorithms, "\t"))
+	for _, key := range keys {
+		outcome := r.Keys[key]
+		fmt.Fprintf(tw, "%s\t%d", key, outcome.Requests)
+		for _, algorithm := range r.Algorithms {
+			fmt.Fprintf(tw, "\t%d", outcome.Denied[algorithm])
+		}
+		fmt.Fprintln(tw, "\t")
+	}
+	tw.Flush()
+}
+
+// percent returns part as a percentage of whole.
+func percent(part, whole int) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return 100 * float64(part) / float64(whole)
+}
+
+func main() {
+	rate := flag.Float64("rate", 1, "tokens added or water leaked per second (tokenbucket, leakybucket)")
+	burst := flag.Int("burst", 5, "bucket capacity (tokenbucket, leakybucket)")
+	limit := flag.Int("limit", 5, "requests per window (fixedwindow, slidinglog, slidingwindow)")
+	window := flag.Duration("window", time.Second, "window length (fixedwindow, slidinglog, slidingwindow)")
+	algorithms := flag.String("algorithms", strings.Join(sim.Algorithms, ","), "comma separated algorithms to replay")
+	topKeys := flag.Int("keys", 10, "number of keys to show outcomes for")
+	flag.Parse()
+
+	input := io.Reader(os.Stdin)
+	if flag.NArg() > 0 {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		input = f
+	}
+
+	requests, err := trace.Read(input)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "read trace:", err)
+		os.Exit(1)
+	}
+
+	params := sim.Params{Rate: *rate, Burst: *burst, Limit: *limit, Window: *window}
+	report, err := replay(requests, strings.Split(*algorithms, ","), params)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	report.Write(os.Stdout, *topKeys)
+}
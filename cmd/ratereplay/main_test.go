@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nesyor/ratelimiter/internal/sim"
+	"github.com/nesyor/ratelimiter/internal/trace"
+)
+
+const testTrace = `{"time": 0, "key": "a"}
+{"time": 0, "key": "a"}
+{"time": 0, "key": "a"}
+{"time": 0.6, "key": "a"}
+{"time": 0, "key": "b"}
+`
+
+func TestReplay(t *testing.T) {
+	requests, err := trace.ReadJSONL(strings.NewReader(testTrace))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	params := sim.Params{Rate: 2, Burst: 2, Limit: 2, Window: time.Second}
+	report, err := replay(requests, []string{"tokenbucket", "fixedwindow"}, params)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Both deny the third simultaneous request from a; only the token bucket
+	// has refilled by 600ms.
+	if report.Denied["tokenbucket"] != 1 || report.Denied["fixedwindow"] != 2 {
+		t.Errorf("unexpected denials %v", report.Denied)
+	}
+	if report.Disagree["tokenbucket"]["fixedwindow"] != 1 || report.Disagree["fixedwindow"]["tokenbucket"] != 1 {
+		t.Errorf("expected one disagreement but got %v", report.Disagree)
+	}
+	if a := report.Keys["a"]; a.Requests != 4 || a.Denied["fixedwindow"] != 2 {
+		t.Errorf("unexpected outcome for key a: %+v", a)
+	}
+	if b := report.Keys["b"]; b.Requests != 1 || b.Denied["tokenbucket"] != 0 {
+		t.Errorf("unexpected outcome for key b: %+v", b)
+	}
+
+	var out strings.Builder
+	report.Write(&out, 1)
+	for _, expected := range []string{"5 requests from 2 keys", "tokenbucket", "denied requests per key"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected report to contain %q:\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestReplayUnknownAlgorithm(t *testing.T) {
+	if _, err := replay(nil, []string{"nope"}, sim.Params{}); err == nil {
+		t.Error("expected an error for an unknown algorithm")
+	}
+}
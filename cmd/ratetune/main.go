@@ -0,0 +1,303 @@
+// Command ratetune recommends rate limiter parameters from recorded traffic.
+//
+// Usage:
+//
+//	ratetune [flags] [trace]
+//
+// The trace is either JSONL, one {"time": ..., "key": ...} request per line, or an
+// access log in Common Log Format; without a file argument it is read from standard input.
+//
+// Keys are split into top offenders (the busiest keys) and normal clients. ratetune
+// searches for the tightest parameters under which the per-client denial rate of
+// normal clients stays under -max-deny at the given percentile, which caps the top
+// offenders as hard as possible without hurting everyone else, and prints them as a
+// JSON rule.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/nesyor/ratelimiter/internal/sim"
+	"github.com/nesyor/ratelimiter/internal/trace"
+)
+
+// Recommendation is a ready-to-use rule for one algorithm, along with how it performed on the trace.
+type Recommendation struct {
+	Algorithm string  `json:"algorithm"`
+	Rate      float64 `json:"rate,omitempty"`   // Bucket algorithms only.
+	Burst     int     `json:"burst,omitempty"`  // Bucket algorithms only.
+	Limit     int     `json:"limit,omitempty"`  // Window algorithms only.
+	Window    string  `json:"window,omitempty"` // Window algorithms only.
+
+	NormalDenyRate   float64 `json:"normal_deny_rate"`   // Denial rate of normal clients at the target percentile.
+	OffenderDenyRate float64 `json:"offender_deny_rate"` // Fraction of top offender requests denied.
+}
+
+// Target describes what the recommended parameters have to achieve.
+type Target struct {
+	Percentile float64 // Percentile of normal clients, by denial rate, the limit applies to.
+	MaxDeny    float64 // Highest acceptable denial rate for a normal client at that percentile.
+	Offenders  float64 // Fraction of keys, by request count, treated as top offenders.
+}
+
+// validate reports the first target setting that is out of range.
+func (t Target) validate() error {
+	if !(t.Offenders >= 0 && t.Offenders <= 1) {
+		return fmt.Errorf("offenders must be a fraction from 0 to 1, got %g", t.Offenders)
+	}
+	return nil
+}
+
+// evaluation is the outcome of replaying a trace with one set of parameters.
+type evaluation struct {
+	params       sim.Params
+	normalDeny   float64
+	offenderDeny float64
+}
+
+// tuner searches parameters for one algorithm over a fixed trace.
+type tuner struct {
+	requests  []trace.Request
+	algorithm string
+	target    Target
+	offenders map[string]bool
+}
+
+// newTuner splits the trace's keys into offenders and normal clients.
+func newTuner(requests []trace.Request, algorithm string, target Target) *tuner {
+	counts := make(map[string]int)
+	for _, req := range requests {
+		counts[req.Key]++
+	}
+
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	offenders := make(map[string]bool)
+	for _, key := range keys[:int(math.Ceil(target.Offenders*float64(len(keys))))] {
+		offenders[key] = true
+	}
+
+	return &tuner{
+		requests:  requests,
+		algorithm: algorithm,
+		target:    target,
+		offenders: offenders,
+	}
+}
+
+// evaluate replays the trace with the given parameters.
+func (t *tuner) evaluate(params sim.Params) evaluation {
+	l, _ := sim.New(t.algorithm, params)
+
+	type outcome struct{ requests, denied int }
+	outcomes := make(map[string]*outcome)
+	offenderRequests, offenderDenied := 0, 0
+
+	for _, req := range t.requests {
+		allowed := l.Allow(req.Key, req.Time)
+		if t.offenders[req.Key] {
+			offenderRequests++
+			if !allowed {
+				offenderDenied++
+			}
+			continue
+		}
+
+		o, exists := outcomes[req.Key]
+		if !exists {
+			o = &outcome{}
+			outcomes[req.Key] = o
+		}
+		o.requests++
+		if !allowed {
+			o.denied++
+		}
+	}
+
+	rates := make([]float64, 0, len(outcomes))
+	for _, o := range outcomes {
+		rates = append(rates, float64(o.denied)/float64(o.requests))
+	}
+
+	e := evaluation{params: params, normalDeny: percentile(rates, t.target.Percentile)}
+	if offenderRequests > 0 {
+		e.offenderDeny = float64(offenderDenied) / float64(offenderRequests)
+	}
+	return e
+}
+
+// acceptable reports whether normal clients are treated well enough.
+func (t *tuner) acceptable(e evaluation) bool {
+	return e.normalDeny <= t.target.MaxDeny
+}
+
+// smallest binary searches the smallest value in [1, upper] for which the parameters
+// made by set are acceptable. Larger values never deny more, so the search is valid.
+func (t *tuner) smallest(upper int, set func(n int) sim.Params) evaluation {
+	lo, hi := 1, upper
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if t.acceptable(t.evaluate(set(mid))) {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return t.evaluate(set(lo))
+}
+
+// recommend returns the acceptable parameters that deny the most offender requests.
+func (t *tuner) recommend(windows []time.Duration) (Recommendation, error) {
+	// Allowing every request of the busiest normal client in a single burst is always acceptable.
+	maxRequests := 1
+	counts := make(map[string]int)
+	for _, req := range t.requests {
+		if counts[req.Key]++; !t.offenders[req.Key] {
+			maxRequests = max(maxRequests, counts[req.Key])
+		}
+	}
+
+	var candidates []evaluation
+	switch t.algorithm {
+	case "tokenbucket", "leakybucket":
+		for _, rate := range candidateRates(t.requests) {
+			candidates = append(candidates, t.smallest(maxRequests, func(burst int) sim.Params {
+				return sim.Params{Rate: rate, Burst: burst}
+			}))
+		}
+	case "fixedwindow", "slidinglog", "slidingwindow":
+		for _, window := range windows {
+			candidates = append(candidates, t.smallest(maxRequests, func(limit int) sim.Params {
+				return sim.Params{Limit: limit, Window: window}
+			}))
+		}
+	default:
+		return Recommendation{}, fmt.Errorf("unknown algorithm %q", t.algorithm)
+	}
+
+	var best *evaluation
+	for i, e := range candidates {
+		if !t.acceptable(e) {
+			continue
+		}
+		if best == nil || e.offenderDeny > best.offenderDeny {
+			best = &candidates[i]
+		}
+	}
+	if best == nil {
+		return Recommendation{}, fmt.Errorf("no parameters keep normal clients under the target")
+	}
+
+	rec := Recommendation{
+		Algorithm:        t.algorithm,
+		NormalDenyRate:   best.normalDeny,
+		OffenderDenyRate: best.offenderDeny,
+	}
+	if best.params.Window > 0 {
+		rec.Limit = best.params.Limit
+		rec.Window = best.params.Window.String()
+	} else {
+		rec.Rate = best.params.Rate
+		rec.Burst = best.params.Burst
+	}
+	return rec, nil
+}
+
+// candidateRates returns whole rates per second from 1 up to the busiest second in the trace,
+// roughly doubling each time.
+func candidateRates(requests []trace.Request) []float64 {
+	perSecond := make(map[string]map[int64]int)
+	peak := 1
+	for _, req := range requests {
+		seconds, exists := perSecond[req.Key]
+		if !exists {
+			seconds = make(map[int64]int)
+			perSecond[req.Key] = seconds
+		}
+		seconds[req.Time.Unix()]++
+		peak = max(peak, seconds[req.Time.Unix()])
+	}
+
+	rates := []float64{1}
+	for scale := 1; ; scale *= 10 {
+		for _, step := range []int{2, 3, 5, 10} {
+			if step*scale > peak {
+				return rates
+			}
+			rates = append(rates, float64(step*scale))
+		}
+	}
+}
+
+// percentile returns the p-th percentile of values using the nearest rank method.
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	rank := int(math.Ceil(p / 100 * float64(len(values))))
+	return values[min(max(rank, 1), len(values))-1]
+}
+
+func main() {
+	algorithm := flag.String("algorithm", "tokenbucket", "algorithm to tune: "+fmt.Sprint(sim.Algorithms))
+	pct := flag.Float64("percentile", 99, "percentile of normal clients the denial target applies to")
+	maxDeny := flag.Float64("max-deny", 0, "highest acceptable denial rate for normal clients, from 0 to 1")
+	offenders := flag.Float64("offenders", 0.01, "fraction of busiest keys treated as top offenders")
+	window := flag.Duration("window", 0, "window length for window algorithms; by default 1s, 10s, 1m and 1h are tried")
+	flag.Parse()
+
+	target := Target{Percentile: *pct, MaxDeny: *maxDeny, Offenders: *offenders}
+	if err := target.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	input := io.Reader(os.Stdin)
+	if flag.NArg() > 0 {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		input = f
+	}
+
+	requests, err := trace.Read(input)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "read trace:", err)
+		os.Exit(1)
+	}
+
+	windows := []time.Duration{time.Second, 10 * time.Second, time.Minute, time.Hour}
+	if *window > 0 {
+		windows = []time.Duration{*window}
+	}
+
+	rec, err := newTuner(requests, *algorithm, target).recommend(windows)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(rec)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/nesyor/ratelimiter/internal/trace"
+)
+
+// testTrace has 99 normal clients making a burst of 3 requests every second and one
+// offender making 50 requests per second, for 10 seconds.
+func testTrace() []trace.Request {
+	start := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	var requests []trace.Request
+	for second := 0; second < 10; second++ {
+		at := start.Add(time.Duration(second) * time.Second)
+		for client := 0; client < 99; client++ {
+			for i := 0; i < 3; i++ {
+				requests = append(requests, trace.Request{Time: at, Key: fmt.Sprintf("10.0.0.%d", client)})
+			}
+		}
+		for i := 0; i < 50; i++ {
+			requests = append(requests, trace.Request{Time: at.Add(time.Duration(i) * 20 * time.Millisecond), Key: "offender"})
+		}
+	}
+	trace.Sort(requests)
+	return requests
+}
+
+func TestRecommend(t *testing.T) {
+	target := Target{Percentile: 99, MaxDeny: 0, Offenders: 0.01}
+
+	tests := []struct {
+		algorithm string
+		check     func(Recommendation) bool
+	}{
+		// Normal bursts of 3 need a capacity of at least 3.
+		{"tokenbucket", func(r Recommendation) bool { return r.Burst >= 3 && r.Rate >= 1 }},
+		{"leakybucket", func(r Recommendation) bool { return r.Burst >= 3 && r.Rate >= 1 }},
+		// 3 requests per second, and no more than 30 in 10 seconds or 3 per second.
+		{"slidinglog", func(r Recommendation) bool { return float64(r.Limit)/parseDuration(r.Window).Seconds() == 3 }},
+		{"fixedwindow", func(r Recommendation) bool { return r.Limit == 3 && r.Window == "1s" }},
+	}
+
+	for _, test := range tests {
+		rec, err := newTuner(testTrace(), test.algorithm, target).recommend([]time.Duration{time.Second, 10 * time.Second})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.algorithm, err)
+		}
+		if rec.NormalDenyRate != 0 {
+			t.Errorf("%s: expected no denials for normal clients but got %v", test.algorithm, rec.NormalDenyRate)
+		}
+		if rec.OffenderDenyRate < 0.9 {
+			t.Errorf("%s: expected the offender to be capped but only %v was denied", test.algorithm, rec.OffenderDenyRate)
+		}
+		if !test.check(rec) {
+			t.Errorf("%s: unexpected recommendation %+v", test.algorithm, rec)
+		}
+	}
+}
+
+func TestRecommendUnknownAlgorithm(t *testing.T) {
+	if _, err := newTuner(testTrace(), "nope", Target{}).recommend(nil); err == nil {
+		t.Error("expected an error for an unknown algorithm")
+	}
+}
+
+func TestTargetValidate(t *testing.T) {
+	for _, offenders := range []float64{-0.1, 1.5, math.NaN()} {
+		if err := (Target{Percentile: 99, Offenders: offenders}).validate(); err == nil {
+			t.Errorf("expected an error for offenders of %g", offenders)
+		}
+	}
+	for _, offenders := range []float64{0, 0.01, 1} {
+		if err := (Target{Percentile: 99, Offenders: offenders}).validate(); err != nil {
+			t.Errorf("unexpected error for offenders of %g: %v", offenders, err)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	values := []float64{0.5, 0, 0, 0.1, 0}
+	if p := percentile(values, 80); p != 0.1 {
+		t.Errorf("expected 80th percentile of 0.1 but got %v", p)
+	}
+	if p := percentile(values, 100); p != 0.5 {
+		t.Errorf("expected 100th percentile of 0.5 but got %v", p)
+	}
+	if p := percentile(nil, 99); p != 0 {
+		t.Errorf("expected 0 for no values but got %v", p)
+	}
+}
+
+func parseDuration(s string) time.Duration {
+	d, _ := time.ParseDuration(s)
+	return d
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nesyor/ratelimiter/internal/conformance"
+)
+
+func TestRateLimiterConformance(t *testing.T) {
+	// Weighing the previous window only approximates a sliding window: right after a
+	// full window twice the limit can fall within one window length. It also assumes
+	// the previous window's requests were spread evenly, while a client that requests
+	// as fast as allowed bunches them at the end of each window and gets one request
+	// per window less than the limit. The sustained checks run for 20 windows, so they
+	// come up 20 requests short, and a few more in the windows they start and end in.
+	spec := conformance.Spec{Burst: 5, Rate: 5, MaxBurst: 10, Slack: 22}
+	conformance.Run(t, spec, func(clock *conformance.Clock) conformance.Limiter {
+		rl := mustNewRateLimiter(t, 5, time.Second, 0.001, 0.01)
+		rl.now = clock.Now
+		return rl
+	})
+}
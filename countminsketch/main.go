@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"hash/maphash"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/nesyor/ratelimiter/internal/audit"
+)
+
+// Sketch is a count-min sketch: depth rows of width counters, each key counted in one
+// counter per row. A key's count is the smallest of its counters, which is never less
+// than the true count and, with probability at least 1-delta, exceeds it by at most
+// epsilon times the total of all counts.
+type Sketch struct {
+	width  int
+	depth  int
+	counts []uint32 // depth rows of width counters.
+	total  uint64   // Sum of everything added.
+	seed   maphash.Seed
+}
+
+// maxCounters bounds the size of a sketch, at 1 GiB of counters.
+const maxCounters = 1 << 28
+
+// NewSketch creates a sketch that overcounts by at most epsilon times the total count
+// with probability at least 1-delta. It uses ceil(e/epsilon) * ceil(ln(1/delta))
+// four byte counters, whatever the number of keys. Epsilon must be positive and delta
+// between 0 and 1, exclusive.
+func NewSketch(epsilon, delta float64) (*Sketch, error) {
+	if err := checkAccuracy(epsilon, delta); err != nil {
+		return nil, err
+	}
+	return newSketch(epsilon, delta), nil
+}
+
+// checkAccuracy returns an error if a sketch cannot have the error epsilon with
+// probability 1-delta, or would need more than maxCounters counters for it.
+func checkAccuracy(epsilon, delta float64) error {
+	// Written so that NaN fails the checks too.
+	if !(epsilon > 0) {
+		return fmt.Errorf("countminsketch: epsilon must be positive, got %g", epsilon)
+	}
+	if !(delta > 0 && delta < 1) {
+		return fmt.Errorf("countminsketch: delta must be between 0 and 1, got %g", delta)
+	}
+	if counters := math.Ceil(math.E/epsilon) * math.Ceil(math.Log(1/delta)); counters > maxCounters {
+		return fmt.Errorf("countminsketch: epsilon %g and delta %g need %.0f counters, more than %d", epsilon, delta, counters, maxCounters)
+	}
+	return nil
+}
+
+// newSketch creates a sketch for an epsilon and delta already known to be valid.
+func newSketch(epsilon, delta float64) *Sketch {
+	width := int(math.Ceil(math.E / epsilon))
+	depth := max(int(math.Ceil(math.Log(1/delta))), 1)
+	return &Sketch{
+		width:  width,
+		depth:  depth,
+		counts: make([]uint32, width*depth),
+		seed:   maphash.MakeSeed(),
+	}
+}
+
+// indexes returns the counter of key in every row. The seed is random per sketch, so
+// clients cannot pick keys that collide with a victim's on purpose.
+func (s *Sketch) indexes(key string) []int {
+	// Rows use the double hashing h1 + i*h2 of a single 64 bit hash.
+	h := maphash.String(s.seed, key)
+	h1, h2 := h&math.MaxUint32, h>>32|1
+
+	idx := make([]int, s.depth)
+	for i := range idx {
+		idx[i] = i*s.width + int((h1+uint64(i)*h2)%uint64(s.width))
+	}
+	return idx
+}
+
+// Count returns the estimated count of key.
+func (s *Sketch) Count(key string) uint32 {
+	return s.min(s.indexes(key))
+}
+
+func (s *Sketch) min(idx []int) uint32 {
+	count := uint32(math.MaxUint32)
+	for _, i := range idx {
+		count = min(count, s.counts[i])
+	}
+	return count
+}
+
+// Add counts n more for key and returns its new estimate. Only the counters that are
+// below the new estimate are raised (conservative update), which keeps every estimate
+// an overcount but lowers the error in practice.
+func (s *Sketch) Add(key string, n uint32) uint32 {
+	idx := s.indexes(key)
+	count := s.min(idx)
+	if count > math.MaxUint32-n {
+		count = math.MaxUint32
+	} else {
+		count += n
+	}
+	for _, i := range idx {
+		s.counts[i] = max(s.counts[i], count)
+	}
+	s.total += uint64(n)
+	return count
+}
+
+// Total returns the sum of everything added since the last reset.
+func (s *Sketch) Total() uint64 {
+	return s.total
+}
+
+// Bytes returns the memory used by the counters.
+func (s *Sketch) Bytes() int {
+	return len(s.counts) * 4
+}
+
+// Reset clears all counts.
+func (s *Sketch) Reset() {
+	clear(s.counts)
+	s.total = 0
+}
+
+// RateLimiter allows limit requests per key per sliding window in constant memory,
+// however many keys there are. It counts requests of the current and the previous
+// fixed window in a sketch each, and weighs the previous window by how much of it
+// still overlaps the sliding window.
+//
+// Weighing the previous window assumes its requests were spread evenly over it. If
+// they came at its end, the estimate undercounts the sliding window: a key never gets
+// more than limit requests within one fixed window, but up to twice limit within one
+// window's length across a boundary. A key requesting as fast as allowed bunches its
+// requests like that, and in turn sustains about one request per window less than
+// limit.
+//
+// The sketches themselves never undercount, so their errors only deny a key early:
+// with probability at least 1-delta its estimate exceeds its true count by at most
+// ErrorBound, epsilon times the requests allowed in the current and previous window.
+// If keys make about limit requests each, choose epsilon well below one over the
+// number of active keys to keep the bound below limit.
+type RateLimiter struct {
+	audit.Sink // Optional log of decisions, see SetAuditHandler.
+
+	limit       int
+	window      time.Duration
+	epsilon     float64
+	current     *Sketch
+	previous    *Sketch
+	windowStart time.Time // Start of the window counted in current.
+	now         func() time.Time
+	mu          sync.Mutex
+}
+
+// NewRateLimiter creates a limiter allowing limit requests per window and key, whose
+// estimates are within epsilon times the recent requests with probability 1-delta.
+// The window and epsilon must be positive and delta between 0 and 1, exclusive.
+func NewRateLimiter(limit int, window time.Duration, epsilon, delta float64) (*RateLimiter, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("countminsketch: window must be positive, got %s", window)
+	}
+	if err := checkAccuracy(epsilon, delta); err != nil {
+		return nil, err
+	}
+	return &RateLimiter{
+		limit:    limit,
+		window:   window,
+		epsilon:  epsilon,
+		current:  newSketch(epsilon, delta),
+		previous: newSketch(epsilon, delta),
+		now:      time.Now,
+	}, nil
+}
+
+// rotate moves to the window containing now. The caller must hold rl.mu.
+func (rl *RateLimiter) rotate(now time.Time) {
+	start := now.Truncate(rl.window)
+	switch {
+	case rl.windowStart.IsZero():
+		rl.windowStart = start
+	case start.Equal(rl.windowStart.Add(rl.window)):
+		// The current window becomes the previous one.
+		rl.previous, rl.current = rl.current, rl.previous
+		rl.current.Reset()
+		rl.windowStart = start
+	case start.After(rl.windowStart):
+		// More than a whole window passed without requests.
+		rl.previous.Reset()
+		rl.current.Reset()
+		rl.windowStart = start
+	case start.Before(rl.windowStart):
+		// The clock went back, e.g. after an NTP correction. Keep the counts but move
+		// the window back with it, so keys are not limited until the clock catches up.
+		rl.windowStart = start
+	}
+}
+
+// estimate returns the estimated requests of key in the sliding window ending at now.
+// The caller must hold rl.mu.
+func (rl *RateLimiter) estimate(key string, now time.Time) float64 {
+	overlap := 1 - float64(now.Sub(rl.windowStart))/float64(rl.window)
+	return float64(rl.previous.Count(key))*overlap + float64(rl.current.Count(key))
+}
+
+func (rl *RateLimiter) Allow(key string) bool {
+	logger := rl.AuditLogger()
+	allowed, record := rl.decide(key, logger != nil)
+	if record != nil {
+		// Logged after rl.mu is released, since the handler may do I/O.
+		logger.Log(*record)
+	}
+	return allowed
+}
+
+// decide makes the decision for Allow, describing it in a record if audited.
+func (rl *RateLimiter) decide(key string, audited bool) (bool, *audit.Record) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	rl.rotate(now)
+
+	used := rl.estimate(key, now)
+	allowed := used+1 <= float64(rl.limit)
+	if allowed {
+		rl.current.Add(key, 1)
+		used++
+	}
+
+	if !audited {
+		return allowed, nil
+	}
+	return allowed, &audit.Record{
+		Key:       key,
+		Rule:      fmt.Sprintf("%d/%s", rl.limit, rl.window),
+		Algorithm: "countminsketch",
+		Allowed:   allowed,
+		Remaining: max(float64(rl.limit)-used, 0),
+		Cost:      1,
+	}
+}
+
+// ErrorBound returns how many requests a key's estimate may currently exceed its true
+// count by, with probability at least 1-delta.
+func (rl *RateLimiter) ErrorBound() float64 {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.rotate(rl.now())
+	return rl.epsilon * float64(rl.current.Total()+rl.previous.Total())
+}
+
+// Bytes returns the memory used by the limiter's counters, which does not grow with
+// the number of keys.
+func (rl *RateLimiter) Bytes() int {
+	return rl.current.Bytes() + rl.previous.Bytes()
+}
+
+func main() {
+	// Within 0.001% of the recent requests for 99.9% of keys.
+	rl, err := NewRateLimiter(5, time.Second, 0.00001, 0.001)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// A flood of requests from 100k spoofed addresses...
+	for i := 0; i < 100_000; i++ {
+		rl.Allow(fmt.Sprintf("10.%d.%d.%d", i>>16&255, i>>8&255, i&255))
+	}
+	fmt.Printf("Counted 100k keys in %d KB, error bound %.0f requests\n", rl.Bytes()/1024, rl.ErrorBound())
+
+	// ...barely affects regular clients.
+	for i := 0; i < 7; i++ {
+		if rl.Allow("192.168.1.1") {
+			fmt.Println("Request from 192.168.1.1 allowed!")
+		} else {
+			fmt.Println("Request from 192.168.1.1 denied!")
+		}
+	}
+}
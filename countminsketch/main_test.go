@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// mustNewRateLimiter creates a limiter or fails the test.
+func mustNewRateLimiter(t *testing.T, limit int, window time.Duration, epsilon, delta float64) *RateLimiter {
+	t.Helper()
+	rl, err := NewRateLimiter(limit, window, epsilon, delta)
+	if err != nil {
+		t.Fatalf("failed to create limiter: %v", err)
+	}
+	return rl
+}
+
+// Test that estimates never undercount and stay within the documented error bound
+func TestSketchErrorBound(t *testing.T) {
+	epsilon, delta := 0.001, 0.01
+	s := newSketch(epsilon, delta)
+
+	// A skewed workload: a few heavy keys and a long tail of light ones.
+	r := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(r, 1.1, 1, 49_999)
+	counts := make(map[string]uint32)
+	for i := 0; i < 200_000; i++ {
+		key := fmt.Sprintf("key-%d", zipf.Uint64())
+		counts[key]++
+		s.Add(key, 1)
+	}
+
+	bound := epsilon * float64(s.Total())
+	exceeded := 0
+	for key, count := range counts {
+		estimate := s.Count(key)
+		if estimate < count {
+			t.Fatalf("expected %s to be counted at least %d times but got %d", key, count, estimate)
+		}
+		if float64(estimate-count) > bound {
+			exceeded++
+		}
+	}
+	if rate := float64(exceeded) / float64(len(counts)); rate > delta {
+		t.Errorf("expected at most %.0f%% of keys beyond the bound of %.0f but got %.2f%%", delta*100, bound, rate*100)
+	}
+}
+
+func TestSketchSize(t *testing.T) {
+	s, err := NewSketch(0.01, 0.01)
+	if err != nil {
+		t.Fatalf("failed to create sketch: %v", err)
+	}
+	// ceil(e/0.01) = 272 counters per row, ceil(ln 100) = 5 rows.
+	if s.width != 272 || s.depth != 5 || s.Bytes() != 272*5*4 {
+		t.Fatalf("unexpected sketch of %d x %d counters", s.width, s.depth)
+	}
+
+	for i := 0; i < 100_000; i++ {
+		s.Add(fmt.Sprint(i), 1)
+	}
+	if s.Bytes() != 272*5*4 {
+		t.Errorf("expected the sketch not to grow but it uses %d bytes", s.Bytes())
+	}
+
+	s.Reset()
+	if s.Count("1") != 0 || s.Total() != 0 {
+		t.Error("expected Reset to clear all counts")
+	}
+}
+
+// Test that sketches that cannot meet their error bound, or would not fit in memory,
+// are rejected
+func TestNewSketchRejectsInvalidAccuracy(t *testing.T) {
+	tests := []struct{ epsilon, delta float64 }{
+		{0, 0.01},
+		{-0.1, 0.01},
+		{math.NaN(), 0.01},
+		{0.01, 0},
+		{0.01, 1},
+		{0.01, 1.5},
+		{0.01, math.NaN()},
+		{1e-12, 0.01},
+	}
+	for _, tt := range tests {
+		if _, err := NewSketch(tt.epsilon, tt.delta); err == nil {
+			t.Errorf("expected an error for epsilon %g and delta %g", tt.epsilon, tt.delta)
+		}
+		if _, err := NewRateLimiter(5, time.Second, tt.epsilon, tt.delta); err == nil {
+			t.Errorf("expected the limiter to reject epsilon %g and delta %g", tt.epsilon, tt.delta)
+		}
+	}
+	if _, err := NewRateLimiter(5, 0, 0.01, 0.01); err == nil {
+		t.Error("expected an error for a window of 0")
+	}
+}
+
+func newTestLimiter(t *testing.T, limit int, window time.Duration) (*RateLimiter, *time.Time) {
+	rl := mustNewRateLimiter(t, limit, window, 0.001, 0.01)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	rl.now = func() time.Time { return now }
+	return rl, &now
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl, now := newTestLimiter(t, 3, time.Second)
+
+	for i := 0; i < 3; i++ {
+		if !rl.Allow("192.168.1.1") {
+			t.Fatalf("expected request %d to be allowed", i+1)
+		}
+	}
+	if rl.Allow("192.168.1.1") {
+		t.Fatal("expected request to be denied after the limit")
+	}
+	if !rl.Allow("192.168.1.2") {
+		t.Fatal("expected other keys to have their own limit")
+	}
+
+	// Halfway through the next window half of the previous window still counts.
+	*now = now.Add(1500 * time.Millisecond)
+	if !rl.Allow("192.168.1.1") || rl.Allow("192.168.1.1") {
+		t.Fatal("expected one request to be allowed with 1.5 of 3 requests still in the window")
+	}
+
+	// After two idle windows everything is forgotten.
+	*now = now.Add(2 * time.Second)
+	for i := 0; i < 3; i++ {
+		if !rl.Allow("192.168.1.1") {
+			t.Fatalf("expected request %d to be allowed after idle windows", i+1)
+		}
+	}
+}
+
+// Test that a flood of keys neither lets any key past its limit nor denies others
+// by more than the error bound
+func TestRateLimiterManyKeys(t *testing.T) {
+	limit := 10
+	rl := mustNewRateLimiter(t, limit, time.Minute, 0.0001, 0.01)
+	rl.now = func() time.Time { return time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC) }
+
+	for i := 0; i < 20_000; i++ {
+		rl.Allow(fmt.Sprintf("flood-%d", i))
+	}
+
+	bound := rl.ErrorBound()
+	short := 0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("client-%d", i)
+		allowed := 0
+		for j := 0; j < 2*limit; j++ {
+			if rl.Allow(key) {
+				allowed++
+			}
+		}
+		if allowed > limit {
+			t.Fatalf("expected %s to be allowed at most %d requests but got %d", key, limit, allowed)
+		}
+		if float64(allowed) < float64(limit)-bound {
+			short++
+		}
+	}
+	if short > 10 {
+		t.Errorf("expected at most 1%% of clients denied beyond the bound of %.0f but got %d", bound, short)
+	}
+}
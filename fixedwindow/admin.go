@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nesyor/ratelimiter/internal/admin"
+)
+
+// keyState is what the admin API shows for a single IP.
+type keyState struct {
+	Count    int       `json:"count"`
+	Limit    int       `json:"limit"`
+	ResetAt  time.Time `json:"reset_at"`
+	Credit   int       `json:"credit"`
+	Override *int      `json:"override,omitempty"`
+}
+
+// override is the admin API's per-key limit document, e.g. {"limit": 100}.
+type override struct {
+	Limit int `json:"limit"`
+}
+
+// Keys returns the IPs that have a window.
+func (rl *RateLimiter) Keys() []string {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	keys := make([]string, 0, len(rl.windows))
+	for ip := range rl.windows {
+		keys = append(keys, ip)
+	}
+	return keys
+}
+
+// State returns the current window of ip.
+func (rl *RateLimiter) State(ip string) (any, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	window, exists := rl.windows[ip]
+	if !exists {
+		return nil, admin.ErrUnknownKey
+	}
+	now := rl.now()
+	rl.clampWindow(ip, window, now)
+
+	state := keyState{
+		Count:   window.count,
+		Limit:   rl.limitFor(ip),
+		ResetAt: window.expireTime,
+		Credit:  rl.credits.Remaining(ip),
+	}
+	if !now.Before(window.expireTime) {
+		state.Count = 0
+	}
+	if limit, ok := rl.overrides[ip]; ok {
+		state.Override = &limit
+	}
+	return state, nil
+}
+
+// Reset removes ip's window, so its next request starts a new one.
+// Any credit granted to ip is cleared as well.
+func (rl *RateLimiter) Reset(ip string) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.credits.Clear(ip)
+	if _, exists := rl.windows[ip]; !exists {
+		return admin.ErrUnknownKey
+	}
+	delete(rl.windows, ip)
+	return nil
+}
+
+// Grant allows ip amount requests beyond its limit until ttl from now.
+func (rl *RateLimiter) Grant(ip string, amount int, ttl time.Duration) {
+	rl.credits.Grant(ip, amount, ttl)
+}
+
+// SetOverride gives ip its own limit per window.
+func (rl *RateLimiter) SetOverride(ip string, raw json.RawMessage) error {
+	var o override
+	if err := json.Unmarshal(raw, &o); err != nil {
+		return err
+	}
+	if o.Limit <= 0 {
+		return fmt.Errorf("override needs a positive limit")
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.overrides[ip] = o.Limit
+	return nil
+}
+
+// ClearOverride returns ip to the default limit.
+func (rl *RateLimiter) ClearOverride(ip string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	delete(rl.overrides, ip)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nesyor/ratelimiter/internal/conformance"
+)
+
+func TestRateLimiterConformance(t *testing.T) {
+	// Up to twice the limit fits around a window boundary.
+	spec := conformance.Spec{Burst: 5, Rate: 5, MaxBurst: 10, Model: conformance.FixedWindow(5, time.Second)}
+	conformance.Run(t, spec, func(clock *conformance.Clock) conformance.Limiter {
+		rl := newRateLimiter(5, time.Second, FirstRequest)
+		rl.now = clock.Now
+		return rl
+	})
+}
+
+func TestRateLimiterConformanceAligned(t *testing.T) {
+	for _, alignment := range []Alignment{EpochAligned, Jittered} {
+		// Aligned windows can start just before a key's first request, so even a fresh
+		// key may get up to twice the limit at once; the suite's clock starts on a
+		// window boundary for epoch aligned windows.
+		spec := conformance.Spec{Burst: 5, Rate: 5, MaxBurst: 10, Slack: 5}
+		conformance.Run(t, spec, func(clock *conformance.Clock) conformance.Limiter {
+			rl := newRateLimiter(5, time.Second, alignment)
+			rl.now = clock.Now
+			return rl
+		})
+	}
+}
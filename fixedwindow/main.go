@@ -1,14 +1,41 @@
 package main
 
 import (
+	"fmt"
+	"hash/fnv"
 	"sync"
 	"time"
+
+	"github.com/nesyor/ratelimiter/internal/admin"
+	"github.com/nesyor/ratelimiter/internal/audit"
+)
+
+// Alignment controls where the boundaries of a fixed window fall.
+type Alignment int
+
+const (
+	// FirstRequest starts a key's window at its first request, so windows differ per client.
+	FirstRequest Alignment = iota
+	// EpochAligned starts every window at a multiple of the window duration since the Unix epoch,
+	// e.g. a one minute window always resets at :00.
+	EpochAligned
+	// Jittered aligns windows like EpochAligned but shifts each key by a stable per-key offset,
+	// so that clients do not all reset at the same instant.
+	Jittered
 )
 
 type RateLimiter struct {
-	requestsPerSecond int
-	windows           map[string]*Window
-	mu                sync.Mutex
+	audit.Sink    // Optional log of decisions, see SetAuditHandler.
+	admin.TopKeys // Optional tracker of the busiest keys, see SetTopK.
+
+	limit     int
+	window    time.Duration
+	alignment Alignment
+	windows   map[string]*Window
+	overrides map[string]int // Per-key limits set through the admin API.
+	credits   admin.Credits  // Extra requests granted through the admin API.
+	now       func() time.Time
+	mu        sync.Mutex
 }
 
 type Window struct {
@@ -16,27 +43,85 @@ type Window struct {
 	expireTime time.Time
 }
 
+// NewRateLimiter creates a limiter allowing rps requests per one second window.
 func NewRateLimiter(rps int) *RateLimiter {
+	return newRateLimiter(rps, time.Second, FirstRequest)
+}
+
+// NewWindowRateLimiter creates a limiter allowing limit requests per window, with
+// window boundaries placed according to alignment. The window must be positive.
+func NewWindowRateLimiter(limit int, window time.Duration, alignment Alignment) (*RateLimiter, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("fixedwindow: window must be positive, got %s", window)
+	}
+	return newRateLimiter(limit, window, alignment), nil
+}
+
+// newRateLimiter creates a limiter with a window already known to be positive.
+func newRateLimiter(limit int, window time.Duration, alignment Alignment) *RateLimiter {
 	return &RateLimiter{
-		requestsPerSecond: rps,
-		windows:           make(map[string]*Window),
+		limit:     limit,
+		window:    window,
+		alignment: alignment,
+		windows:   make(map[string]*Window),
+		overrides: make(map[string]int),
+		now:       time.Now,
 	}
 }
 
 func (rl *RateLimiter) Allow(ip string) bool {
+	logger := rl.AuditLogger()
+	allowed, record := rl.decide(ip, logger != nil)
+	if record != nil {
+		// Logged after rl.mu is released, since the handler may do I/O.
+		logger.Log(*record)
+	}
+	return allowed
+}
+
+// decide makes the decision for Allow, describing it in a record if audited.
+func (rl *RateLimiter) decide(ip string, audited bool) (bool, *audit.Record) {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
-	now := time.Now()
+	now := rl.now()
+	allowed := rl.allow(ip, now)
+	if !allowed && rl.credits.Take(ip) {
+		// Credit granted through the admin API covers the request.
+		allowed = true
+	}
+	rl.RecordTop(ip, allowed)
+
+	if !audited {
+		return allowed, nil
+	}
+	window := rl.windows[ip]
+	record := &audit.Record{
+		Key:       ip,
+		Rule:      fmt.Sprintf("%d/%s", rl.limitFor(ip), rl.window),
+		Algorithm: "fixedwindow",
+		Allowed:   allowed,
+		Remaining: float64(max(rl.limitFor(ip)-window.count, 0)),
+		Cost:      1,
+	}
+	if !allowed {
+		record.RetryAfter = window.expireTime.Sub(now)
+	}
+	return allowed, record
+}
+
+// allow makes the decision for Allow. The caller must hold rl.mu.
+func (rl *RateLimiter) allow(ip string, now time.Time) bool {
 	if window, exists := rl.windows[ip]; exists {
-		if now.After(window.expireTime) {
+		rl.clampWindow(ip, window, now)
+		if !now.Before(window.expireTime) {
 			// Expired window, reset
 			rl.windows[ip] = &Window{
 				count:      1,
-				expireTime: now.Add(1 * time.Second),
+				expireTime: rl.windowEnd(ip, now),
 			}
 			return true
-		} else if window.count < rl.requestsPerSecond {
+		} else if window.count < rl.limitFor(ip) {
 			// Existing window, still has capacity
 			window.count++
 			return true
@@ -48,12 +133,90 @@ func (rl *RateLimiter) Allow(ip string) bool {
 		// New window for this IP
 		rl.windows[ip] = &Window{
 			count:      1,
-			expireTime: now.Add(1 * time.Second),
+			expireTime: rl.windowEnd(ip, now),
 		}
 		return true
 	}
 }
 
+// ResetTime returns when the current window for ip ends and its count starts over.
+// For aligned windows this is known even before the first request.
+func (rl *RateLimiter) ResetTime(ip string) time.Time {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	if window, exists := rl.windows[ip]; exists {
+		rl.clampWindow(ip, window, now)
+		if now.Before(window.expireTime) {
+			return window.expireTime
+		}
+	}
+	return rl.windowEnd(ip, now)
+}
+
+// Remaining returns how many more requests ip may make in its current window.
+func (rl *RateLimiter) Remaining(ip string) int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	if window, exists := rl.windows[ip]; exists {
+		rl.clampWindow(ip, window, now)
+		if now.Before(window.expireTime) {
+			return max(rl.limitFor(ip)-window.count, 0)
+		}
+	}
+	return rl.limitFor(ip)
+}
+
+// limitFor returns the number of requests ip may make per window. The caller must hold rl.mu.
+func (rl *RateLimiter) limitFor(ip string) int {
+	if limit, ok := rl.overrides[ip]; ok {
+		return limit
+	}
+	return rl.limit
+}
+
+// clampWindow shortens window if the clock went back since it started, e.g. after an
+// NTP correction, so that it never lasts longer than a window starting now would and
+// the key is not locked out until the clock catches up again. The count is kept.
+// The caller must hold rl.mu.
+func (rl *RateLimiter) clampWindow(ip string, window *Window, now time.Time) {
+	if end := rl.windowEnd(ip, now); window.expireTime.After(end) {
+		window.expireTime = end
+	}
+}
+
+// windowEnd returns the end of the window containing now for ip. Windows starting at
+// the first request end a window after now, keeping its monotonic clock reading if it
+// has one; aligned windows end at a wall clock time.
+func (rl *RateLimiter) windowEnd(ip string, now time.Time) time.Time {
+	if rl.alignment == FirstRequest {
+		return now.Add(rl.window)
+	}
+
+	size := int64(rl.window)
+	var offset int64
+	if rl.alignment == Jittered {
+		offset = keyOffset(ip, size)
+	}
+
+	// Windows are [epoch+offset+k*size, epoch+offset+(k+1)*size).
+	elapsed := (now.UnixNano() - offset) % size
+	if elapsed < 0 {
+		elapsed += size
+	}
+	return time.Unix(0, now.UnixNano()-elapsed+size)
+}
+
+// keyOffset returns a stable offset in [0, size) derived from the key.
+func keyOffset(key string, size int64) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int64(h.Sum64() % uint64(size))
+}
+
 func main() {
 	rl := NewRateLimiter(5)
 
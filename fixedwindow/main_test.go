@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"log/slog"
 	"sync"
 	"testing"
 	"time"
@@ -87,3 +90,121 @@ func TestRateLimiter_MultipleIPs(t *testing.T) {
 		}
 	}
 }
+
+// mustNewWindowRateLimiter creates a limiter or fails the test.
+func mustNewWindowRateLimiter(t *testing.T, limit int, window time.Duration, alignment Alignment) *RateLimiter {
+	t.Helper()
+	rl, err := NewWindowRateLimiter(limit, window, alignment)
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	return rl
+}
+
+func TestRateLimiter_ConfigurableWindow(t *testing.T) {
+	limit := 3
+	window := 200 * time.Millisecond
+	rl := mustNewWindowRateLimiter(t, limit, window, FirstRequest)
+	ip := "192.168.0.3"
+
+	for i := 0; i < limit; i++ {
+		if !rl.Allow(ip) {
+			t.Errorf("Request %d denied for IP %s but should have been allowed", i+1, ip)
+		}
+	}
+	if rl.Allow(ip) {
+		t.Errorf("Request exceeded limit for IP %s but was allowed", ip)
+	}
+	if remaining := rl.Remaining(ip); remaining != 0 {
+		t.Errorf("Expected 0 remaining requests for IP %s but got %d", ip, remaining)
+	}
+
+	time.Sleep(window)
+	if !rl.Allow(ip) {
+		t.Errorf("After waiting %v, request was denied for IP %s but should have been allowed", window, ip)
+	}
+}
+
+func TestRateLimiter_EpochAligned(t *testing.T) {
+	window := 100 * time.Millisecond
+	rl := mustNewWindowRateLimiter(t, 1, window, EpochAligned)
+
+	// Every key resets at the same multiple of the window since the epoch.
+	reset := rl.ResetTime("192.168.0.4")
+	if reset.UnixNano()%int64(window) != 0 {
+		t.Fatalf("Expected reset time %v to be aligned to %v", reset, window)
+	}
+	if other := rl.ResetTime("192.168.0.5"); !other.Equal(reset) {
+		t.Fatalf("Expected all keys to reset at %v but got %v", reset, other)
+	}
+
+	ip := "192.168.0.4"
+	if !rl.Allow(ip) {
+		t.Fatalf("Request denied for IP %s but should have been allowed", ip)
+	}
+	if rl.Allow(ip) {
+		t.Fatalf("Request exceeded limit for IP %s but was allowed", ip)
+	}
+
+	// The reported reset time is when the window actually starts over.
+	time.Sleep(time.Until(rl.ResetTime(ip)))
+	if !rl.Allow(ip) {
+		t.Fatalf("Request denied for IP %s after reset time but should have been allowed", ip)
+	}
+}
+
+func TestRateLimiter_Jittered(t *testing.T) {
+	window := time.Minute
+	rl := mustNewWindowRateLimiter(t, 1, window, Jittered)
+
+	offsets := make(map[int64]bool)
+	for i := 0; i < 10; i++ {
+		ip := fmt.Sprintf("192.168.0.%d", i)
+		reset := rl.ResetTime(ip)
+		if until := time.Until(reset); until <= 0 || until > window {
+			t.Fatalf("Expected reset time for IP %s within one window but got %v", ip, until)
+		}
+		// The per-key offset is stable across calls.
+		if again := rl.ResetTime(ip); !again.Equal(reset) {
+			t.Fatalf("Expected stable reset time %v for IP %s but got %v", reset, ip, again)
+		}
+		offsets[reset.UnixNano()%int64(window)] = true
+	}
+
+	if len(offsets) < 2 {
+		t.Fatalf("Expected jittered windows to reset at different offsets but got %d distinct", len(offsets))
+	}
+}
+
+func TestRateLimiter_InvalidWindow(t *testing.T) {
+	// Aligned windows divide by the window, so a window that is not positive must be rejected up front.
+	for _, alignment := range []Alignment{FirstRequest, EpochAligned, Jittered} {
+		for _, window := range []time.Duration{0, -time.Second} {
+			if _, err := NewWindowRateLimiter(1, window, alignment); err == nil {
+				t.Errorf("Expected an error for a window of %v with alignment %d", window, alignment)
+			}
+		}
+	}
+}
+
+func TestRateLimiter_AuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	rl := NewRateLimiter(1)
+	rl.SetAuditHandler(slog.NewJSONHandler(&buf, nil), 0)
+
+	ip := "192.168.0.6"
+	rl.Allow(ip)
+	rl.Allow(ip)
+
+	// Only the denial is logged with a sample rate of 0
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Expected a single JSON audit record but got %q", buf.String())
+	}
+	if record["decision"] != "deny" || record["key"] != ip || record["algorithm"] != "fixedwindow" || record["remaining"] != 0.0 {
+		t.Errorf("Unexpected audit record %v", record)
+	}
+	if retryAfter := record["retry_after"].(float64); retryAfter <= 0 || retryAfter > float64(time.Second) {
+		t.Errorf("Expected retry_after within the window but got %v", retryAfter)
+	}
+}
@@ -0,0 +1,334 @@
+// Package admin provides an HTTP API for inspecting and adjusting the per-key
+// state of a rate limiter, for example to help a wrongly throttled customer.
+//
+// All endpoints require an "Authorization: Bearer <token>" header:
+//
+//	GET    /keys                list tracked keys and their state
+//	GET    /keys/{key}          show a single key
+//	POST   /keys/{key}/reset    forget the key's state, as if it had never made a request
+//	POST   /keys/{key}/credit   grant extra requests, body {"amount": 10, "ttl": "10m"}
+//	PUT    /keys/{key}/override set per-key limits, body depends on the algorithm
+//	DELETE /keys/{key}/override remove per-key limits
+//	GET    /top?n=10            list the keys with the most requests and denials,
+//	                            if the limiter tracks them
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nesyor/ratelimiter/internal/topk"
+)
+
+// ErrUnknownKey is returned by Store methods for keys the limiter does not track.
+var ErrUnknownKey = errors.New("admin: unknown key")
+
+// Store is implemented by each limiter to expose its per-key state.
+type Store interface {
+	// Keys returns the keys the limiter currently tracks.
+	Keys() []string
+	// State returns a JSON-encodable description of key's state.
+	State(key string) (any, error)
+	// Reset forgets key's state, including credit granted to it.
+	Reset(key string) error
+	// Grant gives key amount extra requests that expire after ttl.
+	Grant(key string, amount int, ttl time.Duration)
+	// SetOverride sets per-key limits from an algorithm specific JSON document.
+	SetOverride(key string, override json.RawMessage) error
+	// ClearOverride removes per-key limits.
+	ClearOverride(key string)
+}
+
+// TopReporter is implemented by stores that can report their busiest keys.
+type TopReporter interface {
+	// Top returns the n keys with the most requests and denials, or false if the
+	// store does not track them.
+	Top(n int) (topk.Report, bool)
+}
+
+// KeyState pairs a key with its state for the listing endpoint.
+type KeyState struct {
+	Key   string `json:"key"`
+	State any    `json:"state"`
+}
+
+// creditRequest is the body of a credit request.
+type creditRequest struct {
+	Amount int    `json:"amount"`
+	TTL    string `json:"ttl"`
+}
+
+// RequireToken wraps h so that requests without the bearer token are rejected, for
+// serving other administrative endpoints next to Handler. An empty token rejects all requests.
+func RequireToken(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid bearer token"))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Handler serves the admin API for store. Requests without the bearer token are rejected.
+// Mount it with http.StripPrefix when serving it under a path prefix.
+func Handler(store Store, token string) http.Handler {
+	return RequireToken(token, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, err := url.PathUnescape(r.URL.EscapedPath())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		path = strings.TrimPrefix(path, "/")
+
+		if path == "keys" {
+			if r.Method != http.MethodGet {
+				writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+				return
+			}
+			listKeys(w, store)
+			return
+		}
+		if path == "top" {
+			if r.Method != http.MethodGet {
+				writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+				return
+			}
+			showTop(w, r, store)
+			return
+		}
+
+		key, found := strings.CutPrefix(path, "keys/")
+		if !found || key == "" {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no such endpoint /%s", path))
+			return
+		}
+
+		// Keys may contain slashes, so the action is recognised by its suffix.
+		action := ""
+		for _, suffix := range []string{"reset", "credit", "override"} {
+			if k, found := strings.CutSuffix(key, "/"+suffix); found {
+				key, action = k, suffix
+				break
+			}
+		}
+
+		switch {
+		case action == "" && r.Method == http.MethodGet:
+			showKey(w, store, key)
+		case action == "reset" && r.Method == http.MethodPost:
+			if err := store.Reset(key); err != nil {
+				writeError(w, http.StatusNotFound, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case action == "credit" && r.Method == http.MethodPost:
+			grantCredit(w, r, store, key)
+		case action == "override" && r.Method == http.MethodPut:
+			var override json.RawMessage
+			if err := json.NewDecoder(r.Body).Decode(&override); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := store.SetOverride(key, override); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case action == "override" && r.Method == http.MethodDelete:
+			store.ClearOverride(key)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		}
+	}))
+}
+
+// authorized checks the request's bearer token in constant time.
+func authorized(r *http.Request, token string) bool {
+	given, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return found && token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+func listKeys(w http.ResponseWriter, store Store) {
+	keys := store.Keys()
+	sort.Strings(keys)
+
+	states := make([]KeyState, 0, len(keys))
+	for _, key := range keys {
+		// Keys may disappear between listing and reading them.
+		if state, err := store.State(key); err == nil {
+			states = append(states, KeyState{Key: key, State: state})
+		}
+	}
+	writeJSON(w, http.StatusOK, states)
+}
+
+func showKey(w http.ResponseWriter, store Store, key string) {
+	state, err := store.State(key)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, KeyState{Key: key, State: state})
+}
+
+func showTop(w http.ResponseWriter, r *http.Request, store Store) {
+	n := 10
+	if s := r.URL.Query().Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("n must be a positive number"))
+			return
+		}
+	}
+
+	var report topk.Report
+	reporter, ok := store.(TopReporter)
+	if ok {
+		report, ok = reporter.Top(n)
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("top keys are not tracked"))
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func grantCredit(w http.ResponseWriter, r *http.Request, store Store, key string) {
+	var req creditRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil || ttl <= 0 || req.Amount <= 0 {
+		writeError(w, http.StatusBadRequest, errors.New("credit needs a positive amount and ttl"))
+		return
+	}
+
+	store.Grant(key, req.Amount, ttl)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// Credits keeps temporary per-key credit granted through the admin API. Limiters
+// spend a key's credit on requests they would otherwise deny.
+type Credits struct {
+	credits map[string]*credit
+	mu      sync.Mutex
+}
+
+// credit is extra requests that expire at a given time.
+type credit struct {
+	amount  int
+	expires time.Time
+}
+
+// Grant gives key amount extra requests until ttl from now, on top of any credit it still has.
+func (c *Credits) Grant(key string, amount int, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.credits == nil {
+		c.credits = make(map[string]*credit)
+	}
+	expires := time.Now().Add(ttl)
+	if existing, ok := c.credits[key]; ok && time.Now().Before(existing.expires) {
+		existing.amount += amount
+		existing.expires = maxTime(existing.expires, expires)
+		return
+	}
+	c.credits[key] = &credit{amount: amount, expires: expires}
+}
+
+// Take spends one request of key's credit, reporting whether there was any.
+func (c *Credits) Take(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cr, ok := c.credits[key]
+	if !ok {
+		return false
+	}
+	if cr.amount <= 0 || !time.Now().Before(cr.expires) {
+		delete(c.credits, key)
+		return false
+	}
+	cr.amount--
+	return true
+}
+
+// Remaining returns key's unexpired credit.
+func (c *Credits) Remaining(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cr, ok := c.credits[key]; ok && time.Now().Before(cr.expires) {
+		return cr.amount
+	}
+	return 0
+}
+
+// Clear removes key's credit.
+func (c *Credits) Clear(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.credits, key)
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// TopKeys holds the optional tracker of a limiter's busiest keys. Limiters embed it to
+// provide SetTopK and to implement TopReporter, and record their decisions with
+// RecordTop. The zero value tracks nothing.
+type TopKeys struct {
+	tracker atomic.Pointer[topk.Tracker]
+}
+
+// SetTopK makes the limiter record its decisions in t, so that the admin API can
+// report the busiest and most throttled keys. A nil t turns tracking off.
+func (k *TopKeys) SetTopK(t *topk.Tracker) {
+	k.tracker.Store(t)
+}
+
+// RecordTop counts a decision for key if keys are tracked.
+func (k *TopKeys) RecordTop(key string, allowed bool) {
+	k.tracker.Load().Record(key, allowed)
+}
+
+// Top returns the n keys with the most requests and denials, or false if keys are
+// not tracked.
+func (k *TopKeys) Top(n int) (topk.Report, bool) {
+	t := k.tracker.Load()
+	if t == nil {
+		return topk.Report{}, false
+	}
+	return t.Top(n), true
+}
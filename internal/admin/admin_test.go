@@ -0,0 +1,243 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nesyor/ratelimiter/internal/topk"
+)
+
+// fakeStore tracks a counter per key.
+type fakeStore struct {
+	counts    map[string]int
+	overrides map[string]string
+	credits   Credits
+}
+
+func (s *fakeStore) Keys() []string {
+	keys := make([]string, 0, len(s.counts))
+	for key := range s.counts {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (s *fakeStore) State(key string) (any, error) {
+	count, ok := s.counts[key]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return map[string]int{"count": count, "credit": s.credits.Remaining(key)}, nil
+}
+
+func (s *fakeStore) Reset(key string) error {
+	if _, ok := s.counts[key]; !ok {
+		return ErrUnknownKey
+	}
+	s.counts[key] = 0
+	return nil
+}
+
+func (s *fakeStore) Grant(key string, amount int, ttl time.Duration) {
+	s.credits.Grant(key, amount, ttl)
+}
+
+func (s *fakeStore) SetOverride(key string, override json.RawMessage) error {
+	var o struct{ Limit int }
+	if err := json.Unmarshal(override, &o); err != nil || o.Limit <= 0 {
+		return fmt.Errorf("invalid override")
+	}
+	s.overrides[key] = string(override)
+	return nil
+}
+
+func (s *fakeStore) ClearOverride(key string) {
+	delete(s.overrides, key)
+}
+
+func newTestServer() (*fakeStore, http.Handler) {
+	store := &fakeStore{
+		counts:    map[string]int{"192.168.1.1": 3, "2001:db8::1": 1},
+		overrides: make(map[string]string),
+	}
+	return store, Handler(store, "secret")
+}
+
+func do(handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestHandlerRequiresToken(t *testing.T) {
+	_, handler := newTestServer()
+
+	for _, header := range []string{"", "Bearer wrong", "secret", "Basic secret"} {
+		req := httptest.NewRequest("GET", "/keys", nil)
+		req.Header.Set("Authorization", header)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401 for Authorization %q but got %d", header, recorder.Code)
+		}
+	}
+
+	// An empty configured token never authorizes anything.
+	req := httptest.NewRequest("GET", "/keys", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	recorder := httptest.NewRecorder()
+	Handler(&fakeStore{}, "").ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 with an empty token but got %d", recorder.Code)
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	handler := RequireToken("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	for header, expected := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"Bearer secret": http.StatusTeapot,
+	} {
+		req := httptest.NewRequest("GET", "/failover", nil)
+		req.Header.Set("Authorization", header)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != expected {
+			t.Errorf("expected %d for Authorization %q but got %d", expected, header, recorder.Code)
+		}
+	}
+}
+
+func TestHandlerListAndShow(t *testing.T) {
+	_, handler := newTestServer()
+
+	recorder := do(handler, "GET", "/keys", "")
+	var states []KeyState
+	if err := json.Unmarshal(recorder.Body.Bytes(), &states); err != nil || len(states) != 2 {
+		t.Fatalf("expected 2 keys but got %s", recorder.Body.String())
+	}
+	if states[0].Key != "192.168.1.1" {
+		t.Errorf("expected keys to be sorted but got %v first", states[0].Key)
+	}
+
+	if recorder := do(handler, "GET", "/keys/2001:db8::1", ""); recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"count":1`) {
+		t.Errorf("unexpected response for a single key: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := do(handler, "GET", "/keys/10.0.0.1", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown key but got %d", recorder.Code)
+	}
+	if recorder := do(handler, "GET", "/nope", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown endpoint but got %d", recorder.Code)
+	}
+}
+
+func TestHandlerResetCreditOverride(t *testing.T) {
+	store, handler := newTestServer()
+
+	if recorder := do(handler, "POST", "/keys/192.168.1.1/reset", ""); recorder.Code != http.StatusNoContent || store.counts["192.168.1.1"] != 0 {
+		t.Errorf("expected reset to succeed but got %d with count %d", recorder.Code, store.counts["192.168.1.1"])
+	}
+
+	if recorder := do(handler, "POST", "/keys/192.168.1.1/credit", `{"amount": 5, "ttl": "1m"}`); recorder.Code != http.StatusNoContent {
+		t.Errorf("expected credit to succeed but got %d", recorder.Code)
+	}
+	if remaining := store.credits.Remaining("192.168.1.1"); remaining != 5 {
+		t.Errorf("expected 5 credit but got %d", remaining)
+	}
+	if recorder := do(handler, "POST", "/keys/192.168.1.1/credit", `{"amount": 5}`); recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for credit without ttl but got %d", recorder.Code)
+	}
+
+	if recorder := do(handler, "PUT", "/keys/192.168.1.1/override", `{"limit": 10}`); recorder.Code != http.StatusNoContent {
+		t.Errorf("expected override to succeed but got %d", recorder.Code)
+	}
+	if recorder := do(handler, "PUT", "/keys/192.168.1.1/override", `{"limit": -1}`); recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid override but got %d", recorder.Code)
+	}
+	if recorder := do(handler, "DELETE", "/keys/192.168.1.1/override", ""); recorder.Code != http.StatusNoContent || len(store.overrides) != 0 {
+		t.Errorf("expected override to be removed but got %d", recorder.Code)
+	}
+
+	if recorder := do(handler, "DELETE", "/keys/192.168.1.1/reset", ""); recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for DELETE reset but got %d", recorder.Code)
+	}
+}
+
+// topStore is a fakeStore that tracks its busiest keys.
+type topStore struct {
+	*fakeStore
+	TopKeys
+}
+
+func TestHandlerTop(t *testing.T) {
+	_, handler := newTestServer()
+	if recorder := do(handler, "GET", "/top", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a store without top keys but got %d", recorder.Code)
+	}
+
+	store, _ := newTestServer()
+	top := &topStore{fakeStore: store}
+	handler = Handler(top, "secret")
+	top.RecordTop("192.168.1.1", true)
+	if recorder := do(handler, "GET", "/top", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("expected 404 before tracking is turned on but got %d", recorder.Code)
+	}
+
+	top.SetTopK(topk.New(2, time.Minute))
+	top.RecordTop("192.168.1.1", true)
+	top.RecordTop("192.168.1.1", false)
+	top.RecordTop("2001:db8::1", true)
+
+	recorder := do(handler, "GET", "/top?n=1", "")
+	var report topk.Report
+	if err := json.Unmarshal(recorder.Body.Bytes(), &report); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("expected a report but got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if len(report.Requests) != 1 || report.Requests[0].Key != "192.168.1.1" || report.Requests[0].Count != 2 {
+		t.Errorf("expected 192.168.1.1 with 2 requests but got %v", report.Requests)
+	}
+	if len(report.Denied) != 1 || report.Denied[0].Key != "192.168.1.1" {
+		t.Errorf("expected 192.168.1.1 to be denied the most but got %v", report.Denied)
+	}
+
+	for _, path := range []string{"/top?n=0", "/top?n=x"} {
+		if recorder := do(handler, "GET", path, ""); recorder.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s but got %d", path, recorder.Code)
+		}
+	}
+}
+
+func TestCredits(t *testing.T) {
+	var credits Credits
+
+	if credits.Take("k") {
+		t.Fatal("expected no credit before a grant")
+	}
+	credits.Grant("k", 2, time.Minute)
+	credits.Grant("k", 1, time.Minute)
+	for i := 0; i < 3; i++ {
+		if !credits.Take("k") {
+			t.Fatalf("expected credit %d to be available", i+1)
+		}
+	}
+	if credits.Take("k") {
+		t.Fatal("expected credit to be used up")
+	}
+
+	credits.Grant("k", 5, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if credits.Take("k") || credits.Remaining("k") != 0 {
+		t.Fatal("expected credit to expire")
+	}
+}
@@ -0,0 +1,91 @@
+// Package audit writes structured records of rate limiting decisions to a log/slog handler.
+package audit
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// Record is a single rate limiting decision.
+type Record struct {
+	Key        string        // Key the decision was made for, usually a client IP.
+	Rule       string        // Human readable description of the limit that applied.
+	Algorithm  string        // Name of the limiting algorithm.
+	Allowed    bool          // Whether the request was allowed.
+	Shadow     bool          // Whether a denial was only recorded because the rule is in shadow mode.
+	Remaining  float64       // Requests (or tokens) left after the decision.
+	RetryAfter time.Duration // How long until a denied request could succeed.
+	Cost       float64       // Amount the request counted against the limit.
+}
+
+// Logger emits audit records. Denials are always logged; allowed decisions are
+// sampled so that busy limiters do not flood the log. A nil *Logger discards everything.
+type Logger struct {
+	logger     *slog.Logger
+	sampleRate float64
+}
+
+// New creates a Logger writing to h that logs the given fraction of allowed decisions,
+// from 0 (none) to 1 (all).
+func New(h slog.Handler, sampleRate float64) *Logger {
+	return &Logger{
+		logger:     slog.New(h),
+		sampleRate: sampleRate,
+	}
+}
+
+// Log writes r unless it is an allowed decision that was not sampled.
+func (l *Logger) Log(r Record) {
+	if l == nil {
+		return
+	}
+
+	level := slog.LevelWarn
+	decision := "deny"
+	switch {
+	case r.Allowed && r.Shadow:
+		decision = "shadow_deny"
+	case r.Allowed:
+		if l.sampleRate <= 0 || (l.sampleRate < 1 && rand.Float64() >= l.sampleRate) {
+			return
+		}
+		level = slog.LevelInfo
+		decision = "allow"
+	}
+
+	l.logger.LogAttrs(context.Background(), level, "rate limit decision",
+		slog.String("key", r.Key),
+		slog.String("rule", r.Rule),
+		slog.String("algorithm", r.Algorithm),
+		slog.String("decision", decision),
+		slog.Float64("remaining", r.Remaining),
+		slog.Duration("retry_after", r.RetryAfter),
+		slog.Float64("cost", r.Cost),
+	)
+}
+
+// Sink holds the optional Logger of a limiter. Limiters embed it to provide
+// SetAuditHandler, and fetch the Logger with AuditLogger before taking their own
+// lock, so that records are written after releasing it: handlers may do I/O. The
+// zero value logs nothing.
+type Sink struct {
+	logger atomic.Pointer[Logger]
+}
+
+// SetAuditHandler makes the limiter log its decisions to h, sampling the given
+// fraction of allowed decisions. A nil h turns audit logging off.
+func (s *Sink) SetAuditHandler(h slog.Handler, sampleRate float64) {
+	if h == nil {
+		s.logger.Store(nil)
+		return
+	}
+	s.logger.Store(New(h, sampleRate))
+}
+
+// AuditLogger returns the Logger set by SetAuditHandler, or nil if audit logging is off.
+func (s *Sink) AuditLogger() *Logger {
+	return s.logger.Load()
+}
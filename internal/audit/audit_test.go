@@ -0,0 +1,96 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoggerRecordFields(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(slog.NewJSONHandler(&buf, nil), 0)
+
+	logger.Log(Record{
+		Key:        "192.168.1.1",
+		Rule:       "5/1s",
+		Algorithm:  "fixedwindow",
+		Remaining:  0,
+		RetryAfter: 300 * time.Millisecond,
+		Cost:       1,
+	})
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected a JSON record but got %q: %v", buf.String(), err)
+	}
+	expected := map[string]any{
+		"level":       "WARN",
+		"key":         "192.168.1.1",
+		"rule":        "5/1s",
+		"algorithm":   "fixedwindow",
+		"decision":    "deny",
+		"remaining":   0.0,
+		"retry_after": float64(300 * time.Millisecond),
+		"cost":        1.0,
+	}
+	for field, value := range expected {
+		if entry[field] != value {
+			t.Errorf("expected %s to be %v but got %v", field, value, entry[field])
+		}
+	}
+}
+
+func TestLoggerSampling(t *testing.T) {
+	tests := []struct {
+		sampleRate float64
+		allowed    int // Allowed decisions expected in the log out of 100.
+	}{
+		{0, 0},
+		{1, 100},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		logger := New(slog.NewTextHandler(&buf, nil), test.sampleRate)
+		for i := 0; i < 100; i++ {
+			logger.Log(Record{Key: "k", Allowed: true})
+		}
+		// Denials and shadow denials are always logged.
+		logger.Log(Record{Key: "k"})
+		logger.Log(Record{Key: "k", Allowed: true, Shadow: true})
+
+		if n := strings.Count(buf.String(), "decision=allow"); n != test.allowed {
+			t.Errorf("sample rate %v: expected %d allowed records but got %d", test.sampleRate, test.allowed, n)
+		}
+		if !strings.Contains(buf.String(), "decision=deny") || !strings.Contains(buf.String(), "decision=shadow_deny") {
+			t.Errorf("sample rate %v: expected denials to always be logged", test.sampleRate)
+		}
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	var logger *Logger
+	logger.Log(Record{Key: "k"}) // Must not panic.
+}
+
+func TestSink(t *testing.T) {
+	var sink Sink
+	if sink.AuditLogger() != nil {
+		t.Fatal("expected the zero sink to log nothing")
+	}
+
+	var buf bytes.Buffer
+	sink.SetAuditHandler(slog.NewJSONHandler(&buf, nil), 0)
+	sink.AuditLogger().Log(Record{Key: "k"})
+	if !strings.Contains(buf.String(), `"decision":"deny"`) {
+		t.Fatalf("expected the denial to be logged but got %q", buf.String())
+	}
+
+	sink.SetAuditHandler(nil, 0)
+	if sink.AuditLogger() != nil {
+		t.Fatal("expected a nil handler to turn audit logging off")
+	}
+}
@@ -0,0 +1,314 @@
+// Package conformance is a test suite that any rate limiter can be run against.
+//
+// Limiters are driven by a fake Clock, so the suite checks exact numbers instead of
+// sleeping: the burst a fresh key gets, the rate it can sustain, that keys do not
+// affect each other, that concurrent requests are counted exactly once, that the
+// clock jumping backwards or forwards neither frees nor locks out a key, and that
+// random request patterns never let more through than the limits allow. Given a
+// reference model, every single decision is also compared against it.
+package conformance
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Limiter is the interface the suite drives limiters through.
+type Limiter interface {
+	Allow(key string) bool
+}
+
+// Clock is a fake clock for limiters under test. It starts at midnight UTC on
+// 2026-01-01, so windows aligned to the epoch start with it, and only moves when told.
+type Clock struct {
+	now time.Time
+	mu  sync.Mutex
+}
+
+// NewClock creates a clock at its start time.
+func NewClock() *Clock {
+	return &Clock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+// Now returns the clock's current time.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// Advance moves the clock forward by d, or backward if d is negative.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// Spec describes the limits a limiter under test was created with, for a single key.
+type Spec struct {
+	// Burst is the number of requests a fresh key may make at once.
+	Burst int
+	// Rate is the number of requests per second a key can sustain.
+	Rate float64
+	// MaxBurst is the most requests a key with history may get at once, if more than
+	// Burst. A fixed window, for example, allows twice its limit around a boundary.
+	MaxBurst int
+	// Slack is how many requests the sustained count may differ from the exact one
+	// by, for limiters that only approximate their limits.
+	Slack int
+	// Model, if not nil, creates a reference model that must make the same decisions.
+	Model func() Model
+}
+
+// maxBurst returns the most requests a key may get at once.
+func (s Spec) maxBurst() int {
+	return max(s.MaxBurst, s.Burst)
+}
+
+// perRequest returns the time a key has to wait for each request at the sustained rate.
+func (s Spec) perRequest() time.Duration {
+	return time.Duration(float64(time.Second) / s.Rate)
+}
+
+// Run runs the suite as subtests of t, creating a fresh limiter for each check with
+// newLimiter. The limiter must take the time from clock.
+func Run(t *testing.T, spec Spec, newLimiter func(clock *Clock) Limiter) {
+	t.Run("Burst", func(t *testing.T) { testBurst(t, spec, newLimiter) })
+	t.Run("SustainedRate", func(t *testing.T) { testSustainedRate(t, spec, newLimiter) })
+	t.Run("KeyIsolation", func(t *testing.T) { testKeyIsolation(t, spec, newLimiter) })
+	t.Run("Concurrent", func(t *testing.T) { testConcurrent(t, spec, newLimiter) })
+	t.Run("ClockJumps", func(t *testing.T) { testClockJumps(t, spec, newLimiter) })
+	t.Run("Random", func(t *testing.T) { testRandom(t, spec, newLimiter) })
+}
+
+// take makes up to n requests for key and returns how many were allowed before the
+// first denial.
+func take(l Limiter, key string, n int) int {
+	for i := 0; i < n; i++ {
+		if !l.Allow(key) {
+			return i
+		}
+	}
+	return n
+}
+
+func testBurst(t *testing.T, spec Spec, newLimiter func(*Clock) Limiter) {
+	l := newLimiter(NewClock())
+
+	if n := take(l, "192.0.2.1", spec.Burst+1); n != spec.Burst {
+		t.Fatalf("expected a burst of %d requests but got %d", spec.Burst, n)
+	}
+	for i := 0; i < spec.Burst; i++ {
+		if l.Allow("192.0.2.1") {
+			t.Fatalf("expected request %d after the burst to be denied without time passing", i+1)
+		}
+	}
+}
+
+func testSustainedRate(t *testing.T, spec Spec, newLimiter func(*Clock) Limiter) {
+	clock := NewClock()
+	l := newLimiter(clock)
+
+	// Run for twenty bursts' worth of time, requesting as much as allowed every
+	// quarter of the time a single request takes.
+	duration := time.Duration(20 * float64(spec.Burst) * float64(spec.perRequest()))
+	step := max(spec.perRequest()/4, 1)
+
+	allowed := take(l, "192.0.2.1", spec.maxBurst()+1)
+	for elapsed := time.Duration(0); elapsed < duration; elapsed += step {
+		clock.Advance(step)
+		allowed += take(l, "192.0.2.1", spec.maxBurst()+1)
+	}
+
+	expected := float64(spec.Burst) + spec.Rate*duration.Seconds()
+	if math.Abs(float64(allowed)-expected) > float64(spec.Slack)+1 {
+		t.Errorf("expected about %.0f requests in %s but got %d", expected, duration, allowed)
+	}
+}
+
+func testKeyIsolation(t *testing.T, spec Spec, newLimiter func(*Clock) Limiter) {
+	l := newLimiter(NewClock())
+
+	if n := take(l, "192.0.2.1", spec.Burst+1); n != spec.Burst {
+		t.Fatalf("expected a burst of %d requests but got %d", spec.Burst, n)
+	}
+	if n := take(l, "192.0.2.2", spec.Burst+1); n != spec.Burst {
+		t.Errorf("expected another key to get its own burst of %d but got %d", spec.Burst, n)
+	}
+	if l.Allow("192.0.2.1") {
+		t.Error("expected the first key to stay limited after another key's requests")
+	}
+}
+
+func testConcurrent(t *testing.T, spec Spec, newLimiter func(*Clock) Limiter) {
+	const goroutines = 8
+
+	// With the clock standing still, a shared key gets exactly one burst and every
+	// goroutine's own key gets exactly one burst.
+	l := newLimiter(NewClock())
+	var shared atomic.Int64
+	own := make([]int, goroutines)
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 2*spec.Burst; i++ {
+				if l.Allow("shared") {
+					shared.Add(1)
+				}
+				if l.Allow(fmt.Sprintf("own-%d", g)) {
+					own[g]++
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if n := shared.Load(); n != int64(spec.Burst) {
+		t.Errorf("expected %d concurrent requests for a shared key to be allowed but got %d", spec.Burst, n)
+	}
+	for g, n := range own {
+		if n != spec.Burst {
+			t.Errorf("expected goroutine %d to get a burst of %d for its own key but got %d", g, spec.Burst, n)
+		}
+	}
+
+	// With the clock moving, concurrent requests never beat the limits.
+	clock := NewClock()
+	l = newLimiter(clock)
+	shared.Store(0)
+	var calls atomic.Int64
+	var stop atomic.Bool
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				if l.Allow("shared") {
+					shared.Add(1)
+				}
+				calls.Add(1)
+				runtime.Gosched()
+			}
+		}()
+	}
+	step := max(spec.perRequest()/4, 1)
+	for i := 0; i < 200; i++ {
+		clock.Advance(step)
+		// Let a round of requests see each step.
+		for target := calls.Load() + goroutines; calls.Load() < target; {
+			runtime.Gosched()
+		}
+	}
+	stop.Store(true)
+	wg.Wait()
+
+	limit := float64(spec.maxBurst()) + spec.Rate*(200*step).Seconds() + float64(spec.Slack)
+	if n := shared.Load(); float64(n) > limit {
+		t.Errorf("expected at most %.0f requests while the clock moved but got %d", limit, n)
+	}
+}
+
+func testClockJumps(t *testing.T, spec Spec, newLimiter func(*Clock) Limiter) {
+	for _, jump := range []time.Duration{-time.Hour, -spec.perRequest() / 2, time.Hour} {
+		clock := NewClock()
+		l := newLimiter(clock)
+
+		// A key that used up its burst gets nothing more when the clock jumps back, as
+		// after an NTP correction, and at most a burst when it jumps forward.
+		take(l, "192.0.2.1", spec.maxBurst()+1)
+		clock.Advance(jump)
+		allowed := take(l, "192.0.2.1", spec.maxBurst()+1)
+		if jump < 0 && allowed > spec.Slack {
+			t.Errorf("clock jumped by %s: expected no requests to be allowed but got %d", jump, allowed)
+		}
+		if allowed > spec.maxBurst() {
+			t.Errorf("clock jumped by %s: expected at most %d requests to be allowed but got %d", jump, spec.maxBurst(), allowed)
+		}
+
+		// From there on the key is limited to its rate as usual, instead of being
+		// locked out until the clock catches up again.
+		duration := time.Duration(20 * float64(spec.Burst) * float64(spec.perRequest()))
+		step := max(spec.perRequest()/4, 1)
+		allowed = 0
+		for elapsed := time.Duration(0); elapsed < duration; elapsed += step {
+			clock.Advance(step)
+			allowed += take(l, "192.0.2.1", spec.maxBurst()+1)
+		}
+
+		expected := spec.Rate * duration.Seconds()
+		if low, high := expected-float64(spec.Burst+spec.Slack)-1, expected+float64(spec.Slack)+1; float64(allowed) < low || float64(allowed) > high {
+			t.Errorf("clock jumped by %s: expected about %.0f requests in the %s after but got %d", jump, expected, duration, allowed)
+		}
+	}
+}
+
+func testRandom(t *testing.T, spec Spec, newLimiter func(*Clock) Limiter) {
+	keys := []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"}
+
+	for seed := int64(1); seed <= 20; seed++ {
+		r := rand.New(rand.NewSource(seed))
+		clock := NewClock()
+		l := newLimiter(clock)
+		var model Model
+		if spec.Model != nil {
+			model = spec.Model()
+		}
+
+		allowed := make(map[string][]time.Time)
+		for i := 0; i < 500; i++ {
+			// Mostly bursts and short gaps, sometimes idle periods.
+			switch r.Intn(8) {
+			case 0, 1, 2:
+			case 3, 4, 5:
+				clock.Advance(time.Duration(r.Int63n(int64(spec.perRequest()) + 1)))
+			case 6:
+				clock.Advance(time.Duration(r.Int63n(int64(spec.Burst)*int64(spec.perRequest()) + 1)))
+			case 7:
+				clock.Advance(time.Duration(r.Int63n(10*int64(spec.Burst)*int64(spec.perRequest()) + 1)))
+			}
+
+			key := keys[r.Intn(len(keys))]
+			got := l.Allow(key)
+			if model != nil {
+				if want := model.Allow(key, clock.Now()); got != want {
+					t.Fatalf("seed %d, request %d for %s at %s: expected allowed %v but got %v",
+						seed, i+1, key, clock.Now().Format(time.RFC3339Nano), want, got)
+				}
+			}
+			if got {
+				allowed[key] = append(allowed[key], clock.Now())
+			}
+		}
+
+		if err := checkIntervals(spec, allowed); err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+	}
+}
+
+// checkIntervals reports an error if any interval between two allowed requests of a
+// key holds more requests than the spec allows in that much time.
+func checkIntervals(spec Spec, allowed map[string][]time.Time) error {
+	for key, times := range allowed {
+		for i := range times {
+			for j := i; j < len(times); j++ {
+				d := times[j].Sub(times[i])
+				limit := float64(spec.maxBurst()) + spec.Rate*d.Seconds() + float64(spec.Slack)
+				if n := j - i + 1; float64(n) > limit+1e-9 {
+					return fmt.Errorf("%s was allowed %d requests within %s, more than %.2f", key, n, d, limit)
+				}
+			}
+		}
+	}
+	return nil
+}
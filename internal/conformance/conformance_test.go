@@ -0,0 +1,55 @@
+package conformance
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// modelLimiter runs a model as a limiter, so the suite can check the models themselves.
+type modelLimiter struct {
+	model Model
+	clock *Clock
+	mu    sync.Mutex
+}
+
+func (l *modelLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.model.Allow(key, l.clock.Now())
+}
+
+func runModel(t *testing.T, spec Spec, model func() Model) {
+	Run(t, spec, func(clock *Clock) Limiter {
+		return &modelLimiter{model: model(), clock: clock}
+	})
+}
+
+func TestTokenBucketModel(t *testing.T) {
+	runModel(t, Spec{Burst: 10, Rate: 5}, TokenBucket(5, 10))
+}
+
+func TestFixedWindowModel(t *testing.T) {
+	runModel(t, Spec{Burst: 5, Rate: 5, MaxBurst: 10}, FixedWindow(5, time.Second))
+}
+
+func TestSlidingLogModel(t *testing.T) {
+	runModel(t, Spec{Burst: 5, Rate: 5}, SlidingLog(5, time.Second))
+}
+
+func TestCheckIntervals(t *testing.T) {
+	start := NewClock().Now()
+	spec := Spec{Burst: 2, Rate: 1}
+
+	// Two at once and one a second later is within a burst of two at one per second...
+	ok := map[string][]time.Time{"k": {start, start, start.Add(time.Second)}}
+	if err := checkIntervals(spec, ok); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// ...but three within half a second is not.
+	tooMany := map[string][]time.Time{"k": {start, start, start.Add(500 * time.Millisecond)}}
+	if err := checkIntervals(spec, tooMany); err == nil {
+		t.Error("expected an error for three requests within half a second")
+	}
+}
@@ -0,0 +1,117 @@
+package conformance
+
+import "time"
+
+// Model is a reference implementation of a limiting algorithm, kept as simple as
+// possible so it is obviously correct. The time of each request is passed in.
+type Model interface {
+	Allow(key string, now time.Time) bool
+}
+
+// TokenBucket models buckets that start full with capacity tokens and gain rate
+// tokens per second. Tokens are counted in billionths, so there is no rounding.
+func TokenBucket(rate, capacity int) func() Model {
+	return func() Model {
+		return &tokenBucket{rate: int64(rate), capacity: int64(capacity), buckets: make(map[string]*nanoTokens)}
+	}
+}
+
+type tokenBucket struct {
+	rate     int64
+	capacity int64
+	buckets  map[string]*nanoTokens
+}
+
+type nanoTokens struct {
+	tokens int64 // Billionths of a token.
+	last   time.Time
+}
+
+func (m *tokenBucket) Allow(key string, now time.Time) bool {
+	full := m.capacity * int64(time.Second)
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &nanoTokens{tokens: full, last: now}
+		m.buckets[key] = b
+	}
+
+	// Cap the elapsed time first so the product cannot overflow. Time running
+	// backwards earns nothing.
+	elapsed := min(max(int64(now.Sub(b.last)), 0), full)
+	b.tokens = min(b.tokens+elapsed*m.rate, full)
+	b.last = now
+
+	if b.tokens < int64(time.Second) {
+		return false
+	}
+	b.tokens -= int64(time.Second)
+	return true
+}
+
+// FixedWindow models windows of limit requests that start with a key's first request
+// after its previous window ended. If the clock goes back to before the start of a
+// window, the window starts over from there with its count.
+func FixedWindow(limit int, window time.Duration) func() Model {
+	return func() Model {
+		return &fixedWindow{limit: limit, window: window, windows: make(map[string]*countSince)}
+	}
+}
+
+type fixedWindow struct {
+	limit   int
+	window  time.Duration
+	windows map[string]*countSince
+}
+
+type countSince struct {
+	count int
+	start time.Time
+}
+
+func (m *fixedWindow) Allow(key string, now time.Time) bool {
+	w, ok := m.windows[key]
+	if !ok || now.Sub(w.start) >= m.window {
+		w = &countSince{start: now}
+		m.windows[key] = w
+	}
+	if now.Before(w.start) {
+		w.start = now
+	}
+	if w.count >= m.limit {
+		return false
+	}
+	w.count++
+	return true
+}
+
+// SlidingLog models a log allowing limit requests within any window: a request at t
+// counts against the key until just before t+window. If the clock goes back to before
+// t, the request counts as made at the new time.
+func SlidingLog(limit int, window time.Duration) func() Model {
+	return func() Model {
+		return &slidingLog{limit: limit, window: window, logs: make(map[string][]time.Time)}
+	}
+}
+
+type slidingLog struct {
+	limit  int
+	window time.Duration
+	logs   map[string][]time.Time
+}
+
+func (m *slidingLog) Allow(key string, now time.Time) bool {
+	count := 0
+	for i, t := range m.logs[key] {
+		if t.After(now) {
+			m.logs[key][i] = now
+		}
+		if now.Sub(m.logs[key][i]) < m.window {
+			count++
+		}
+	}
+	if count >= m.limit {
+		return false
+	}
+	m.logs[key] = append(m.logs[key], now)
+	return true
+}
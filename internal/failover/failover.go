@@ -0,0 +1,249 @@
+// Package failover defines what a rate limiter does when its remote backend, such as
+// Redis or the owner of a key in a cluster, cannot answer: allow the request, deny
+// it, or decide it with a local in-memory limiter. A circuit breaker stops calling a
+// backend that keeps failing until it has had time to recover.
+package failover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Policy is the decision made when the backend fails.
+type Policy int
+
+const (
+	// FailLocal decides with the local limiter. It is the zero value.
+	FailLocal Policy = iota
+	// FailOpen allows the request.
+	FailOpen
+	// FailClosed denies the request.
+	FailClosed
+)
+
+func (p Policy) String() string {
+	switch p {
+	case FailOpen:
+		return "open"
+	case FailClosed:
+		return "closed"
+	default:
+		return "local"
+	}
+}
+
+// ParsePolicy parses "open", "closed" or "local".
+func ParsePolicy(s string) (Policy, error) {
+	switch s {
+	case "open":
+		return FailOpen, nil
+	case "closed":
+		return FailClosed, nil
+	case "local":
+		return FailLocal, nil
+	default:
+		return 0, fmt.Errorf("unknown failure policy %q", s)
+	}
+}
+
+// ErrTimeout is the failure recorded when the backend does not answer in time.
+var ErrTimeout = errors.New("failover: backend timed out")
+
+// Options configures a Guard.
+type Options struct {
+	Policy Policy
+	// Local decides requests under FailLocal, typically an in-memory limiter at a
+	// scaled-down rate since each replica falls back on its own. Without it FailLocal
+	// behaves like FailOpen.
+	Local func(key string) bool
+	// Timeout bounds each backend call; 0 waits for the backend's own timeout.
+	Timeout time.Duration
+	// FailureThreshold is the number of consecutive failures that opens the circuit
+	// breaker; 0 disables it.
+	FailureThreshold int
+	// Cooldown is how long the breaker stays open before a trial call is let through.
+	Cooldown time.Duration
+}
+
+// Stats counts the calls made through a Guard.
+type Stats struct {
+	Calls        uint64 // Backend calls made.
+	Failures     uint64 // Calls that returned an error, including timeouts.
+	Timeouts     uint64 // Calls that did not answer in time.
+	ShortCircuit uint64 // Calls skipped because the breaker was open.
+	Fallbacks    uint64 // Decisions made by the failure policy.
+	BreakerOpens uint64 // Times the breaker opened.
+}
+
+// Guard calls a backend and applies the failure policy when it fails.
+type Guard struct {
+	opts    Options
+	breaker *Breaker
+	stats   Stats
+	mu      sync.Mutex
+}
+
+// New creates a guard with the given options.
+func New(opts Options) *Guard {
+	g := &Guard{opts: opts}
+	if opts.FailureThreshold > 0 {
+		g.breaker = NewBreaker(opts.FailureThreshold, opts.Cooldown)
+	}
+	return g
+}
+
+// Stats returns the calls made through the guard so far.
+func (g *Guard) Stats() Stats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.stats
+}
+
+// Allow returns remote's decision for key, or the failure policy's when remote fails,
+// times out or the breaker is open. remote must give up once its context is done,
+// which happens when the timeout passes.
+func (g *Guard) Allow(key string, remote func(ctx context.Context) (bool, error)) bool {
+	if g.breaker != nil && !g.breaker.Ready() {
+		g.mu.Lock()
+		g.stats.ShortCircuit++
+		g.mu.Unlock()
+		return g.fallback(key)
+	}
+
+	allowed, err := g.call(remote)
+
+	g.mu.Lock()
+	g.stats.Calls++
+	if err != nil {
+		g.stats.Failures++
+		if err == ErrTimeout {
+			g.stats.Timeouts++
+		}
+	}
+	g.mu.Unlock()
+
+	if g.breaker != nil {
+		if err != nil && g.breaker.Failure() {
+			log.Printf("failover: backend failing, circuit open for %s: %v", g.opts.Cooldown, err)
+			g.mu.Lock()
+			g.stats.BreakerOpens++
+			g.mu.Unlock()
+		} else if err == nil {
+			g.breaker.Success()
+		}
+	}
+
+	if err != nil {
+		return g.fallback(key)
+	}
+	return allowed
+}
+
+// call runs remote with a context that ends after the timeout. The call runs on the
+// caller's goroutine, so calls that time out do not pile up behind a slow backend.
+func (g *Guard) call(remote func(ctx context.Context) (bool, error)) (bool, error) {
+	if g.opts.Timeout <= 0 {
+		return remote(context.Background())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), g.opts.Timeout)
+	defer cancel()
+
+	allowed, err := remote(ctx)
+	if err != nil && ctx.Err() != nil {
+		return false, ErrTimeout
+	}
+	return allowed, err
+}
+
+// fallback decides key by the failure policy.
+func (g *Guard) fallback(key string) bool {
+	g.mu.Lock()
+	g.stats.Fallbacks++
+	g.mu.Unlock()
+
+	switch g.opts.Policy {
+	case FailClosed:
+		return false
+	case FailLocal:
+		if g.opts.Local != nil {
+			return g.opts.Local(key)
+		}
+	}
+	return true
+}
+
+// breakerState is the state of a Breaker.
+type breakerState int
+
+const (
+	closed   breakerState = iota // Calls go through.
+	open                         // Calls are skipped until the cooldown ends.
+	halfOpen                     // A single trial call is in flight.
+)
+
+// Breaker is a circuit breaker. It opens after a number of consecutive failures,
+// skips calls while open, and after a cooldown lets a single trial call through:
+// the breaker closes if it succeeds and opens again if it fails.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	state     breakerState
+	openedAt  time.Time
+	now       func() time.Time // Replaced in tests.
+	mu        sync.Mutex
+}
+
+// NewBreaker creates a breaker that opens after threshold consecutive failures for cooldown.
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// Ready reports whether a call may be made. Once the cooldown has passed it returns
+// true for one trial call, whose outcome must be reported with Success or Failure.
+func (b *Breaker) Ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case open:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = halfOpen
+		return true
+	case halfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// Success records a successful call and closes the breaker.
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.state = closed
+}
+
+// Failure records a failed call and reports whether it opened the breaker.
+func (b *Breaker) Failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == halfOpen || (b.state == closed && b.failures >= b.threshold) {
+		b.state = open
+		b.openedAt = b.now()
+		return true
+	}
+	return false
+}
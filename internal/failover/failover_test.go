@@ -0,0 +1,117 @@
+package failover
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var errDown = errors.New("backend down")
+
+func failing(ctx context.Context) (bool, error) { return false, errDown }
+
+func TestPolicies(t *testing.T) {
+	local := func(key string) bool { return key == "local-ok" }
+
+	tests := []struct {
+		policy   Policy
+		key      string
+		expected bool
+	}{
+		{FailOpen, "a", true},
+		{FailClosed, "a", false},
+		{FailLocal, "local-ok", true},
+		{FailLocal, "a", false},
+	}
+	for _, tt := range tests {
+		g := New(Options{Policy: tt.policy, Local: local})
+		if allowed := g.Allow(tt.key, failing); allowed != tt.expected {
+			t.Errorf("%s: expected %v for %s but got %v", tt.policy, tt.expected, tt.key, allowed)
+		}
+		if s := g.Stats(); s.Calls != 1 || s.Failures != 1 || s.Fallbacks != 1 {
+			t.Errorf("%s: unexpected stats %+v", tt.policy, s)
+		}
+	}
+
+	// Successful calls return the backend's decision.
+	g := New(Options{Policy: FailOpen})
+	if g.Allow("a", func(ctx context.Context) (bool, error) { return false, nil }) {
+		t.Error("expected the backend's denial to be kept")
+	}
+	if s := g.Stats(); s.Fallbacks != 0 {
+		t.Errorf("expected no fallbacks but got %+v", s)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, p := range []Policy{FailOpen, FailClosed, FailLocal} {
+		if parsed, err := ParsePolicy(p.String()); err != nil || parsed != p {
+			t.Errorf("expected %s to parse back but got %v, %v", p, parsed, err)
+		}
+	}
+	if _, err := ParsePolicy("sometimes"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	g := New(Options{Policy: FailClosed, Timeout: 10 * time.Millisecond})
+	slow := func(ctx context.Context) (bool, error) {
+		select {
+		case <-time.After(time.Second):
+			return true, nil
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+
+	start := time.Now()
+	if g.Allow("a", slow) {
+		t.Error("expected a slow backend to be treated as a failure")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the call to give up after the timeout but it took %s", elapsed)
+	}
+	if s := g.Stats(); s.Timeouts != 1 || s.Failures != 1 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	g := New(Options{Policy: FailClosed, FailureThreshold: 3, Cooldown: time.Second})
+	g.breaker.now = func() time.Time { return now }
+
+	calls := 0
+	remote := func(ctx context.Context) (bool, error) {
+		calls++
+		return false, errDown
+	}
+
+	for i := 0; i < 5; i++ {
+		g.Allow("a", remote)
+	}
+	// The breaker opened after three failures and skipped the rest.
+	if calls != 3 {
+		t.Errorf("expected 3 backend calls before the breaker opened but got %d", calls)
+	}
+	if s := g.Stats(); s.BreakerOpens != 1 || s.ShortCircuit != 2 || s.Fallbacks != 5 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+
+	// After the cooldown a failed trial call opens it again.
+	now = now.Add(time.Second)
+	g.Allow("a", remote)
+	g.Allow("a", remote)
+	if calls != 4 {
+		t.Errorf("expected a single trial call but got %d calls", calls-3)
+	}
+
+	// A successful trial call closes it.
+	now = now.Add(time.Second)
+	healthy := func(ctx context.Context) (bool, error) { return true, nil }
+	if !g.Allow("a", healthy) || !g.Allow("a", healthy) {
+		t.Error("expected calls to go through once the backend recovered")
+	}
+}
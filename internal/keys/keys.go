@@ -0,0 +1,257 @@
+// Package keys extracts the key a request is rate limited under. Keying by client IP
+// lumps together every user behind the same NAT, so authenticated APIs can key by
+// API key, session cookie or a JWT claim such as the tenant instead, optionally
+// combined with the route.
+package keys
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Extractor returns the key for a request, or false if the request does not carry one.
+type Extractor func(r *http.Request) (string, bool)
+
+// escaper escapes the characters that separate the parts of a key and their values,
+// so that a value taken from a request cannot pose as another part, such as a client
+// IP, and is looked up by Value as it was sent. unescaper undoes it.
+var (
+	escaper   = strings.NewReplacer("%", "%25", "|", "%7C", "=", "%3D")
+	unescaper = strings.NewReplacer("%25", "%", "%7C", "|", "%3D", "=")
+)
+
+// part returns the part of a key carrying value from source.
+func part(source, value string) string {
+	return source + "=" + escaper.Replace(value)
+}
+
+// ClientIP keys requests by the IP of their remote address. It always finds a key.
+func ClientIP() Extractor {
+	return func(r *http.Request) (string, bool) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr, true
+		}
+		return ip, true
+	}
+}
+
+// Header keys requests by the value of the named header, e.g. X-API-Key.
+func Header(name string) Extractor {
+	return func(r *http.Request) (string, bool) {
+		value := r.Header.Get(name)
+		return part("header:"+name, value), value != ""
+	}
+}
+
+// Query keys requests by the value of the named query parameter.
+func Query(name string) Extractor {
+	return func(r *http.Request) (string, bool) {
+		value := r.URL.Query().Get(name)
+		return part("query:"+name, value), value != ""
+	}
+}
+
+// Cookie keys requests by the value of the named cookie.
+func Cookie(name string) Extractor {
+	return func(r *http.Request) (string, bool) {
+		c, err := r.Cookie(name)
+		if err != nil || c.Value == "" {
+			return "", false
+		}
+		return part("cookie:"+name, c.Value), true
+	}
+}
+
+// Route keys requests by method and path, to be combined with another key.
+func Route() Extractor {
+	return func(r *http.Request) (string, bool) {
+		return "route:" + escaper.Replace(r.Method+" "+r.URL.Path), true
+	}
+}
+
+// JWTClaim keys requests by a claim of the bearer token in the Authorization header,
+// e.g. "sub" or "tenant". With a nil secret the token is decoded without checking its
+// signature, which is only safe behind a gateway that has verified it already.
+// Otherwise it must be signed with HS256 using secret and not be expired.
+func JWTClaim(claim string, secret []byte) Extractor {
+	return func(r *http.Request) (string, bool) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found {
+			return "", false
+		}
+		claims, err := parseJWT(token, secret, time.Now())
+		if err != nil {
+			return "", false
+		}
+
+		var value string
+		switch v := claims[claim].(type) {
+		case string:
+			value = v
+		case float64:
+			// Numeric IDs are written out in full rather than as 1.2345e+10.
+			value = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return "", false
+		}
+		return part("jwt:"+claim, value), value != ""
+	}
+}
+
+// parseJWT returns the claims of a compact JWT, verifying it if secret is not nil.
+func parseJWT(token string, secret []byte, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	if secret != nil {
+		var header struct {
+			Alg string `json:"alg"`
+		}
+		if err := decodeSegment(parts[0], &header); err != nil {
+			return nil, err
+		}
+		if header.Alg != "HS256" {
+			return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+		}
+		sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil {
+			return nil, err
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(parts[0] + "." + parts[1]))
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, errors.New("invalid signature")
+		}
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if secret != nil {
+		if exp, ok := claims["exp"].(float64); ok && now.Unix() >= int64(exp) {
+			return nil, errors.New("token expired")
+		}
+	}
+	return claims, nil
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a JWT into v.
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Composite joins the keys of all extractors, e.g. tenant and route. It finds a key
+// only if every extractor does.
+func Composite(extractors ...Extractor) Extractor {
+	return func(r *http.Request) (string, bool) {
+		parts := make([]string, len(extractors))
+		for i, e := range extractors {
+			key, ok := e(r)
+			if !ok {
+				return "", false
+			}
+			parts[i] = key
+		}
+		return strings.Join(parts, "|"), true
+	}
+}
+
+// First returns the key of the first extractor that finds one.
+func First(extractors ...Extractor) Extractor {
+	return func(r *http.Request) (string, bool) {
+		for _, e := range extractors {
+			if key, ok := e(r); ok {
+				return key, true
+			}
+		}
+		return "", false
+	}
+}
+
+// Parse builds an extractor from a comma separated list of alternatives, tried in
+// order, falling back to the client IP. Each alternative joins one or more sources
+// with "+":
+//
+//	ip, route, header:<name>, query:<name>, cookie:<name>, jwt:<claim>
+//
+// For example "jwt:tenant+route,header:X-API-Key" keys by tenant and route, or by API
+// key for requests without a token. JWT signatures are verified when secret is not nil.
+func Parse(spec string, secret []byte) (Extractor, error) {
+	var alternatives []Extractor
+	for _, alt := range strings.Split(spec, ",") {
+		var sources []Extractor
+		for _, source := range strings.Split(alt, "+") {
+			kind, name, _ := strings.Cut(strings.TrimSpace(source), ":")
+			if name == "" && kind != "ip" && kind != "route" {
+				return nil, fmt.Errorf("key source %q needs a name", source)
+			}
+			switch kind {
+			case "ip":
+				sources = append(sources, ClientIP())
+			case "route":
+				sources = append(sources, Route())
+			case "header":
+				sources = append(sources, Header(name))
+			case "query":
+				sources = append(sources, Query(name))
+			case "cookie":
+				sources = append(sources, Cookie(name))
+			case "jwt":
+				sources = append(sources, JWTClaim(name, secret))
+			default:
+				return nil, fmt.Errorf("unknown key source %q", source)
+			}
+		}
+		if len(sources) == 1 {
+			alternatives = append(alternatives, sources[0])
+		} else {
+			alternatives = append(alternatives, Composite(sources...))
+		}
+	}
+	return First(append(alternatives, ClientIP())...), nil
+}
+
+// Value returns the value that source carries in a key built with these extractors,
+// such as the API key in "header:X-API-Key=abc" for the source "header:X-API-Key", so
+// that keys can be looked up in tables of raw values. Sources are written as in Parse;
+// "ip" matches the bare client IP. It reports false if no part of key is from source.
+func Value(key, source string) (string, bool) {
+	for _, part := range strings.Split(key, "|") {
+		if prefix, value, found := strings.Cut(part, "="); found && strings.Contains(prefix, ":") {
+			if prefix == source {
+				return unescaper.Replace(value), true
+			}
+		} else if source == "ip" && !strings.HasPrefix(part, "route:") {
+			return part, true
+		}
+	}
+	return "", false
+}
+
+// Key returns the request's key from e, or its client IP if e finds none.
+func Key(e Extractor, r *http.Request) string {
+	if e != nil {
+		if key, ok := e(r); ok {
+			return key
+		}
+	}
+	key, _ := ClientIP()(r)
+	return key
+}
@@ -0,0 +1,147 @@
+package keys
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// signJWT returns an HS256 token with the given claims.
+func signJWT(claims map[string]any, secret []byte) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload, _ := json.Marshal(claims)
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func newRequest(target string, headers map[string]string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.RemoteAddr = "203.0.113.7:51234"
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	return r
+}
+
+func TestExtractors(t *testing.T) {
+	secret := []byte("s3cret")
+	valid := signJWT(map[string]any{"sub": "user-1", "tenant": "acme", "exp": time.Now().Add(time.Hour).Unix()}, secret)
+	expired := signJWT(map[string]any{"tenant": "acme", "exp": time.Now().Add(-time.Hour).Unix()}, secret)
+	forged := signJWT(map[string]any{"tenant": "acme"}, []byte("other"))
+	numeric := signJWT(map[string]any{"user_id": 12345678901}, secret)
+
+	tests := []struct {
+		name      string
+		extractor Extractor
+		request   *http.Request
+		key       string
+		ok        bool
+	}{
+		{"ip", ClientIP(), newRequest("/", nil), "203.0.113.7", true},
+		{"header", Header("X-API-Key"), newRequest("/", map[string]string{"X-API-Key": "k1"}), "header:X-API-Key=k1", true},
+		{"missing header", Header("X-API-Key"), newRequest("/", nil), "", false},
+		{"query", Query("api_key"), newRequest("/?api_key=k2", nil), "query:api_key=k2", true},
+		{"cookie", Cookie("session"), newRequest("/", map[string]string{"Cookie": "session=abc"}), "cookie:session=abc", true},
+		{"missing cookie", Cookie("session"), newRequest("/", nil), "", false},
+		{"unverified jwt", JWTClaim("sub", nil), newRequest("/", map[string]string{"Authorization": "Bearer " + forged}), "", false},
+		{"unverified jwt claim", JWTClaim("tenant", nil), newRequest("/", map[string]string{"Authorization": "Bearer " + forged}), "jwt:tenant=acme", true},
+		{"verified jwt", JWTClaim("tenant", secret), newRequest("/", map[string]string{"Authorization": "Bearer " + valid}), "jwt:tenant=acme", true},
+		{"numeric jwt claim", JWTClaim("user_id", secret), newRequest("/", map[string]string{"Authorization": "Bearer " + numeric}), "jwt:user_id=12345678901", true},
+		{"forged jwt", JWTClaim("tenant", secret), newRequest("/", map[string]string{"Authorization": "Bearer " + forged}), "", false},
+		{"expired jwt", JWTClaim("tenant", secret), newRequest("/", map[string]string{"Authorization": "Bearer " + expired}), "", false},
+		{"malformed jwt", JWTClaim("tenant", nil), newRequest("/", map[string]string{"Authorization": "Bearer nope"}), "", false},
+		{
+			"composite",
+			Composite(JWTClaim("tenant", secret), Route()),
+			newRequest("/orders", map[string]string{"Authorization": "Bearer " + valid}),
+			"jwt:tenant=acme|route:GET /orders",
+			true,
+		},
+		{"incomplete composite", Composite(Header("X-API-Key"), Route()), newRequest("/orders", nil), "", false},
+		{"escaped header", Header("X-API-Key"), newRequest("/", map[string]string{"X-API-Key": "junk|10.0.0.5"}), "header:X-API-Key=junk%7C10.0.0.5", true},
+		{"escaped route", Route(), newRequest("/a%7Cjwt:tenant=acme", nil), "route:GET /a%7Cjwt:tenant%3Dacme", true},
+	}
+	for _, tt := range tests {
+		key, ok := tt.extractor(tt.request)
+		if ok != tt.ok || (ok && key != tt.key) {
+			t.Errorf("%s: expected %q, %v but got %q, %v", tt.name, tt.key, tt.ok, key, ok)
+		}
+	}
+}
+
+// Test that values taken from requests cannot pose as other parts of a key
+func TestValueSpoofing(t *testing.T) {
+	e, err := Parse("header:X-API-Key", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, spoof := range []string{"junk|10.0.0.5", "junk|header:X-API-Key=k-pro", "k-pro=x"} {
+		key := Key(e, newRequest("/", map[string]string{"X-API-Key": spoof}))
+		if value, ok := Value(key, "ip"); ok {
+			t.Errorf("expected no client IP in the key for %q but got %q", spoof, value)
+		}
+		if value, ok := Value(key, "header:X-API-Key"); !ok || value != spoof {
+			t.Errorf("expected the API key %q as sent but got %q, %v", spoof, value, ok)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	e, err := Parse("jwt:tenant+route,header:X-API-Key", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	token := signJWT(map[string]any{"tenant": "acme"}, []byte("any"))
+	withToken := newRequest("/orders", map[string]string{"Authorization": "Bearer " + token, "X-API-Key": "k1"})
+	if key := Key(e, withToken); key != "jwt:tenant=acme|route:GET /orders" {
+		t.Errorf("expected the first alternative to win but got %q", key)
+	}
+	if key := Key(e, newRequest("/", map[string]string{"X-API-Key": "k1"})); key != "header:X-API-Key=k1" {
+		t.Errorf("expected the API key alternative but got %q", key)
+	}
+	// Without either, requests fall back to their client IP.
+	if key := Key(e, newRequest("/", nil)); key != "203.0.113.7" {
+		t.Errorf("expected the client IP but got %q", key)
+	}
+
+	for _, spec := range []string{"header", "jwt:", "ip+bogus:x"} {
+		if _, err := Parse(spec, nil); err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+}
+
+func TestValue(t *testing.T) {
+	tests := []struct {
+		key, source, value string
+		ok                 bool
+	}{
+		{"203.0.113.7", "ip", "203.0.113.7", true},
+		{"2001:db8::1", "ip", "2001:db8::1", true},
+		{"header:X-API-Key=k1", "header:X-API-Key", "k1", true},
+		{"header:X-API-Key=k1", "query:X-API-Key", "", false},
+		{"header:X-API-Key=k1", "ip", "", false},
+		{"jwt:tenant=acme|route:GET /orders", "jwt:tenant", "acme", true},
+		{"jwt:tenant=acme|route:GET /orders", "ip", "", false},
+		{"cookie:session=a%3Db|query:user=u1", "cookie:session", "a=b", true},
+		{"cookie:session=a%3Db|query:user=u1", "query:user", "u1", true},
+		{"header:X-API-Key=100%25%7C%253D", "header:X-API-Key", "100%|%3D", true},
+		{"jwt:sub=k1", "jwt:tenant", "", false},
+	}
+	for _, tt := range tests {
+		value, ok := Value(tt.key, tt.source)
+		if ok != tt.ok || value != tt.value {
+			t.Errorf("%s from %s: expected %q, %v but got %q, %v", tt.source, tt.key, tt.value, tt.ok, value, ok)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+// Package lease cuts the round trips to a central rate limiter by leasing tokens in
+// batches and spending them locally.
+//
+// Every token is taken from the central bucket before it is spent, so leasing never
+// allows more requests than the central limit. What it changes is when tokens are
+// spent: tokens leased by one process cannot be used by another until they are spent
+// or returned. The tokens held in leases across all processes are bounded by
+// Options.MaxOutstanding, which is how far decisions can drift from asking the
+// central limiter for every request.
+package lease
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/nesyor/ratelimiter/internal/redis"
+)
+
+// Source is the central limiter tokens are leased from.
+type Source interface {
+	// Acquire takes n tokens for key if that many are available, and reports whether it did.
+	Acquire(key string, n int) (bool, error)
+	// Release returns n unused tokens for key.
+	Release(key string, n int) error
+}
+
+// redisSource leases tokens from a token bucket in Redis.
+type redisSource struct {
+	bucket *redis.TokenBucket
+}
+
+// RedisSource returns a Source that leases tokens from bucket.
+func RedisSource(bucket *redis.TokenBucket) Source {
+	return redisSource{bucket: bucket}
+}
+
+func (s redisSource) Acquire(key string, n int) (bool, error) {
+	res, err := s.bucket.AllowN(key, n)
+	return res.Allowed, err
+}
+
+func (s redisSource) Release(key string, n int) error {
+	_, err := s.bucket.AllowN(key, -n)
+	return err
+}
+
+// Options configures a Leaser.
+type Options struct {
+	// TTL is how long a lease may be spent from. Unused tokens are returned when it expires.
+	TTL time.Duration
+	// MaxOutstanding bounds the tokens held in leases for a key across all processes.
+	MaxOutstanding int
+	// Processes is the number of processes sharing the central limiter, at least 1.
+	// Each process leases at most MaxOutstanding/Processes tokens at a time.
+	Processes int
+}
+
+// smoothing is the weight of the latest observation in the request rate estimate.
+const smoothing = 0.5
+
+// lease is the state of a single key.
+type lease struct {
+	tokens  int       // Leased tokens not spent yet.
+	expires time.Time // When unused tokens are returned.
+	start   time.Time // When the current lease was taken.
+	spent   int       // Requests served from the current lease.
+	rate    float64   // Estimated requests per second.
+	removed bool      // Set once the lease is dropped from the leaser.
+	mu      sync.Mutex
+}
+
+// Leaser decides requests from leased tokens, leasing batches from a Source as needed.
+type Leaser struct {
+	source   Source
+	ttl      time.Duration
+	maxBatch int
+	now      func() time.Time // Replaced in tests.
+	leases   map[string]*lease
+	mu       sync.Mutex // Guards leases. Taken inside a lease's lock, never the other way round.
+	done     chan struct{}
+	stop     sync.Once // Closes done.
+}
+
+// New creates a leaser over source. Unused tokens are returned in the background
+// once their lease expires, until Close is called.
+func New(source Source, opts Options) (*Leaser, error) {
+	if opts.Processes <= 0 {
+		return nil, fmt.Errorf("lease: processes must be positive, got %d", opts.Processes)
+	}
+	l := &Leaser{
+		source:   source,
+		ttl:      opts.TTL,
+		maxBatch: max(opts.MaxOutstanding/opts.Processes, 1),
+		now:      time.Now,
+		leases:   make(map[string]*lease),
+		done:     make(chan struct{}),
+	}
+	if l.ttl > 0 {
+		go l.run()
+	}
+	return l, nil
+}
+
+// run returns expired leases until the leaser is closed.
+func (l *Leaser) run() {
+	ticker := time.NewTicker(l.ttl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.expire()
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// Close stops the background expiry and returns every unused token. Calling it
+// again only returns tokens leased since.
+func (l *Leaser) Close() error {
+	l.stop.Do(func() { close(l.done) })
+
+	var firstErr error
+	for key, ls := range l.snapshot() {
+		ls.mu.Lock()
+		if ls.tokens > 0 {
+			if err := l.source.Release(key, ls.tokens); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			ls.tokens = 0
+		}
+		ls.mu.Unlock()
+	}
+	return firstErr
+}
+
+// snapshot returns the current leases, so they can be released one at a time
+// without holding l.mu during the round trips to the source.
+func (l *Leaser) snapshot() map[string]*lease {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	leases := make(map[string]*lease, len(l.leases))
+	for key, ls := range l.leases {
+		leases[key] = ls
+	}
+	return leases
+}
+
+// expire returns the unused tokens of expired leases.
+func (l *Leaser) expire() {
+	now := l.now()
+	for key, ls := range l.snapshot() {
+		ls.mu.Lock()
+		if !ls.removed && !now.Before(ls.expires) {
+			l.release(key, ls)
+			if ls.tokens == 0 {
+				// Forget idle keys; a new lease starts from scratch.
+				l.mu.Lock()
+				delete(l.leases, key)
+				l.mu.Unlock()
+				ls.removed = true
+			}
+		}
+		ls.mu.Unlock()
+	}
+}
+
+// release returns ls's unused tokens. The lease's lock must be held.
+func (l *Leaser) release(key string, ls *lease) {
+	if ls.tokens == 0 {
+		return
+	}
+	if err := l.source.Release(key, ls.tokens); err != nil {
+		// Keep the tokens; they are returned on the next attempt.
+		return
+	}
+	ls.tokens = 0
+}
+
+// Allow spends a leased token for key, leasing a new batch when none is left.
+// The error is the Source's; the request is denied when it fails.
+func (l *Leaser) Allow(key string) (bool, error) {
+	ls := l.lease(key)
+	defer ls.mu.Unlock()
+
+	now := l.now()
+	if ls.tokens > 0 && now.Before(ls.expires) {
+		ls.tokens--
+		ls.spent++
+		return true, nil
+	}
+	l.release(key, ls)
+
+	// Estimate the request rate from the previous lease to size the next one.
+	if !ls.start.IsZero() {
+		if elapsed := now.Sub(ls.start).Seconds(); elapsed > 0 {
+			ls.rate = smoothing*float64(ls.spent+1)/elapsed + (1-smoothing)*ls.rate
+		}
+	}
+
+	// Ask for the tokens needed until the lease expires, falling back to smaller
+	// batches when the central bucket has fewer left.
+	for batch := l.batchSize(ls.rate); batch > 0; batch /= 2 {
+		ok, err := l.source.Acquire(key, batch)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			ls.tokens = batch - 1
+			ls.expires = now.Add(l.ttl)
+			ls.start = now
+			ls.spent = 1
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// lease returns key's lease, locked.
+func (l *Leaser) lease(key string) *lease {
+	for {
+		l.mu.Lock()
+		ls, exists := l.leases[key]
+		if !exists {
+			ls = &lease{}
+			l.leases[key] = ls
+		}
+		l.mu.Unlock()
+
+		ls.mu.Lock()
+		if !ls.removed {
+			return ls
+		}
+		// The lease expired while we waited for it; tokens leased on it would never be returned.
+		ls.mu.Unlock()
+	}
+}
+
+// batchSize returns the number of tokens to lease at the given request rate.
+func (l *Leaser) batchSize(rate float64) int {
+	batch := int(math.Ceil(rate * l.ttl.Seconds()))
+	return min(max(batch, 1), l.maxBatch)
+}
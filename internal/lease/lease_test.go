@@ -0,0 +1,194 @@
+package lease
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// bucket is a central token bucket that never refills.
+type bucket struct {
+	mu        sync.Mutex
+	tokens    int
+	acquires  int    // Acquire calls made.
+	largest   int    // Largest batch requested.
+	onRelease func() // Called by Release, if set, as a slow round trip would take time.
+}
+
+func (b *bucket) Acquire(key string, n int) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.acquires++
+	b.largest = max(b.largest, n)
+	if b.tokens < n {
+		return false, nil
+	}
+	b.tokens -= n
+	return true, nil
+}
+
+func (b *bucket) Release(key string, n int) error {
+	if b.onRelease != nil {
+		b.onRelease()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens += n
+	return nil
+}
+
+// clock is a manually advanced clock.
+type clock struct{ now time.Time }
+
+func (c *clock) Now() time.Time          { return c.now }
+func (c *clock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+// mustNew creates a leaser or fails the test.
+func mustNew(t *testing.T, b *bucket, opts Options) *Leaser {
+	t.Helper()
+	l, err := New(b, opts)
+	if err != nil {
+		t.Fatalf("failed to create leaser: %v", err)
+	}
+	return l
+}
+
+func newLeaser(t *testing.T, b *bucket, c *clock, opts Options) *Leaser {
+	l := mustNew(t, b, Options{MaxOutstanding: opts.MaxOutstanding, Processes: opts.Processes})
+	// Without a TTL in New no background expiry runs; tests call expire themselves.
+	l.ttl = opts.TTL
+	l.now = c.Now
+	return l
+}
+
+func TestLeaserBatchesAdaptToRate(t *testing.T) {
+	b := &bucket{tokens: 1000}
+	c := &clock{now: time.Unix(0, 0)}
+	l := newLeaser(t, b, c, Options{TTL: time.Second, MaxOutstanding: 100, Processes: 2})
+
+	// 20 requests per second for 10 seconds.
+	allowed := 0
+	for i := 0; i < 200; i++ {
+		if ok, _ := l.Allow("a"); ok {
+			allowed++
+		}
+		c.Advance(50 * time.Millisecond)
+	}
+	if allowed != 200 {
+		t.Fatalf("expected every request to be allowed but got %d", allowed)
+	}
+	// The first leases hold a single token; once the rate is known each lease covers about a second.
+	if b.acquires > 30 {
+		t.Errorf("expected leasing to cut central calls but made %d for 200 requests", b.acquires)
+	}
+	if b.largest > 50 {
+		t.Errorf("expected batches of at most 50 tokens but one asked for %d", b.largest)
+	}
+}
+
+func TestLeaserNeverExceedsCentralLimit(t *testing.T) {
+	b := &bucket{tokens: 25}
+	c := &clock{now: time.Unix(0, 0)}
+	opts := Options{TTL: time.Second, MaxOutstanding: 20, Processes: 2}
+	leasers := []*Leaser{newLeaser(t, b, c, opts), newLeaser(t, b, c, opts)}
+
+	allowed := 0
+	for i := 0; i < 200; i++ {
+		if ok, _ := leasers[i%2].Allow("a"); ok {
+			allowed++
+		}
+		c.Advance(5 * time.Millisecond)
+	}
+	if allowed != 25 {
+		t.Errorf("expected exactly the 25 central tokens to be spent but %d requests were allowed", allowed)
+	}
+}
+
+func TestLeaserReturnsUnusedTokens(t *testing.T) {
+	b := &bucket{tokens: 100}
+	c := &clock{now: time.Unix(0, 0)}
+	l := newLeaser(t, b, c, Options{TTL: time.Second, MaxOutstanding: 10, Processes: 1})
+
+	// Build up a rate estimate so the next lease is a full batch.
+	for i := 0; i < 30; i++ {
+		l.Allow("a")
+		c.Advance(10 * time.Millisecond)
+	}
+	spent := 30
+	if b.tokens+spent == 100 {
+		t.Fatal("expected some tokens to be held in a lease")
+	}
+
+	// Once the lease expires its unused tokens go back to the central bucket.
+	c.Advance(time.Second)
+	l.expire()
+	if b.tokens != 100-spent {
+		t.Errorf("expected %d tokens back in the central bucket but got %d", 100-spent, b.tokens)
+	}
+	if len(l.leases) != 0 {
+		t.Error("expected the expired lease to be forgotten")
+	}
+}
+
+func TestLeaserClose(t *testing.T) {
+	b := &bucket{tokens: 100}
+	l := mustNew(t, b, Options{TTL: time.Hour, MaxOutstanding: 10, Processes: 1})
+	l.leases["a"] = &lease{rate: 100}
+
+	l.Allow("a")
+	if b.tokens != 90 {
+		t.Fatalf("expected a batch of 10 tokens to be leased but the bucket has %d", b.tokens)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b.tokens != 99 {
+		t.Errorf("expected the 9 unused tokens to be returned but the bucket has %d", b.tokens)
+	}
+}
+
+func TestLeaserReleasesOutsideLock(t *testing.T) {
+	b := &bucket{tokens: 100}
+	c := &clock{now: time.Unix(0, 0)}
+	l := newLeaser(t, b, c, Options{TTL: time.Second, MaxOutstanding: 10, Processes: 1})
+	l.leases["a"] = &lease{rate: 100}
+	l.Allow("a")
+
+	// Requests for other keys go on while the expired lease is returned.
+	b.onRelease = func() { l.Allow("b") }
+	c.Advance(time.Second)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		l.expire()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected returning a lease not to block requests for other keys")
+	}
+	if _, ok := l.leases["a"]; ok {
+		t.Error("expected the expired lease to be forgotten")
+	}
+}
+
+func TestLeaserCloseTwice(t *testing.T) {
+	l := mustNew(t, &bucket{tokens: 100}, Options{TTL: time.Hour, MaxOutstanding: 10, Processes: 1})
+	if err := l.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("unexpected error closing again: %v", err)
+	}
+}
+
+func TestNewRejectsNoProcesses(t *testing.T) {
+	for _, processes := range []int{0, -1} {
+		if _, err := New(&bucket{}, Options{MaxOutstanding: 10, Processes: processes}); err == nil {
+			t.Errorf("expected an error for %d processes", processes)
+		}
+	}
+}
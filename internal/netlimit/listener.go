@@ -0,0 +1,261 @@
+// Package netlimit protects TCP services from connection floods with a net.Listener
+// that limits the rate of accepted connections and the number of open connections
+// per remote IP.
+package netlimit
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Limiter decides whether a connection from an IP may be accepted. The in-memory
+// limiters in this repository, such as the tokenbucket RateLimiter, implement it.
+type Limiter interface {
+	Allow(ip string) bool
+}
+
+// Options configures a Listener.
+type Options struct {
+	// Rate limits accepted connections per IP; nil accepts them at any rate.
+	Rate Limiter
+	// MaxConns caps the open connections per IP; 0 means no cap.
+	MaxConns int
+	// Delay holds an excess connection for this long and checks it again before
+	// closing it, which absorbs short bursts; 0 closes excess connections at once.
+	Delay time.Duration
+	// MaxDelayed caps the connections held by Delay at once; excess connections
+	// beyond it are closed at once. 0 means DefaultMaxDelayed.
+	MaxDelayed int
+}
+
+// DefaultMaxDelayed is the number of connections held by Delay at once when
+// Options.MaxDelayed is 0.
+const DefaultMaxDelayed = 1024
+
+// Accept errors other than net.ErrClosed are retried after a delay that starts at
+// minAcceptDelay and doubles up to maxAcceptDelay, as net/http.Server does.
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// Stats counts the connections seen by a Listener.
+type Stats struct {
+	Accepted uint64 // Connections handed to Accept.
+	Delayed  uint64 // Excess connections held for a second check.
+	Rejected uint64 // Excess connections closed.
+}
+
+// Listener wraps a net.Listener, closing or delaying connections beyond the limits.
+// Accepted connections count against their IP's cap until they are closed.
+type Listener struct {
+	net.Listener
+	opts  Options
+	conns map[string]int // Open connections per IP.
+	stats Stats
+	mu    sync.Mutex
+
+	ready     chan net.Conn
+	delayed   chan struct{} // Holds a slot per connection waiting out the delay.
+	err       chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewListener wraps inner with the given limits. It starts accepting from inner right away.
+func NewListener(inner net.Listener, opts Options) *Listener {
+	if opts.MaxDelayed <= 0 {
+		opts.MaxDelayed = DefaultMaxDelayed
+	}
+	l := &Listener{
+		Listener: inner,
+		opts:     opts,
+		conns:    make(map[string]int),
+		ready:    make(chan net.Conn),
+		delayed:  make(chan struct{}, opts.MaxDelayed),
+		err:      make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// run accepts connections from the wrapped listener and admits or rejects them.
+// Errors such as running out of file descriptors are retried with a growing delay;
+// only the wrapped listener being closed ends the loop.
+func (l *Listener) run() {
+	var delay time.Duration
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				l.err <- err
+				return
+			}
+			delay = min(max(2*delay, minAcceptDelay), maxAcceptDelay)
+			select {
+			case <-time.After(delay):
+				continue
+			case <-l.done:
+				l.err <- net.ErrClosed
+				return
+			}
+		}
+		delay = 0
+		l.admit(conn)
+	}
+}
+
+// admit hands conn to Accept if its IP is within the limits, and otherwise closes
+// it or checks it again after the delay.
+func (l *Listener) admit(conn net.Conn) {
+	ip := remoteIP(conn)
+	if l.try(ip) {
+		l.deliver(conn, ip)
+		return
+	}
+	if l.opts.Delay <= 0 {
+		l.reject(conn)
+		return
+	}
+	select {
+	case l.delayed <- struct{}{}:
+	default:
+		// Too many connections are held already.
+		l.reject(conn)
+		return
+	}
+
+	l.mu.Lock()
+	l.stats.Delayed++
+	l.mu.Unlock()
+
+	// Wait in the background so one flooding IP does not hold up the others.
+	go func() {
+		defer func() { <-l.delayed }()
+		timer := time.NewTimer(l.opts.Delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+			if l.try(ip) {
+				l.deliver(conn, ip)
+				return
+			}
+			l.reject(conn)
+		case <-l.done:
+			conn.Close()
+		}
+	}()
+}
+
+// try reserves a connection for ip if it is within the limits.
+func (l *Listener) try(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Check the cap first so connections over it do not use up the rate.
+	if l.opts.MaxConns > 0 && l.conns[ip] >= l.opts.MaxConns {
+		return false
+	}
+	if l.opts.Rate != nil && !l.opts.Rate.Allow(ip) {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+// release gives back a connection reserved by try.
+func (l *Listener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+// deliver hands an admitted connection to Accept.
+func (l *Listener) deliver(conn net.Conn, ip string) {
+	c := &limitedConn{Conn: conn, release: func() { l.release(ip) }}
+	select {
+	case l.ready <- c:
+		l.mu.Lock()
+		l.stats.Accepted++
+		l.mu.Unlock()
+	case <-l.done:
+		c.Close()
+	}
+}
+
+// reject closes an excess connection.
+func (l *Listener) reject(conn net.Conn) {
+	conn.Close()
+
+	l.mu.Lock()
+	l.stats.Rejected++
+	l.mu.Unlock()
+}
+
+// Accept waits for and returns the next connection within the limits.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.ready:
+		return conn, nil
+	case err := <-l.err:
+		// Keep the error for later calls.
+		l.err <- err
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the wrapped listener and any connections held back by the delay.
+func (l *Listener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.Listener.Close()
+	})
+	return err
+}
+
+// Stats returns the connections seen so far.
+func (l *Listener) Stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.stats
+}
+
+// OpenConns returns the number of open connections from ip.
+func (l *Listener) OpenConns(ip string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.conns[ip]
+}
+
+// limitedConn releases its IP's connection slot when closed.
+type limitedConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// remoteIP returns the IP of conn's remote address.
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
@@ -0,0 +1,229 @@
+package netlimit
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countLimiter allows a fixed number of connections per IP.
+type countLimiter struct {
+	mu    sync.Mutex
+	limit int
+	seen  map[string]int
+}
+
+func (c *countLimiter) Allow(ip string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seen[ip]++
+	return c.seen[ip] <= c.limit
+}
+
+// server is a limited listener on localhost with a loop passing accepted connections to the test.
+type server struct {
+	*Listener
+	accepted chan net.Conn
+}
+
+// listen starts a server that is closed when the test ends.
+func listen(t *testing.T, opts Options) *server {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := &server{Listener: NewListener(inner, opts), accepted: make(chan net.Conn, 10)}
+	t.Cleanup(func() { s.Close() })
+
+	go func() {
+		for {
+			conn, err := s.Accept()
+			if err != nil {
+				return
+			}
+			s.accepted <- conn
+		}
+	}()
+	return s
+}
+
+// dial connects to s and returns the server side of the connection if it was
+// accepted within the timeout.
+func dial(t *testing.T, s *server, timeout time.Duration) (client, conn net.Conn) {
+	client, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	select {
+	case conn = <-s.accepted:
+		return client, conn
+	case <-time.After(timeout):
+		return client, nil
+	}
+}
+
+// closedByServer reports whether the server closed client.
+func closedByServer(client net.Conn) bool {
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := client.Read(make([]byte, 1))
+	return errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed)
+}
+
+func TestListenerMaxConns(t *testing.T) {
+	l := listen(t, Options{MaxConns: 2})
+
+	_, first := dial(t, l, time.Second)
+	_, second := dial(t, l, time.Second)
+	if first == nil || second == nil {
+		t.Fatal("expected the first two connections to be accepted")
+	}
+
+	client, third := dial(t, l, 100*time.Millisecond)
+	if third != nil {
+		t.Fatal("expected the third connection to be rejected")
+	}
+	if !closedByServer(client) {
+		t.Error("expected the rejected connection to be closed")
+	}
+
+	// Closing a connection frees a slot; closing it twice frees only one.
+	first.Close()
+	first.Close()
+	if n := l.OpenConns("127.0.0.1"); n != 1 {
+		t.Fatalf("expected 1 open connection but got %d", n)
+	}
+	if _, fourth := dial(t, l, time.Second); fourth == nil {
+		t.Error("expected a connection to be accepted after one was closed")
+	}
+
+	if s := l.Stats(); s.Accepted != 3 || s.Rejected != 1 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestListenerRate(t *testing.T) {
+	l := listen(t, Options{Rate: &countLimiter{limit: 1, seen: make(map[string]int)}})
+
+	if _, conn := dial(t, l, time.Second); conn == nil {
+		t.Fatal("expected the first connection to be accepted")
+	}
+	client, conn := dial(t, l, 100*time.Millisecond)
+	if conn != nil || !closedByServer(client) {
+		t.Error("expected a connection over the rate to be closed")
+	}
+}
+
+func TestListenerDelay(t *testing.T) {
+	l := listen(t, Options{MaxConns: 1, Delay: 300 * time.Millisecond})
+
+	_, first := dial(t, l, time.Second)
+	if first == nil {
+		t.Fatal("expected the first connection to be accepted")
+	}
+
+	// The second connection is held while the first is still open...
+	if _, second := dial(t, l, 50*time.Millisecond); second != nil {
+		t.Fatal("expected the second connection to be held")
+	}
+	first.Close()
+
+	// ...and accepted once the delay has passed, because the first one closed.
+	select {
+	case <-l.accepted:
+	case <-time.After(time.Second):
+		t.Fatal("expected the delayed connection to be accepted")
+	}
+	if s := l.Stats(); s.Delayed != 1 || s.Rejected != 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	l := listen(t, Options{})
+	l.Close()
+	if _, err := l.Accept(); err == nil {
+		t.Error("expected Accept to fail after Close")
+	}
+}
+
+// flakyListener fails its first Accept calls with a temporary error.
+type flakyListener struct {
+	net.Listener
+	mu       sync.Mutex
+	failures int
+}
+
+func (f *flakyListener) Accept() (net.Conn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.failures > 0 {
+		f.failures--
+		return nil, errors.New("accept: too many open files")
+	}
+	return f.Listener.Accept()
+}
+
+func TestListenerRetriesAcceptErrors(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	l := NewListener(&flakyListener{Listener: inner, failures: 3}, Options{})
+	defer l.Close()
+
+	client, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		accepted <- err
+	}()
+	select {
+	case err := <-accepted:
+		if err != nil {
+			t.Fatalf("expected the connection to be accepted after the errors but got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the connection to be accepted after the errors")
+	}
+
+	// Closing the listener ends the loop.
+	l.Close()
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected net.ErrClosed after Close but got %v", err)
+	}
+}
+
+func TestListenerMaxDelayed(t *testing.T) {
+	l := listen(t, Options{MaxConns: 1, Delay: time.Second, MaxDelayed: 1})
+
+	if _, first := dial(t, l, time.Second); first == nil {
+		t.Fatal("expected the first connection to be accepted")
+	}
+	if _, second := dial(t, l, 50*time.Millisecond); second != nil {
+		t.Fatal("expected the second connection to be held")
+	}
+
+	// Only one connection may be held, so the third is closed at once.
+	client, _ := dial(t, l, 50*time.Millisecond)
+	if !closedByServer(client) {
+		t.Fatal("expected the third connection to be closed")
+	}
+	if s := l.Stats(); s.Delayed != 1 || s.Rejected != 1 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
@@ -0,0 +1,235 @@
+package outbound
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Learned is what an upstream host told us about its limit in its last response.
+type Learned struct {
+	Limit     int           // Requests allowed per window.
+	Remaining int           // Requests left in the current window.
+	Reset     time.Time     // When the current window ends.
+	Window    time.Duration // Window length, when the host states it.
+	Paused    time.Time     // No requests are sent before this time, after a 429.
+}
+
+// defaultPause is how long a host is paused after a 429 that gives no Retry-After or reset time.
+const defaultPause = time.Second
+
+// LearningTransport is an http.RoundTripper that configures a token bucket per upstream
+// host from the rate limit headers in its responses, and stops sending to a host that
+// answers 429 Too Many Requests until its Retry-After has passed. Hosts that have not
+// sent any rate limit headers are not limited.
+//
+// It understands the IETF RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset and
+// RateLimit-Policy headers, the combined RateLimit header, the common X-RateLimit-Limit,
+// X-RateLimit-Remaining and X-RateLimit-Reset headers and Retry-After.
+type LearningTransport struct {
+	// Base sends the requests; nil means http.DefaultTransport.
+	Base http.RoundTripper
+
+	now     func() time.Time // Replaced in tests.
+	learned map[string]Learned
+	buckets map[string]*bucket
+	mu      sync.Mutex
+}
+
+// NewLearningTransport creates a learning transport sending requests through base.
+func NewLearningTransport(base http.RoundTripper) *LearningTransport {
+	return &LearningTransport{
+		Base:    base,
+		now:     time.Now,
+		learned: make(map[string]Learned),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Limits returns the limits learned so far, by host.
+func (t *LearningTransport) Limits() map[string]Learned {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	limits := make(map[string]Learned, len(t.learned))
+	for host, l := range t.learned {
+		limits[host] = l
+	}
+	return limits
+}
+
+// bucket returns host's bucket, which does not limit until something is learned.
+func (t *LearningTransport) bucket(host string) *bucket {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b, exists := t.buckets[host]
+	if !exists {
+		b = newBucket(Limit{}, t.now())
+		t.buckets[host] = b
+	}
+	return b
+}
+
+// RoundTrip waits until the request's host may be sent another request, sends it and
+// learns from the response.
+func (t *LearningTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	host := r.URL.Host
+	b := t.bucket(host)
+	if err := wait(r, b); err != nil {
+		return nil, err
+	}
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+
+	t.learn(host, b, resp)
+	return resp, nil
+}
+
+// learn updates host's limit and bucket from resp.
+func (t *LearningTransport) learn(host string, b *bucket, resp *http.Response) {
+	now := t.now()
+	l, ok := parseHeaders(resp.Header, now)
+	limited := resp.StatusCode == http.StatusTooManyRequests
+	if !ok && !limited {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	prev := t.learned[host]
+	if !ok {
+		// A 429 without rate limit headers keeps what was learned before.
+		l = prev
+	}
+	if l.Window == 0 {
+		l.Window = prev.Window
+	}
+
+	if limited {
+		l.Paused = now.Add(defaultPause)
+		if retry, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now); ok {
+			l.Paused = retry
+		} else if l.Reset.After(now) {
+			l.Paused = l.Reset
+		}
+	}
+	t.learned[host] = l
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if limited {
+		b.paused = l.Paused
+	}
+	if l.Limit <= 0 {
+		return
+	}
+
+	// Spread the limit over its window. Hosts that do not state the window are
+	// assumed to use one as long as the time left until the reset, which errs on
+	// the fast side but is corrected by the remaining count on every response.
+	window := l.Window
+	if window <= 0 {
+		window = l.Reset.Sub(now)
+	}
+	if window <= 0 {
+		return
+	}
+	b.advance(now)
+	if b.limit.Rate <= 0 {
+		// Nothing was limited so far, so the host's count is all there is to go by.
+		b.tokens = float64(l.Remaining)
+	} else {
+		// The host's count only lowers the bucket. Tokens reserved by requests that are
+		// still waiting or in flight are not in it yet, and must not be handed out again.
+		b.tokens = math.Min(b.tokens, float64(l.Remaining))
+	}
+	b.limit = Limit{Rate: float64(l.Limit) / window.Seconds(), Burst: l.Limit}
+}
+
+// parseHeaders reads the rate limit headers of a response, preferring the IETF ones.
+func parseHeaders(h http.Header, now time.Time) (Learned, bool) {
+	var l Learned
+	limit, remaining, reset := h.Get("RateLimit-Limit"), h.Get("RateLimit-Remaining"), h.Get("RateLimit-Reset")
+
+	if combined := h.Get("RateLimit"); combined != "" && limit == "" {
+		// The combined form: RateLimit: limit=100, remaining=50, reset=30
+		for _, param := range strings.Split(combined, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			switch name {
+			case "limit":
+				limit = value
+			case "remaining":
+				remaining = value
+			case "reset":
+				reset = value
+			}
+		}
+	}
+	if limit == "" {
+		limit, remaining, reset = h.Get("X-RateLimit-Limit"), h.Get("X-RateLimit-Remaining"), h.Get("X-RateLimit-Reset")
+	}
+
+	var err error
+	if l.Limit, err = strconv.Atoi(firstItem(limit)); err != nil {
+		return Learned{}, false
+	}
+	if l.Remaining, err = strconv.Atoi(remaining); err != nil {
+		l.Remaining = l.Limit
+	}
+	if seconds, err := strconv.ParseInt(reset, 10, 64); err == nil {
+		if seconds > 1e9 {
+			// Some hosts send the reset time as a Unix timestamp rather than a delay.
+			l.Reset = time.Unix(seconds, 0)
+		} else {
+			l.Reset = now.Add(time.Duration(seconds) * time.Second)
+		}
+	}
+
+	// RateLimit-Policy: 100;w=60 states the window; older drafts put it in RateLimit-Limit.
+	policy := h.Get("RateLimit-Policy")
+	if policy == "" {
+		policy = limit
+	}
+	for _, param := range strings.Split(policy, ";")[1:] {
+		if name, value, _ := strings.Cut(strings.TrimSpace(param), "="); name == "w" {
+			if seconds, err := strconv.Atoi(value); err == nil {
+				l.Window = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return l, true
+}
+
+// firstItem returns the leading number of a header value such as "100, 100;w=60".
+func firstItem(value string) string {
+	value, _, _ = strings.Cut(value, ",")
+	value, _, _ = strings.Cut(value, ";")
+	return strings.TrimSpace(value)
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return now.Add(time.Duration(seconds) * time.Second), true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return at, true
+	}
+	return time.Time{}, false
+}
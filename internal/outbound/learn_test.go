@@ -0,0 +1,172 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHeaders(t *testing.T) {
+	now := time.Unix(1_800_000_000, 0)
+
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		expected Learned
+	}{
+		{
+			name:     "ietf",
+			headers:  map[string]string{"RateLimit-Limit": "100", "RateLimit-Remaining": "40", "RateLimit-Reset": "30", "RateLimit-Policy": "100;w=60"},
+			expected: Learned{Limit: 100, Remaining: 40, Reset: now.Add(30 * time.Second), Window: time.Minute},
+		},
+		{
+			name:     "ietf window in limit",
+			headers:  map[string]string{"RateLimit-Limit": "10, 10;w=1", "RateLimit-Remaining": "9", "RateLimit-Reset": "1"},
+			expected: Learned{Limit: 10, Remaining: 9, Reset: now.Add(time.Second), Window: time.Second},
+		},
+		{
+			name:     "combined",
+			headers:  map[string]string{"RateLimit": "limit=50, remaining=5, reset=10"},
+			expected: Learned{Limit: 50, Remaining: 5, Reset: now.Add(10 * time.Second)},
+		},
+		{
+			name:     "x-ratelimit with epoch reset",
+			headers:  map[string]string{"X-RateLimit-Limit": "5000", "X-RateLimit-Remaining": "4999", "X-RateLimit-Reset": "1800003600"},
+			expected: Learned{Limit: 5000, Remaining: 4999, Reset: now.Add(time.Hour)},
+		},
+	}
+	for _, tt := range tests {
+		h := make(http.Header)
+		for name, value := range tt.headers {
+			h.Set(name, value)
+		}
+		l, ok := parseHeaders(h, now)
+		if !ok || l != tt.expected {
+			t.Errorf("%s: expected %+v but got %+v", tt.name, tt.expected, l)
+		}
+	}
+
+	if _, ok := parseHeaders(http.Header{}, now); ok {
+		t.Error("expected no limit without rate limit headers")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	if at, ok := parseRetryAfter("120", now); !ok || !at.Equal(now.Add(2*time.Minute)) {
+		t.Errorf("expected a delay in seconds to be parsed but got %v", at)
+	}
+	if at, ok := parseRetryAfter("Sun, 18 Oct 2026 12:05:00 GMT", now); !ok || !at.Equal(now.Add(5*time.Minute)) {
+		t.Errorf("expected an HTTP date to be parsed but got %v", at)
+	}
+	if _, ok := parseRetryAfter("soon", now); ok {
+		t.Error("expected an invalid value to be rejected")
+	}
+}
+
+func TestLearningTransportPaces(t *testing.T) {
+	remaining := 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The upstream allows 20 requests per second and had 2 left.
+		remaining = max(remaining-1, 0)
+		w.Header().Set("RateLimit-Policy", "20;w=1")
+		w.Header().Set("RateLimit-Limit", "20")
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	}))
+	defer srv.Close()
+
+	tr := NewLearningTransport(nil)
+	client := &http.Client{Transport: tr}
+
+	// The first response teaches the limit with one request left, the second uses it
+	// up, so the third waits for a refill of 50ms.
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := get(client, context.Background(), srv.URL); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("expected requests to be paced once the limit was learned but took %s", elapsed)
+	}
+
+	l := tr.Limits()[strings.TrimPrefix(srv.URL, "http://")]
+	if l.Limit != 20 || l.Window != time.Second {
+		t.Errorf("expected the learned limit to be exposed but got %+v", l)
+	}
+}
+
+func TestLearningTransportKeepsReservations(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	tr := NewLearningTransport(nil)
+	tr.now = func() time.Time { return now }
+	b := tr.bucket("api.example.com")
+
+	respond := func(remaining int) *http.Response {
+		h := http.Header{}
+		h.Set("RateLimit-Policy", "10;w=1")
+		h.Set("RateLimit-Limit", "10")
+		h.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		return &http.Response{StatusCode: http.StatusOK, Header: h}
+	}
+
+	// The first response sets the bucket to the host's count...
+	tr.learn("api.example.com", b, respond(5))
+	if b.tokens != 5 {
+		t.Fatalf("expected 5 tokens from the first response but got %v", b.tokens)
+	}
+
+	// ...later ones do not hand out the tokens of requests waiting to be sent.
+	for i := 0; i < 7; i++ {
+		b.reserve(now, time.Time{})
+	}
+	tr.learn("api.example.com", b, respond(4))
+	if b.tokens != -2 {
+		t.Errorf("expected the 2 waiting requests to keep their reservations but got %v tokens", b.tokens)
+	}
+
+	// A host reporting fewer requests left than the bucket has lowers it.
+	now = now.Add(time.Second)
+	tr.learn("api.example.com", b, respond(1))
+	if b.tokens != 1 {
+		t.Errorf("expected the bucket to be lowered to 1 token but got %v", b.tokens)
+	}
+}
+
+func TestLearningTransportPausesOn429(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "2")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	tr := NewLearningTransport(nil)
+	client := &http.Client{Transport: tr}
+
+	if err := get(client, context.Background(), srv.URL); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l := tr.Limits()[strings.TrimPrefix(srv.URL, "http://")]
+	if until := time.Until(l.Paused); until < time.Second || until > 2*time.Second {
+		t.Errorf("expected the host to be paused for about 2s but got %s", until)
+	}
+
+	// Requests that cannot wait out the pause fail without being sent.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := get(client, ctx, srv.URL); !errors.Is(err, ErrDeadline) {
+		t.Errorf("expected ErrDeadline while paused but got %v", err)
+	}
+
+	// Other hosts are unaffected.
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer other.Close()
+	if err := get(client, ctx, other.URL); err != nil {
+		t.Errorf("expected another host to be reachable but got %v", err)
+	}
+}
@@ -0,0 +1,198 @@
+// Package outbound throttles our own requests to third-party APIs that rate limit
+// us. Transport wraps an http.RoundTripper and waits for a token from a per-host
+// (or per-route) token bucket before sending each request.
+package outbound
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrDeadline is returned when waiting for a token would outlast the request's
+// context deadline. The request is not sent and no token is spent.
+var ErrDeadline = errors.New("outbound: rate limit wait exceeds context deadline")
+
+// Limit is a token bucket limit. A Rate of 0 or less means no limit.
+type Limit struct {
+	Rate  float64 // Requests per second.
+	Burst int     // Requests that may be sent at once.
+}
+
+// bucket is a token bucket that hands out tokens ahead of time: a request takes a
+// token even if none is left and waits until the bucket has refilled to cover it.
+type bucket struct {
+	limit  Limit
+	tokens float64
+	last   time.Time
+	paused time.Time // No request is sent before this time.
+	mu     sync.Mutex
+}
+
+func newBucket(limit Limit, now time.Time) *bucket {
+	return &bucket{limit: limit, tokens: float64(limit.Burst), last: now}
+}
+
+// advance adds the tokens refilled since the last call.
+func (b *bucket) advance(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed*b.limit.Rate)
+	}
+	b.last = now
+}
+
+// reserve takes a token and returns how long to wait before using it. If the wait
+// would end after deadline (when non-zero) no token is taken and ErrDeadline is returned.
+func (b *bucket) reserve(now, deadline time.Time) (time.Duration, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var wait time.Duration
+	if b.paused.After(now) {
+		wait = b.paused.Sub(now)
+	}
+	if b.limit.Rate <= 0 {
+		if !deadline.IsZero() && now.Add(wait).After(deadline) {
+			return 0, ErrDeadline
+		}
+		return wait, nil
+	}
+	b.advance(now)
+
+	if b.tokens < 1 {
+		wait = max(wait, time.Duration((1-b.tokens)/b.limit.Rate*float64(time.Second)))
+	}
+	if !deadline.IsZero() && now.Add(wait).After(deadline) {
+		return 0, ErrDeadline
+	}
+	b.tokens--
+	return wait, nil
+}
+
+// cancel gives back a token taken by reserve that was not used.
+func (b *bucket) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.limit.Rate > 0 {
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+1)
+	}
+}
+
+// configure changes the bucket's limit, keeping the tokens it has up to the new burst.
+func (b *bucket) configure(limit Limit, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.advance(now)
+	b.limit = limit
+	b.tokens = math.Min(b.tokens, float64(limit.Burst))
+}
+
+// Transport is an http.RoundTripper that rate limits requests before passing them to Base.
+type Transport struct {
+	// Base sends the requests; nil means http.DefaultTransport.
+	Base http.RoundTripper
+	// Key groups requests that share a limit; nil groups them by host. Return a host
+	// and path prefix, for example, to limit routes separately.
+	Key func(r *http.Request) string
+
+	defaultLimit Limit
+	limits       map[string]Limit
+	buckets      map[string]*bucket
+	mu           sync.Mutex
+}
+
+// NewTransport creates a transport sending requests through base, limiting each
+// key to defaultLimit unless SetLimit sets another.
+func NewTransport(base http.RoundTripper, defaultLimit Limit) *Transport {
+	return &Transport{
+		Base:         base,
+		defaultLimit: defaultLimit,
+		limits:       make(map[string]Limit),
+		buckets:      make(map[string]*bucket),
+	}
+}
+
+// SetLimit sets the limit for requests with the given key.
+func (t *Transport) SetLimit(key string, limit Limit) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.limits[key] = limit
+	if b, exists := t.buckets[key]; exists {
+		b.configure(limit, time.Now())
+	}
+}
+
+// key returns the key r is limited under.
+func (t *Transport) key(r *http.Request) string {
+	if t.Key != nil {
+		return t.Key(r)
+	}
+	return r.URL.Host
+}
+
+// bucket returns the bucket for key, creating it with the key's limit.
+func (t *Transport) bucket(key string) *bucket {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b, exists := t.buckets[key]
+	if !exists {
+		limit, ok := t.limits[key]
+		if !ok {
+			limit = t.defaultLimit
+		}
+		b = newBucket(limit, time.Now())
+		t.buckets[key] = b
+	}
+	return b
+}
+
+// Wait blocks until a request for key may be sent. It fails immediately with
+// ErrDeadline if that would be after r's context deadline, and returns the context's
+// error if it is done while waiting.
+func (t *Transport) Wait(r *http.Request, key string) error {
+	return wait(r, t.bucket(key))
+}
+
+// wait reserves a token from b and waits for it, honoring r's context.
+func wait(r *http.Request, b *bucket) error {
+	ctx := r.Context()
+	deadline, _ := ctx.Deadline()
+
+	delay, err := b.reserve(time.Now(), deadline)
+	if err != nil {
+		return err
+	}
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.cancel()
+		return ctx.Err()
+	}
+}
+
+// RoundTrip waits for the request's limit and sends it.
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if err := t.Wait(r, t.key(r)); err != nil {
+		return nil, err
+	}
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(r)
+}
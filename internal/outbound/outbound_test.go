@@ -0,0 +1,117 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newServer starts a server that counts the requests it receives.
+func newServer(t *testing.T, received *int64) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(received, 1)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func get(client *http.Client, ctx context.Context, url string) error {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	resp, err := client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+func TestTransportWaits(t *testing.T) {
+	var received int64
+	srv := newServer(t, &received)
+	client := &http.Client{Transport: NewTransport(nil, Limit{Rate: 20, Burst: 2})}
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := get(client, context.Background(), srv.URL); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	// The burst covers two requests, the other two wait 50ms each.
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("expected requests beyond the burst to wait but 4 took %s", elapsed)
+	}
+	if n := atomic.LoadInt64(&received); n != 4 {
+		t.Errorf("expected 4 requests to arrive but got %d", n)
+	}
+}
+
+func TestTransportPerHost(t *testing.T) {
+	var received int64
+	a := newServer(t, &received)
+	b := newServer(t, &received)
+
+	tr := NewTransport(nil, Limit{Rate: 0.1, Burst: 1})
+	tr.SetLimit(strings.TrimPrefix(b.URL, "http://"), Limit{}) // No limit for b.
+	client := &http.Client{Transport: tr}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := get(client, ctx, a.URL); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Each host has its own bucket.
+	for i := 0; i < 5; i++ {
+		if err := get(client, ctx, b.URL); err != nil {
+			t.Fatalf("expected the unlimited host to be reachable but got %v", err)
+		}
+	}
+}
+
+func TestTransportFailsFastPastDeadline(t *testing.T) {
+	var received int64
+	srv := newServer(t, &received)
+	client := &http.Client{Transport: NewTransport(nil, Limit{Rate: 1, Burst: 1})}
+
+	get(client, context.Background(), srv.URL)
+
+	// The next token arrives in a second, after the deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := get(client, ctx, srv.URL); !errors.Is(err, ErrDeadline) {
+		t.Errorf("expected ErrDeadline but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("expected to fail without waiting but took %s", elapsed)
+	}
+	if n := atomic.LoadInt64(&received); n != 1 {
+		t.Errorf("expected the second request not to be sent but the server got %d", n)
+	}
+}
+
+func TestTransportCanceledWhileWaiting(t *testing.T) {
+	var received int64
+	srv := newServer(t, &received)
+	tr := NewTransport(nil, Limit{Rate: 5, Burst: 1})
+	client := &http.Client{Transport: tr}
+
+	get(client, context.Background(), srv.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if err := get(client, ctx, srv.URL); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the canceled context's error but got %v", err)
+	}
+
+	// The canceled request gave its token back, so the next one only waits for the refill.
+	start := time.Now()
+	get(client, context.Background(), srv.URL)
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("expected the canceled reservation to be returned but waited %s", elapsed)
+	}
+}
@@ -0,0 +1,219 @@
+// Package redis implements rate limiters whose state lives in Redis, so several
+// replicas of a server share one limit per key. It includes a minimal RESP client,
+// so the repository does not depend on an external Redis library.
+//
+// Each limiter runs a Lua script that reads, updates and writes a key's state in
+// one atomic step and takes the current time from the Redis server, so replicas
+// with skewed clocks still agree.
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Error is an error reply sent by the Redis server.
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+// ErrNil is returned when the server replies with a null bulk string or array.
+var ErrNil = errors.New("redis: nil reply")
+
+// Client is a Redis client sharing a single connection. It is safe for concurrent
+// use; commands are sent one at a time. The connection is dialed on first use and
+// redialed after a network error.
+type Client struct {
+	addr    string
+	timeout time.Duration // Dial, read and write timeout for each command.
+	conn    net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	lock    chan struct{} // Held while using the connection; a channel so waiting for it can be given up.
+}
+
+// NewClient creates a client for the Redis server at addr. Each command, including
+// dialing, fails if it takes longer than timeout; 0 means no timeout.
+func NewClient(addr string, timeout time.Duration) *Client {
+	return &Client{addr: addr, timeout: timeout, lock: make(chan struct{}, 1)}
+}
+
+// Close closes the connection. The next command dials a new one.
+func (c *Client) Close() error {
+	c.lock <- struct{}{}
+	defer func() { <-c.lock }()
+
+	return c.closeConn()
+}
+
+func (c *Client) closeConn() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// Do sends a command and returns its reply. Replies are decoded as string (simple
+// strings), int64 (integers), []byte (bulk strings), []any (arrays) or Error, which
+// is also returned as the error. Null replies return ErrNil.
+func (c *Client) Do(args ...any) (any, error) {
+	return c.DoContext(context.Background(), args...)
+}
+
+// DoContext is Do with a context. The command gives up when ctx is done, including
+// while it waits for another command to finish with the connection.
+func (c *Client) DoContext(ctx context.Context, args ...any) (any, error) {
+	select {
+	case c.lock <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-c.lock }()
+
+	var deadline time.Time
+	if c.timeout > 0 {
+		deadline = time.Now().Add(c.timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+
+	if c.conn == nil {
+		dialer := net.Dialer{Deadline: deadline}
+		conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+		c.r = bufio.NewReader(conn)
+		c.w = bufio.NewWriter(conn)
+	}
+	c.conn.SetDeadline(deadline)
+
+	// Cancelling ctx interrupts the command by moving the deadline into the past.
+	conn := c.conn
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer func() {
+		if !stop() {
+			// The deadline may be moved even after the command finished, so the
+			// connection cannot be trusted by the next one.
+			c.closeConn()
+		}
+	}()
+
+	if err := writeCommand(c.w, args); err != nil {
+		c.closeConn()
+		return nil, err
+	}
+	reply, err := readReply(c.r)
+	if err != nil {
+		var replyErr Error
+		if !errors.As(err, &replyErr) && err != ErrNil {
+			// The connection is in an unknown state after a network or protocol error.
+			c.closeConn()
+		}
+		return nil, err
+	}
+	return reply, nil
+}
+
+// writeCommand writes args as a RESP array of bulk strings and flushes w.
+func writeCommand(w *bufio.Writer, args []any) error {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var s string
+		switch v := arg.(type) {
+		case string:
+			s = v
+		case []byte:
+			s = string(v)
+		case int:
+			s = strconv.Itoa(v)
+		case int64:
+			s = strconv.FormatInt(v, 10)
+		case float64:
+			s = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return fmt.Errorf("redis: unsupported argument type %T", arg)
+		}
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s)
+	}
+	return w.Flush()
+}
+
+// readLine reads a line terminated by CRLF, without the terminator.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis: malformed line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+// readReply reads a single RESP reply.
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed bulk length %q", line)
+		}
+		if n < 0 {
+			return nil, ErrNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed array length %q", line)
+		}
+		if n < 0 {
+			return nil, ErrNil
+		}
+		values := make([]any, n)
+		for i := range values {
+			values[i], err = readReply(r)
+			var replyErr Error
+			switch {
+			case err == ErrNil:
+				// Null elements stay nil instead of failing the whole array.
+			case errors.As(err, &replyErr):
+				values[i] = replyErr
+			case err != nil:
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", line)
+	}
+}
@@ -0,0 +1,339 @@
+package redis
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeServer is an in-process RESP server for tests of the client and of code built on
+// the limiters, so that they run without a Redis server and without waiting for real
+// time to pass. It implements the commands the client and the tests use, and since it
+// cannot run Lua, emulates the limiters' scripts in Go, identified by their digest.
+// Scripts it does not know are rejected. Time, as TIME and the scripts see it and as
+// keys expire by, is taken from the clock it is given.
+type FakeServer struct {
+	ln  net.Listener
+	now func() time.Time
+
+	mu      sync.Mutex
+	strings map[string]string
+	expires map[string]time.Time
+	buckets map[string][2]float64         // Token bucket hashes: tokens and refill time in seconds.
+	logs    map[string]map[string]float64 // Sliding log sorted sets: member to score.
+	loaded  map[string]bool               // Digests of scripts sent with EVAL or SCRIPT LOAD.
+	evals   int                           // EVAL commands received.
+}
+
+// fakeScripts emulates the limiters' scripts, keyed by digest.
+var fakeScripts = map[string]func(f *FakeServer, now time.Time, keys, args []string) any{
+	tokenBucketScript.sha: (*FakeServer).tokenBucket,
+	fixedWindowScript.sha: (*FakeServer).fixedWindow,
+	slidingLogScript.sha:  (*FakeServer).slidingLog,
+}
+
+// NewFakeServer starts a fake server on localhost that tells the time by now. It
+// serves until Close is called.
+func NewFakeServer(now func() time.Time) (*FakeServer, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	f := &FakeServer{
+		ln:      ln,
+		now:     now,
+		strings: make(map[string]string),
+		expires: make(map[string]time.Time),
+		buckets: make(map[string][2]float64),
+		logs:    make(map[string]map[string]float64),
+		loaded:  make(map[string]bool),
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f, nil
+}
+
+// Addr returns the address the server listens on, for NewClient.
+func (f *FakeServer) Addr() string {
+	return f.ln.Addr().String()
+}
+
+// Close stops accepting connections.
+func (f *FakeServer) Close() error {
+	return f.ln.Close()
+}
+
+// Evals returns the number of EVAL commands received, that is how often a script's
+// source was sent rather than just its digest.
+func (f *FakeServer) Evals() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.evals
+}
+
+func (f *FakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	for {
+		// Commands arrive as arrays of bulk strings, which readReply decodes.
+		req, err := readReply(r)
+		if err != nil {
+			return
+		}
+		parts, _ := req.([]any)
+		args := make([]string, len(parts))
+		for i, p := range parts {
+			b, _ := p.([]byte)
+			args[i] = string(b)
+		}
+
+		writeReply(w, f.do(args))
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
+
+// writeReply encodes a reply: string as a simple string, []byte as a bulk string,
+// nil as a null bulk string.
+func writeReply(w *bufio.Writer, reply any) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case string:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case []byte:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case Error:
+		fmt.Fprintf(w, "-%s\r\n", v)
+	case []any:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, e := range v {
+			writeReply(w, e)
+		}
+	default:
+		panic(fmt.Sprintf("fake: cannot encode %T", reply))
+	}
+}
+
+func (f *FakeServer) do(args []string) any {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(args) == 0 {
+		return Error("ERR empty command")
+	}
+	now := f.now()
+	f.expire(now)
+
+	switch cmd := strings.ToUpper(args[0]); {
+	case cmd == "PING":
+		return "PONG"
+	case cmd == "TIME" && len(args) == 1:
+		micros := now.UnixMicro()
+		return []any{[]byte(strconv.FormatInt(micros/1e6, 10)), []byte(strconv.FormatInt(micros%1e6, 10))}
+	case cmd == "GET" && len(args) == 2:
+		if v, ok := f.strings[args[1]]; ok {
+			return []byte(v)
+		}
+		return nil
+	case cmd == "SET" && len(args) == 3:
+		f.del(args[1])
+		f.strings[args[1]] = args[2]
+		return "OK"
+	case cmd == "DEL":
+		n := 0
+		for _, key := range args[1:] {
+			if f.exists(key) {
+				n++
+			}
+			f.del(key)
+		}
+		return n
+	case cmd == "ZADD" && len(args) >= 4 && len(args)%2 == 0:
+		log := f.logs[args[1]]
+		if log == nil {
+			log = make(map[string]float64)
+			f.logs[args[1]] = log
+		}
+		added := 0
+		for i := 2; i < len(args); i += 2 {
+			score, err := strconv.ParseFloat(args[i], 64)
+			if err != nil {
+				return Error("ERR value is not a valid float")
+			}
+			if _, ok := log[args[i+1]]; !ok {
+				added++
+			}
+			log[args[i+1]] = score
+		}
+		return added
+	case cmd == "SCRIPT" && len(args) == 3 && strings.ToUpper(args[1]) == "LOAD":
+		sum := sha1.Sum([]byte(args[2]))
+		sha := hex.EncodeToString(sum[:])
+		f.loaded[sha] = true
+		return []byte(sha)
+	case cmd == "EVAL" && len(args) >= 3:
+		f.evals++
+		sum := sha1.Sum([]byte(args[1]))
+		sha := hex.EncodeToString(sum[:])
+		f.loaded[sha] = true
+		return f.run(sha, now, args[2:])
+	case cmd == "EVALSHA" && len(args) >= 3:
+		if !f.loaded[args[1]] {
+			return Error("NOSCRIPT No matching script. Please use EVAL.")
+		}
+		return f.run(args[1], now, args[2:])
+	default:
+		return Error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+}
+
+// run runs the emulated script with the given digest; args start with the key count.
+func (f *FakeServer) run(sha string, now time.Time, args []string) any {
+	script, ok := fakeScripts[sha]
+	if !ok {
+		return Error("ERR fake server cannot run this script")
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 0 || n > len(args)-1 {
+		return Error("ERR invalid number of keys")
+	}
+	return script(f, now, args[1:1+n], args[1+n:])
+}
+
+func (f *FakeServer) exists(key string) bool {
+	_, s := f.strings[key]
+	_, b := f.buckets[key]
+	_, l := f.logs[key]
+	return s || b || l
+}
+
+func (f *FakeServer) del(key string) {
+	delete(f.strings, key)
+	delete(f.buckets, key)
+	delete(f.logs, key)
+	delete(f.expires, key)
+}
+
+// expire deletes keys whose time to live has passed at now.
+func (f *FakeServer) expire(now time.Time) {
+	for key, at := range f.expires {
+		if !now.Before(at) {
+			f.del(key)
+		}
+	}
+}
+
+// tokenBucket emulates tokenBucketScript.
+func (f *FakeServer) tokenBucket(now time.Time, keys, args []string) any {
+	rate, _ := strconv.ParseFloat(args[0], 64)
+	capacity, _ := strconv.ParseFloat(args[1], 64)
+	cost, _ := strconv.ParseFloat(args[2], 64)
+	seconds := float64(now.UnixMicro()) / 1e6
+
+	state, ok := f.buckets[keys[0]]
+	if !ok {
+		state = [2]float64{capacity, seconds}
+	}
+	tokens := math.Min(capacity, state[0]+math.Max(0, seconds-state[1])*rate)
+
+	allowed, retry := 0, 0
+	if tokens >= cost {
+		tokens -= cost
+		allowed = 1
+	} else if rate > 0 {
+		retry = int(math.Ceil((cost - tokens) / rate * 1000))
+	}
+	tokens = math.Min(capacity, tokens)
+
+	f.buckets[keys[0]] = [2]float64{tokens, seconds}
+	if rate > 0 {
+		f.expires[keys[0]] = now.Add(time.Duration(math.Ceil(capacity/rate*1000)+1000) * time.Millisecond)
+	}
+	return []any{allowed, []byte(strconv.FormatFloat(tokens, 'f', -1, 64)), retry}
+}
+
+// fixedWindow emulates fixedWindowScript.
+func (f *FakeServer) fixedWindow(now time.Time, keys, args []string) any {
+	limit, _ := strconv.Atoi(args[0])
+	window, _ := strconv.Atoi(args[1])
+
+	count, _ := strconv.Atoi(f.strings[keys[0]])
+	if count >= limit {
+		pttl := -1
+		if at, ok := f.expires[keys[0]]; ok {
+			pttl = int(at.Sub(now).Milliseconds())
+		}
+		return []any{0, count, pttl}
+	}
+	count++
+	f.strings[keys[0]] = strconv.Itoa(count)
+	if count == 1 {
+		f.expires[keys[0]] = now.Add(time.Duration(window) * time.Millisecond)
+	}
+	return []any{1, count, 0}
+}
+
+// slidingLog emulates slidingLogScript.
+func (f *FakeServer) slidingLog(now time.Time, keys, args []string) any {
+	limit, _ := strconv.Atoi(args[0])
+	window, _ := strconv.ParseFloat(args[1], 64)
+	micros := float64(now.UnixMicro())
+
+	log, ok := f.logs[keys[0]]
+	if !ok {
+		log = make(map[string]float64)
+		f.logs[keys[0]] = log
+	}
+	for member, score := range log {
+		if score > micros {
+			// The clock went back: the request counts as made now.
+			score = micros
+			log[member] = score
+		}
+		if score <= micros-window {
+			delete(log, member)
+		}
+	}
+
+	if len(log) < limit {
+		log[args[2]] = micros
+		f.expires[keys[0]] = now.Add(time.Duration(math.Ceil(window/1000)) * time.Millisecond)
+		return []any{1, len(log), 0}
+	}
+
+	scores := make([]float64, 0, len(log))
+	for _, score := range log {
+		scores = append(scores, score)
+	}
+	sort.Float64s(scores)
+	retry := 0
+	if len(scores) > 0 {
+		retry = int(math.Ceil((scores[0] + window - micros) / 1000))
+	}
+	return []any{0, len(log), retry}
+}
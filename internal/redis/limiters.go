@@ -0,0 +1,234 @@
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Result is the outcome of a single decision.
+type Result struct {
+	Allowed    bool
+	Remaining  float64       // Tokens or requests left for the key.
+	RetryAfter time.Duration // How long until a denied request could succeed.
+}
+
+// tokenBucketScript spends ARGV[3] tokens from the bucket in KEYS[1], a hash holding
+// the token count and the time it was last refilled. New buckets start full, like the
+// in-memory tokenbucket. A negative cost returns tokens, up to the capacity.
+//
+// Numbers are returned as strings because Redis truncates Lua numbers to integers.
+var tokenBucketScript = NewScript(`
+local rate = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil then
+	tokens = capacity
+	ts = now
+end
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate)
+
+local allowed = 0
+local retry = 0
+if tokens >= cost then
+	tokens = tokens - cost
+	allowed = 1
+elseif rate > 0 then
+	retry = math.ceil((cost - tokens) / rate * 1000)
+end
+tokens = math.min(capacity, tokens)
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', string.format('%.6f', now))
+if rate > 0 then
+	redis.call('PEXPIRE', KEYS[1], math.ceil(capacity / rate * 1000) + 1000)
+end
+return {allowed, tostring(tokens), retry}
+`)
+
+// fixedWindowScript counts requests in KEYS[1], which expires ARGV[2] milliseconds
+// after the window's first request, like the in-memory fixedwindow. Denied requests
+// are not counted.
+var fixedWindowScript = NewScript(`
+local limit = tonumber(ARGV[1])
+local count = tonumber(redis.call('GET', KEYS[1]) or '0')
+if count >= limit then
+	return {0, count, redis.call('PTTL', KEYS[1])}
+end
+count = redis.call('INCR', KEYS[1])
+if count == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return {1, count, 0}
+`)
+
+// slidingLogScript keeps the allowed requests of the last ARGV[2] microseconds in the
+// sorted set KEYS[1], scored by time, like the in-memory slidinglog. ARGV[3] is a
+// unique member name for the request. If the server's clock went back, requests
+// scored after now count as made now, so the key is not locked out until the clock
+// catches up again.
+var slidingLogScript = NewScript(`
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+
+local ahead = redis.call('ZRANGEBYSCORE', KEYS[1], string.format('(%.0f', now), '+inf')
+for _, member in ipairs(ahead) do
+	redis.call('ZADD', KEYS[1], now, member)
+end
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+if count < limit then
+	redis.call('ZADD', KEYS[1], now, ARGV[3])
+	redis.call('PEXPIRE', KEYS[1], math.ceil(window / 1000))
+	return {1, count + 1, 0}
+end
+
+local retry = 0
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+if oldest[2] then
+	retry = math.ceil((tonumber(oldest[2]) + window - now) / 1000)
+end
+return {0, count, retry}
+`)
+
+// TokenBucket is a token bucket per key shared by every client of the Redis server.
+type TokenBucket struct {
+	client   *Client
+	prefix   string
+	rate     float64
+	capacity int
+}
+
+// NewTokenBucket creates a token bucket limiter that stores each key's bucket under
+// prefix+key, adding rate tokens per second up to capacity.
+func NewTokenBucket(c *Client, prefix string, rate float64, capacity int) *TokenBucket {
+	return &TokenBucket{client: c, prefix: prefix, rate: rate, capacity: capacity}
+}
+
+// Allow spends a token from key's bucket if one is available.
+func (tb *TokenBucket) Allow(key string) (Result, error) {
+	return tb.AllowN(key, 1)
+}
+
+// AllowN spends n tokens from key's bucket if that many are available. A negative n
+// puts -n tokens back, for example when tokens taken in advance were not used.
+func (tb *TokenBucket) AllowN(key string, n int) (Result, error) {
+	return tb.AllowNWith(context.Background(), key, n, tb.rate, tb.capacity)
+}
+
+// AllowNWith is AllowN for a key with its own rate and capacity, such as a key on a
+// different plan, giving up when ctx is done. The key keeps its tokens when its rate
+// and capacity change, up to the new capacity.
+func (tb *TokenBucket) AllowNWith(ctx context.Context, key string, n int, rate float64, capacity int) (Result, error) {
+	reply, err := tokenBucketScript.RunContext(ctx, tb.client, []string{tb.prefix + key}, rate, capacity, n)
+	if err != nil {
+		return Result{}, err
+	}
+	return parseResult(reply)
+}
+
+// FixedWindow allows a number of requests per key in each window, shared by every
+// client of the Redis server.
+type FixedWindow struct {
+	client *Client
+	prefix string
+	limit  int
+	window time.Duration
+}
+
+// NewFixedWindow creates a fixed window limiter that stores each key's count under
+// prefix+key, allowing limit requests per window.
+func NewFixedWindow(c *Client, prefix string, limit int, window time.Duration) *FixedWindow {
+	return &FixedWindow{client: c, prefix: prefix, limit: limit, window: window}
+}
+
+// Allow counts a request for key if its window has room for it.
+func (fw *FixedWindow) Allow(key string) (Result, error) {
+	reply, err := fixedWindowScript.Run(fw.client, []string{fw.prefix + key}, fw.limit, fw.window.Milliseconds())
+	if err != nil {
+		return Result{}, err
+	}
+	res, err := parseResult(reply)
+	if err != nil {
+		return Result{}, err
+	}
+	// The script returns the request count.
+	res.Remaining = float64(fw.limit) - res.Remaining
+	return res, nil
+}
+
+// SlidingLog allows a number of requests per key in any window of the given length,
+// shared by every client of the Redis server.
+type SlidingLog struct {
+	client *Client
+	prefix string
+	limit  int
+	window time.Duration
+}
+
+// NewSlidingLog creates a sliding log limiter that stores each key's log under
+// prefix+key, allowing limit requests in any window.
+func NewSlidingLog(c *Client, prefix string, limit int, window time.Duration) *SlidingLog {
+	return &SlidingLog{client: c, prefix: prefix, limit: limit, window: window}
+}
+
+// Allow logs a request for key if fewer than limit requests were logged in the last window.
+func (sl *SlidingLog) Allow(key string) (Result, error) {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	reply, err := slidingLogScript.Run(sl.client, []string{sl.prefix + key}, sl.limit, sl.window.Microseconds(), hex.EncodeToString(id))
+	if err != nil {
+		return Result{}, err
+	}
+	res, err := parseResult(reply)
+	if err != nil {
+		return Result{}, err
+	}
+	// The script returns the request count.
+	res.Remaining = float64(sl.limit) - res.Remaining
+	return res, nil
+}
+
+// parseResult decodes the {allowed, remaining or count, retry after in ms} reply of the scripts.
+func parseResult(reply any) (Result, error) {
+	values, ok := reply.([]any)
+	if !ok || len(values) != 3 {
+		return Result{}, fmt.Errorf("redis: unexpected script reply %v", reply)
+	}
+
+	allowed, ok1 := values[0].(int64)
+	retry, ok2 := values[2].(int64)
+	var remaining float64
+	var err error
+	switch v := values[1].(type) {
+	case int64:
+		remaining = float64(v)
+	case []byte:
+		remaining, err = strconv.ParseFloat(string(v), 64)
+	default:
+		ok1 = false
+	}
+	if !ok1 || !ok2 || err != nil {
+		return Result{}, fmt.Errorf("redis: unexpected script reply %v", reply)
+	}
+
+	return Result{
+		Allowed:    allowed == 1,
+		Remaining:  remaining,
+		RetryAfter: time.Duration(max(retry, 0)) * time.Millisecond,
+	}, nil
+}
@@ -0,0 +1,263 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nesyor/ratelimiter/internal/conformance"
+)
+
+// startFakeServer starts a fake server telling the time by now that is closed when
+// the test ends.
+func startFakeServer(t *testing.T, now func() time.Time) *FakeServer {
+	f, err := NewFakeServer(now)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestClientCommands(t *testing.T) {
+	f := startFakeServer(t, time.Now)
+	c := NewClient(f.Addr(), time.Second)
+	defer c.Close()
+
+	if reply, err := c.Do("PING"); err != nil || reply != "PONG" {
+		t.Fatalf("expected PONG but got %v, %v", reply, err)
+	}
+	if _, err := c.Do("SET", "greeting", "hello\r\nworld"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reply, err := c.Do("GET", "greeting"); err != nil || string(reply.([]byte)) != "hello\r\nworld" {
+		t.Errorf("expected the stored value but got %q, %v", reply, err)
+	}
+	if _, err := c.Do("GET", "missing"); err != ErrNil {
+		t.Errorf("expected ErrNil but got %v", err)
+	}
+	if reply, err := c.Do("DEL", "greeting", "missing"); err != nil || reply != int64(1) {
+		t.Errorf("expected 1 deleted key but got %v, %v", reply, err)
+	}
+
+	var replyErr Error
+	if _, err := c.Do("NOPE"); !errors.As(err, &replyErr) {
+		t.Errorf("expected an error reply but got %v", err)
+	}
+	// The connection is still usable after an error reply.
+	if _, err := c.Do("PING"); err != nil {
+		t.Errorf("unexpected error after an error reply: %v", err)
+	}
+
+	// After the connection is closed the next command redials.
+	c.Close()
+	if _, err := c.Do("PING"); err != nil {
+		t.Errorf("unexpected error after reconnecting: %v", err)
+	}
+}
+
+func TestClientContext(t *testing.T) {
+	f := startFakeServer(t, time.Now)
+	c := NewClient(f.Addr(), time.Second)
+	defer c.Close()
+
+	// A command waiting for the connection gives up when its context ends.
+	c.lock <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.DoContext(ctx, "PING"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to be exceeded but got %v", err)
+	}
+	<-c.lock
+
+	if reply, err := c.DoContext(context.Background(), "PING"); err != nil || reply != "PONG" {
+		t.Errorf("expected PONG once the connection is free but got %v, %v", reply, err)
+	}
+}
+
+func TestClientUnreachable(t *testing.T) {
+	c := NewClient("127.0.0.1:1", time.Second)
+	if _, err := c.Do("PING"); err == nil {
+		t.Error("expected an error for an unreachable server")
+	}
+}
+
+func TestScriptLoadsOnce(t *testing.T) {
+	f := startFakeServer(t, time.Now)
+	c := NewClient(f.Addr(), time.Second)
+	defer c.Close()
+
+	tb := NewTokenBucket(c, "test:", 1, 5)
+	for i := 0; i < 3; i++ {
+		if _, err := tb.Allow("a"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	// Only the first call sends the source; later calls hit the script cache.
+	if n := f.Evals(); n != 1 {
+		t.Errorf("expected the script source to be sent once but it was sent %d times", n)
+	}
+}
+
+// scriptServer returns a function connecting to the server the limiters' scripts are
+// tested against, and a function letting time pass on it. That is a fake server with
+// a fake clock, so the tests take no time, or if $REDIS_ADDR is set the Redis server
+// there, whose clock the tests have to wait for. Running against a real server checks
+// that the fake's emulation of the scripts matches their Lua.
+func scriptServer(t *testing.T) (dial func() *Client, advance func(time.Duration)) {
+	addr := os.Getenv("REDIS_ADDR")
+	advance = time.Sleep
+	if addr == "" {
+		clock := conformance.NewClock()
+		addr = startFakeServer(t, clock.Now).Addr()
+		advance = clock.Advance
+	}
+
+	dial = func() *Client {
+		c := NewClient(addr, time.Second)
+		if _, err := c.Do("PING"); err != nil {
+			t.Fatalf("no Redis server at %s: %v", addr, err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	return dial, advance
+}
+
+// testPrefix returns a key prefix unique to the test, and deletes the given keys
+// under it when the test ends.
+func testPrefix(t *testing.T, c *Client, keys ...string) string {
+	prefix := fmt.Sprintf("ratelimiter-test:%s:%d:", t.Name(), time.Now().UnixNano())
+	t.Cleanup(func() {
+		for _, key := range keys {
+			c.Do("DEL", prefix+key)
+		}
+	})
+	return prefix
+}
+
+func TestTokenBucket(t *testing.T) {
+	dial, advance := scriptServer(t)
+	c := dial()
+	prefix := testPrefix(t, c, "a", "b")
+
+	tb := NewTokenBucket(c, prefix, 2, 3)
+	for i := 0; i < 3; i++ {
+		// A little time passes between requests, so the bucket may have refilled slightly.
+		res, err := tb.Allow("a")
+		if err != nil || !res.Allowed || res.Remaining < float64(2-i) || res.Remaining >= float64(3-i) {
+			t.Fatalf("expected request %d to be allowed with %d tokens left but got %+v, %v", i+1, 2-i, res, err)
+		}
+	}
+	res, _ := tb.Allow("a")
+	if res.Allowed || res.RetryAfter <= 0 || res.RetryAfter > 500*time.Millisecond {
+		t.Fatalf("expected a denial with a retry within 500ms but got %+v", res)
+	}
+
+	// At 2 tokens per second one token arrives within 500ms.
+	advance(res.RetryAfter + 50*time.Millisecond)
+	if res, _ := tb.Allow("a"); !res.Allowed {
+		t.Error("expected a request to be allowed after a token was added")
+	}
+
+	// Unused tokens can be given back, up to the capacity.
+	if res, _ := tb.AllowN("a", -10); res.Remaining != 3 {
+		t.Errorf("expected returned tokens to fill the bucket to 3 but got %v", res.Remaining)
+	}
+
+	// A second client shares the same bucket.
+	other := NewTokenBucket(dial(), prefix, 2, 3)
+	if res, _ := other.AllowN("a", 3); !res.Allowed {
+		t.Error("expected the second client to see the shared bucket")
+	}
+	if res, _ := tb.Allow("a"); res.Allowed {
+		t.Error("expected the first client to see the bucket emptied by the second")
+	}
+
+	// Keys may have their own rate and capacity.
+	if res, _ := tb.AllowNWith(context.Background(), "b", 1, 1, 10); !res.Allowed || res.Remaining < 9 || res.Remaining >= 10 {
+		t.Errorf("expected a bucket of 10 with 9 tokens left but got %+v", res)
+	}
+}
+
+func TestFixedWindow(t *testing.T) {
+	dial, advance := scriptServer(t)
+	c := dial()
+	fw := NewFixedWindow(c, testPrefix(t, c, "a"), 2, 300*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		if res, err := fw.Allow("a"); err != nil || !res.Allowed {
+			t.Fatalf("expected request %d to be allowed but got %+v, %v", i+1, res, err)
+		}
+	}
+	res, _ := fw.Allow("a")
+	if res.Allowed || res.Remaining != 0 || res.RetryAfter <= 0 || res.RetryAfter > 300*time.Millisecond {
+		t.Fatalf("expected a denial until the window ends but got %+v", res)
+	}
+
+	advance(res.RetryAfter + 50*time.Millisecond)
+	if res, _ := fw.Allow("a"); !res.Allowed || res.Remaining != 1 {
+		t.Errorf("expected a new window but got %+v", res)
+	}
+}
+
+func TestSlidingLog(t *testing.T) {
+	dial, advance := scriptServer(t)
+	c := dial()
+	sl := NewSlidingLog(c, testPrefix(t, c, "a"), 2, 400*time.Millisecond)
+
+	sl.Allow("a")
+	advance(200 * time.Millisecond)
+	if res, _ := sl.Allow("a"); !res.Allowed || res.Remaining != 0 {
+		t.Fatalf("expected the second request to be allowed but got %+v", res)
+	}
+
+	res, _ := sl.Allow("a")
+	if res.Allowed || res.RetryAfter <= 0 || res.RetryAfter > 200*time.Millisecond {
+		t.Fatalf("expected a denial until the first request leaves the log but got %+v", res)
+	}
+
+	// Once the first request left the window there is room for one more.
+	advance(res.RetryAfter + 20*time.Millisecond)
+	if res, _ := sl.Allow("a"); !res.Allowed {
+		t.Error("expected a request to be allowed once the first one left the window")
+	}
+	if res, _ := sl.Allow("a"); res.Allowed {
+		t.Error("expected the log to be full again")
+	}
+}
+
+func TestSlidingLogClockGoesBack(t *testing.T) {
+	dial, advance := scriptServer(t)
+	c := dial()
+	prefix := testPrefix(t, c, "a")
+	sl := NewSlidingLog(c, prefix, 2, 300*time.Millisecond)
+
+	// Requests logged an hour ahead of the server's clock, as if it went back since.
+	reply, err := c.Do("TIME")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	parts := reply.([]any)
+	secs, _ := strconv.ParseInt(string(parts[0].([]byte)), 10, 64)
+	ahead := (secs + 3600) * 1_000_000
+	for _, member := range []string{"x", "y"} {
+		if _, err := c.Do("ZADD", prefix+"a", ahead, member); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// They count as made now, so the key waits for the window rather than the hour.
+	res, _ := sl.Allow("a")
+	if res.Allowed || res.RetryAfter <= 0 || res.RetryAfter > 300*time.Millisecond {
+		t.Fatalf("expected a denial until the window ends but got %+v", res)
+	}
+	advance(res.RetryAfter + 50*time.Millisecond)
+	if res, _ := sl.Allow("a"); !res.Allowed {
+		t.Errorf("expected a request to be allowed once the window passed but got %+v", res)
+	}
+}
@@ -0,0 +1,43 @@
+package redis
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+)
+
+// Script is a Lua script run atomically on the server.
+type Script struct {
+	src string
+	sha string
+}
+
+// NewScript creates a script from its Lua source.
+func NewScript(src string) *Script {
+	sum := sha1.Sum([]byte(src))
+	return &Script{src: src, sha: hex.EncodeToString(sum[:])}
+}
+
+// Run runs the script with the given keys and arguments. It sends only the script's
+// SHA1 digest and falls back to sending the source when the server has not cached it yet.
+func (s *Script) Run(c *Client, keys []string, args ...any) (any, error) {
+	return s.RunContext(context.Background(), c, keys, args...)
+}
+
+// RunContext is Run with a context bounding the round trips to the server.
+func (s *Script) RunContext(ctx context.Context, c *Client, keys []string, args ...any) (any, error) {
+	cmd := make([]any, 0, 3+len(keys)+len(args))
+	cmd = append(cmd, "EVALSHA", s.sha, len(keys))
+	for _, key := range keys {
+		cmd = append(cmd, key)
+	}
+	cmd = append(cmd, args...)
+
+	reply, err := c.DoContext(ctx, cmd...)
+	if e, ok := err.(Error); ok && strings.HasPrefix(string(e), "NOSCRIPT") {
+		cmd[0], cmd[1] = "EVAL", s.src
+		return c.DoContext(ctx, cmd...)
+	}
+	return reply, err
+}
@@ -0,0 +1,208 @@
+// Package shape limits bandwidth with token buckets that spend one token per byte.
+//
+// Readers, writers and connections can be given several buckets, typically one of
+// their own and one shared with every other connection, and wait for all of them.
+// Data moves in chunks no larger than any bucket's burst, so connections sharing a
+// bucket take turns instead of one large transfer holding it.
+package shape
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxChunk bounds the bytes moved per wait, so waits stay short even for large bursts.
+const maxChunk = 32 * 1024
+
+// Bucket is a token bucket with one token per byte.
+type Bucket struct {
+	rate   float64 // Bytes per second.
+	burst  int     // Bytes that may be sent at once.
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex
+}
+
+// NewBucket creates a bucket allowing rate bytes per second with bursts of up to burst
+// bytes. Both must be positive.
+func NewBucket(rate float64, burst int) (*Bucket, error) {
+	if !(rate > 0) || math.IsInf(rate, 1) {
+		return nil, fmt.Errorf("shape: rate must be positive and finite, got %g", rate)
+	}
+	if burst <= 0 {
+		return nil, fmt.Errorf("shape: burst must be positive, got %d", burst)
+	}
+	return newBucket(rate, burst), nil
+}
+
+// newBucket creates a bucket like NewBucket, without checking its parameters.
+func newBucket(rate float64, burst int) *Bucket {
+	return &Bucket{rate: rate, burst: burst, tokens: float64(burst), last: time.Now()}
+}
+
+// reserve takes n tokens, going into debt if there are not enough, and returns how
+// long to wait until the debt is paid off.
+func (b *Bucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(b.burst), b.tokens+elapsed*b.rate)
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel gives back n tokens taken by reserve.
+func (b *Bucket) cancel(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = math.Min(float64(b.burst), b.tokens+float64(n))
+}
+
+// WaitN blocks until n bytes may be sent through every bucket, or ctx is done.
+// n should not exceed the smallest burst.
+func WaitN(ctx context.Context, n int, buckets ...*Bucket) error {
+	var delay time.Duration
+	for _, b := range buckets {
+		delay = max(delay, b.reserve(n))
+	}
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		for _, b := range buckets {
+			b.cancel(n)
+		}
+		return ctx.Err()
+	}
+}
+
+// chunkSize returns the most bytes that may be moved per wait on buckets.
+func chunkSize(buckets []*Bucket) int {
+	size := maxChunk
+	for _, b := range buckets {
+		size = min(size, b.burst)
+	}
+	return size
+}
+
+// Reader limits the bytes read from an io.Reader.
+type Reader struct {
+	r       io.Reader
+	ctx     context.Context
+	buckets []*Bucket
+}
+
+// NewReader limits reads from r by buckets. Waiting stops when ctx is done.
+func NewReader(ctx context.Context, r io.Reader, buckets ...*Bucket) *Reader {
+	return &Reader{r: r, ctx: ctx, buckets: buckets}
+}
+
+// Read reads at most one chunk and waits until the bytes read are within the limits.
+func (r *Reader) Read(p []byte) (int, error) {
+	if len(p) > chunkSize(r.buckets) {
+		p = p[:chunkSize(r.buckets)]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := WaitN(r.ctx, n, r.buckets...); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// Writer limits the bytes written to an io.Writer.
+type Writer struct {
+	w       io.Writer
+	ctx     context.Context
+	buckets []*Bucket
+}
+
+// NewWriter limits writes to w by buckets. Waiting stops when ctx is done.
+func NewWriter(ctx context.Context, w io.Writer, buckets ...*Bucket) *Writer {
+	return &Writer{w: w, ctx: ctx, buckets: buckets}
+}
+
+// Write writes p in chunks, waiting for the limits before each one.
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	chunk := chunkSize(w.buckets)
+	for len(p) > 0 {
+		n := min(len(p), chunk)
+		if err := WaitN(w.ctx, n, w.buckets...); err != nil {
+			return written, err
+		}
+		m, err := w.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Conn limits the bytes read from and written to a net.Conn.
+type Conn struct {
+	net.Conn
+	r *Reader
+	w *Writer
+}
+
+// NewConn limits reads from c by in and writes to c by out.
+func NewConn(c net.Conn, in, out []*Bucket) *Conn {
+	ctx := context.Background()
+	return &Conn{Conn: c, r: NewReader(ctx, c, in...), w: NewWriter(ctx, c, out...)}
+}
+
+func (c *Conn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *Conn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+// responseWriter limits the bytes of a response body.
+type responseWriter struct {
+	http.ResponseWriter
+	w *Writer
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) { return rw.w.Write(p) }
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (rw *responseWriter) Unwrap() http.ResponseWriter { return rw.ResponseWriter }
+
+// Handler limits each response body written by next to rate bytes per second with
+// bursts of burst bytes, and all of them together by shared when it is not nil. The
+// rate and burst must be positive, as for NewBucket.
+func Handler(rate float64, burst int, shared *Bucket, next http.Handler) (http.Handler, error) {
+	if _, err := NewBucket(rate, burst); err != nil {
+		return nil, err
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buckets := []*Bucket{newBucket(rate, burst)}
+		if shared != nil {
+			buckets = append(buckets, shared)
+		}
+		next.ServeHTTP(&responseWriter{ResponseWriter: w, w: NewWriter(r.Context(), w, buckets...)}, r)
+	}), nil
+}
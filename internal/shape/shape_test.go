@@ -0,0 +1,156 @@
+package shape
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mustNewBucket creates a bucket, failing the test if the parameters are invalid.
+func mustNewBucket(t *testing.T, rate float64, burst int) *Bucket {
+	t.Helper()
+	b, err := NewBucket(rate, burst)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return b
+}
+
+func TestNewBucketRejectsInvalidParameters(t *testing.T) {
+	for _, tc := range []struct {
+		rate  float64
+		burst int
+	}{{0, 1000}, {-1, 1000}, {math.NaN(), 1000}, {math.Inf(1), 1000}, {1000, 0}, {1000, -1}} {
+		if _, err := NewBucket(tc.rate, tc.burst); err == nil {
+			t.Errorf("expected an error for rate %g and burst %d", tc.rate, tc.burst)
+		}
+		if _, err := Handler(tc.rate, tc.burst, nil, http.NotFoundHandler()); err == nil {
+			t.Errorf("expected Handler to reject rate %g and burst %d", tc.rate, tc.burst)
+		}
+	}
+}
+
+func TestWriterRate(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(context.Background(), &buf, mustNewBucket(t, 10_000, 1000))
+
+	// The first 1000 bytes are the burst, the other 2000 take 200ms.
+	start := time.Now()
+	n, err := w.Write(make([]byte, 3000))
+	if err != nil || n != 3000 || buf.Len() != 3000 {
+		t.Fatalf("expected 3000 bytes written but got %d, %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond {
+		t.Errorf("expected the write to take about 200ms but took %s", elapsed)
+	}
+}
+
+func TestReaderRate(t *testing.T) {
+	r := NewReader(context.Background(), bytes.NewReader(make([]byte, 3000)), mustNewBucket(t, 10_000, 1000))
+
+	start := time.Now()
+	data, err := io.ReadAll(r)
+	if err != nil || len(data) != 3000 {
+		t.Fatalf("expected 3000 bytes read but got %d, %v", len(data), err)
+	}
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond {
+		t.Errorf("expected the read to take about 200ms but took %s", elapsed)
+	}
+}
+
+func TestWriterCanceled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	var buf bytes.Buffer
+	w := NewWriter(ctx, &buf, mustNewBucket(t, 1000, 100))
+	n, err := w.Write(make([]byte, 1000))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to stop the write but got %v", err)
+	}
+	if n != buf.Len() || n >= 1000 {
+		t.Errorf("expected a partial write to be reported but got %d of %d", n, buf.Len())
+	}
+}
+
+func TestSharedBucketIsFair(t *testing.T) {
+	shared := mustNewBucket(t, 20_000, 1000)
+
+	// A large and a small transfer share the aggregate limit.
+	var wg sync.WaitGroup
+	finished := make([]time.Duration, 2)
+	start := time.Now()
+	for i, size := range []int{8000, 2000} {
+		w := NewWriter(context.Background(), io.Discard, mustNewBucket(t, 1e9, 1000), shared)
+		wg.Add(1)
+		go func(i, size int) {
+			defer wg.Done()
+			w.Write(make([]byte, size))
+			finished[i] = time.Since(start)
+		}(i, size)
+	}
+	wg.Wait()
+
+	// Taking turns, the small transfer finishes long before the large one.
+	if finished[1] > finished[0]/2 {
+		t.Errorf("expected the small transfer not to wait for the large one, finished after %s and %s", finished[1], finished[0])
+	}
+	// Together they cannot beat the shared rate: 9000 bytes beyond the burst at 20000/s.
+	if finished[0] < 400*time.Millisecond {
+		t.Errorf("expected the shared limit to hold but everything finished in %s", finished[0])
+	}
+}
+
+func TestConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	c := NewConn(server, nil, []*Bucket{mustNewBucket(t, 10_000, 500)})
+	go func() {
+		c.Write(make([]byte, 1500))
+		c.Close()
+	}()
+
+	start := time.Now()
+	data, _ := io.ReadAll(client)
+	if len(data) != 1500 {
+		t.Fatalf("expected 1500 bytes but got %d", len(data))
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("expected writes to the connection to be limited but took %s", elapsed)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	body := make([]byte, 2000)
+	h, err := Handler(10_000, 1000, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	start := time.Now()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if len(data) != 2000 {
+		t.Fatalf("expected 2000 bytes but got %d", len(data))
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("expected the response body to be limited but took %s", elapsed)
+	}
+}
@@ -0,0 +1,165 @@
+// Package sim contains simulated-clock versions of the repository's rate limiting
+// algorithms. Each limiter takes the current time as an argument instead of reading
+// the wall clock, so recorded traffic can be replayed through it faster than real time.
+// They are separate implementations of the algorithms, tested to make the same
+// decisions as the reference models in internal/conformance, which the in-memory
+// limiters in the algorithm directories are tested against as well.
+package sim
+
+import (
+	"fmt"
+	"time"
+)
+
+// Algorithms lists the names accepted by New, in report order.
+var Algorithms = []string{"tokenbucket", "leakybucket", "fixedwindow", "slidinglog", "slidingwindow"}
+
+// Limiter decides whether a request for key at the given time is allowed.
+// Calls must be made in non-decreasing time order.
+type Limiter interface {
+	Allow(key string, now time.Time) bool
+}
+
+// Params configures a simulated limiter. The bucket algorithms use Rate and Burst,
+// the window algorithms use Limit and Window.
+type Params struct {
+	Rate   float64       // Tokens added (tokenbucket) or water leaked (leakybucket) per second.
+	Burst  int           // Bucket capacity.
+	Limit  int           // Requests allowed per window.
+	Window time.Duration // Window length.
+}
+
+// New creates the named limiter.
+func New(algorithm string, p Params) (Limiter, error) {
+	switch algorithm {
+	case "tokenbucket":
+		return &tokenBucket{params: p, buckets: make(map[string]*tokenState)}, nil
+	case "leakybucket":
+		return &leakyBucket{params: p, buckets: make(map[string]*bucketState)}, nil
+	case "fixedwindow":
+		return &fixedWindow{params: p, windows: make(map[string]*windowState)}, nil
+	case "slidinglog":
+		return &slidingLog{params: p, logs: make(map[string][]time.Time)}, nil
+	case "slidingwindow":
+		return &slidingLog{params: p, logs: make(map[string][]time.Time), inclusive: true}, nil
+	default:
+		return nil, fmt.Errorf("unknown algorithm %q", algorithm)
+	}
+}
+
+// tokenState is the per-key state of tokenBucket.
+type tokenState struct {
+	nanoTokens  int64 // Billionths of a token.
+	lastChecked time.Time
+}
+
+// tokenBucket starts each key with a full bucket and spends one token per request.
+// Like the tokenbucket package, it keeps the time spent towards the next token
+// exactly, so tokens are counted in billionths rather than as a float.
+type tokenBucket struct {
+	params  Params
+	buckets map[string]*tokenState
+}
+
+func (tb *tokenBucket) Allow(key string, now time.Time) bool {
+	full := int64(tb.params.Burst) * int64(time.Second)
+	b, exists := tb.buckets[key]
+	if !exists {
+		b = &tokenState{nanoTokens: full, lastChecked: now}
+		tb.buckets[key] = b
+	}
+
+	gained := float64(now.Sub(b.lastChecked)) * tb.params.Rate
+	b.nanoTokens = int64(min(float64(b.nanoTokens)+gained, float64(full)))
+	b.lastChecked = now
+
+	if b.nanoTokens < int64(time.Second) {
+		return false
+	}
+	b.nanoTokens -= int64(time.Second)
+	return true
+}
+
+// bucketState is the per-key state of leakyBucket.
+type bucketState struct {
+	level       float64 // Water in the bucket.
+	lastChecked time.Time
+}
+
+// leakyBucket starts each key with an empty bucket and adds one unit of water per request.
+type leakyBucket struct {
+	params  Params
+	buckets map[string]*bucketState
+}
+
+func (lb *leakyBucket) Allow(key string, now time.Time) bool {
+	b, exists := lb.buckets[key]
+	if !exists {
+		b = &bucketState{lastChecked: now}
+		lb.buckets[key] = b
+	}
+
+	b.level = max(b.level-now.Sub(b.lastChecked).Seconds()*lb.params.Rate, 0)
+	b.lastChecked = now
+
+	if b.level+1 > float64(lb.params.Burst) {
+		return false
+	}
+	b.level++
+	return true
+}
+
+// windowState is the per-key state of fixedWindow.
+type windowState struct {
+	count      int
+	expireTime time.Time
+}
+
+// fixedWindow starts a key's window at its first request.
+type fixedWindow struct {
+	params  Params
+	windows map[string]*windowState
+}
+
+func (fw *fixedWindow) Allow(key string, now time.Time) bool {
+	w, exists := fw.windows[key]
+	if !exists || !now.Before(w.expireTime) {
+		fw.windows[key] = &windowState{count: 1, expireTime: now.Add(fw.params.Window)}
+		return fw.params.Limit > 0
+	}
+	if w.count < fw.params.Limit {
+		w.count++
+		return true
+	}
+	return false
+}
+
+// slidingLog keeps the timestamps of allowed requests within the window. The
+// slidingwindow package also counts requests exactly one window old, hence inclusive.
+type slidingLog struct {
+	params    Params
+	logs      map[string][]time.Time
+	inclusive bool
+}
+
+func (sl *slidingLog) Allow(key string, now time.Time) bool {
+	log := sl.logs[key]
+
+	// Remove timestamps that are out of window
+	j := 0
+	for _, timestamp := range log {
+		age := now.Sub(timestamp)
+		if age < sl.params.Window || (sl.inclusive && age == sl.params.Window) {
+			log[j] = timestamp
+			j++
+		}
+	}
+	log = log[:j]
+
+	allowed := len(log) < sl.params.Limit
+	if allowed {
+		log = append(log, now)
+	}
+	sl.logs[key] = log
+	return allowed
+}
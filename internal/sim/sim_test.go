@@ -0,0 +1,136 @@
+package sim
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/nesyor/ratelimiter/internal/conformance"
+)
+
+var start = time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+// allowedAt feeds one request per offset for key and counts the allowed ones.
+func allowedAt(l Limiter, key string, offsets ...time.Duration) int {
+	allowed := 0
+	for _, offset := range offsets {
+		if l.Allow(key, start.Add(offset)) {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+// burst returns n offsets at the same instant.
+func burst(n int, at time.Duration) []time.Duration {
+	offsets := make([]time.Duration, n)
+	for i := range offsets {
+		offsets[i] = at
+	}
+	return offsets
+}
+
+func TestAlgorithmsBurst(t *testing.T) {
+	params := Params{Rate: 1, Burst: 5, Limit: 5, Window: time.Second}
+
+	for _, algorithm := range Algorithms {
+		l, err := New(algorithm, params)
+		if err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+		if n := allowedAt(l, "a", burst(8, 0)...); n != 5 {
+			t.Errorf("%s: expected a burst of 5 to be allowed but got %d", algorithm, n)
+		}
+		// Keys are limited independently.
+		if n := allowedAt(l, "b", burst(8, 0)...); n != 5 {
+			t.Errorf("%s: expected a second key to get its own burst but got %d", algorithm, n)
+		}
+	}
+}
+
+func TestAlgorithmsRecovery(t *testing.T) {
+	params := Params{Rate: 2, Burst: 2, Limit: 2, Window: time.Second}
+
+	tests := map[string]int{
+		"tokenbucket":   1, // One token refilled after 500ms.
+		"leakybucket":   1, // One unit leaked after 500ms.
+		"fixedwindow":   0, // Still in the first window.
+		"slidinglog":    0, // Both requests still in the log.
+		"slidingwindow": 0,
+	}
+	for algorithm, expected := range tests {
+		l, _ := New(algorithm, params)
+		allowedAt(l, "a", burst(2, 0)...)
+		if n := allowedAt(l, "a", burst(2, 500*time.Millisecond)...); n != expected {
+			t.Errorf("%s: expected %d requests allowed after 500ms but got %d", algorithm, expected, n)
+		}
+	}
+}
+
+func TestSlidingWindowBoundary(t *testing.T) {
+	params := Params{Limit: 1, Window: time.Second}
+
+	log, _ := New("slidinglog", params)
+	window, _ := New("slidingwindow", params)
+	for _, l := range []Limiter{log, window} {
+		l.Allow("a", start)
+	}
+
+	// Exactly one window later, only the sliding log has forgotten the first request.
+	if !log.Allow("a", start.Add(time.Second)) {
+		t.Error("expected slidinglog to allow a request exactly one window later")
+	}
+	if window.Allow("a", start.Add(time.Second)) {
+		t.Error("expected slidingwindow to deny a request exactly one window later")
+	}
+}
+
+func TestUnknownAlgorithm(t *testing.T) {
+	if _, err := New("gcra", Params{}); err == nil {
+		t.Error("expected an error for an unknown algorithm")
+	}
+}
+
+func TestAlgorithmsMatchModels(t *testing.T) {
+	for _, params := range []Params{
+		{Rate: 5, Burst: 10, Limit: 5, Window: time.Second},
+		{Rate: 3, Burst: 4, Limit: 4, Window: 700 * time.Millisecond},
+	} {
+		rate, burst := int(params.Rate), params.Burst
+		models := map[string]func() conformance.Model{
+			"tokenbucket": conformance.TokenBucket(rate, burst),
+			// A leaky bucket used as a meter is a token bucket counting the room left.
+			"leakybucket": conformance.TokenBucket(rate, burst),
+			"fixedwindow": conformance.FixedWindow(params.Limit, params.Window),
+			"slidinglog":  conformance.SlidingLog(params.Limit, params.Window),
+			// Requests still count when exactly a window old.
+			"slidingwindow": conformance.SlidingLog(params.Limit, params.Window+time.Nanosecond),
+		}
+
+		for _, algorithm := range Algorithms {
+			for seed := int64(1); seed <= 20; seed++ {
+				r := rand.New(rand.NewSource(seed))
+				l, _ := New(algorithm, params)
+				model := models[algorithm]()
+
+				now := start
+				for i := 0; i < 1000; i++ {
+					// Mostly bursts and short gaps, sometimes idle periods.
+					switch r.Intn(4) {
+					case 0:
+					case 1, 2:
+						now = now.Add(time.Duration(r.Int63n(int64(time.Second) / int64(rate))))
+					case 3:
+						now = now.Add(time.Duration(r.Int63n(int64(3 * params.Window))))
+					}
+
+					key := []string{"a", "b", "c"}[r.Intn(3)]
+					if got, want := l.Allow(key, now), model.Allow(key, now); got != want {
+						t.Fatalf("%s %+v, seed %d, request %d for %s: expected allowed %v but got %v",
+							algorithm, params, seed, i+1, key, want, got)
+					}
+				}
+			}
+		}
+	}
+}
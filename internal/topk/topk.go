@@ -0,0 +1,224 @@
+// Package topk tracks the keys that make the most requests and get denied the most,
+// to show who is being throttled. It keeps a fixed number of counters with the
+// space-saving algorithm, so memory does not grow with the number of keys, and
+// reports over a sliding period made of a few slots that expire one at a time.
+package topk
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"time"
+)
+
+// slots is the number of parts a tracker's period is split into. The reported
+// period slides forward one slot at a time.
+const slots = 6
+
+// Entry is a key's count in a report. The key's true count lies between Count-Error
+// and Count.
+type Entry struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+	Error uint64 `json:"error"`
+}
+
+// Report lists the keys with the most requests and the most denials since a point in time.
+type Report struct {
+	Since    time.Time `json:"since"`
+	Requests []Entry   `json:"requests"`
+	Denied   []Entry   `json:"denied"`
+}
+
+// Tracker records limiter decisions and reports the top keys over a sliding period.
+// A nil *Tracker discards everything.
+type Tracker struct {
+	capacity int           // Counters per summary.
+	slot     time.Duration // Length of each slot.
+	slots    [slots]slot
+	now      func() time.Time
+	mu       sync.Mutex
+}
+
+// slot summarizes the decisions made during one part of the period.
+type slot struct {
+	start    time.Time
+	requests *summary
+	denied   *summary
+}
+
+// New creates a tracker reporting on the last period that can find the top k keys
+// reliably. It keeps 10*k counters for requests and for denials in each slot; a
+// key's count is overestimated by at most the slot's requests divided by that.
+func New(k int, period time.Duration) *Tracker {
+	t := &Tracker{
+		capacity: 10 * max(k, 1),
+		slot:     max(period/slots, time.Nanosecond),
+		now:      time.Now,
+	}
+	for i := range t.slots {
+		t.slots[i] = slot{requests: newSummary(t.capacity), denied: newSummary(t.capacity)}
+	}
+	return t
+}
+
+// current returns the slot for now, clearing it if it last held an older part of
+// the period. The caller must hold t.mu.
+func (t *Tracker) current(now time.Time) *slot {
+	start := now.Truncate(t.slot)
+	s := &t.slots[int(start.UnixNano()/int64(t.slot))%slots]
+	if !s.start.Equal(start) {
+		s.start = start
+		s.requests.reset()
+		s.denied.reset()
+	}
+	return s
+}
+
+// Record counts a decision for key.
+func (t *Tracker) Record(key string, allowed bool) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.current(t.now())
+	s.requests.add(key)
+	if !allowed {
+		s.denied.add(key)
+	}
+}
+
+// Top returns the n keys with the most requests and the most denials over the period.
+func (t *Tracker) Top(n int) Report {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	t.current(now)
+	since := now.Truncate(t.slot).Add(-(slots - 1) * t.slot)
+
+	var requests, denied []*summary
+	for i := range t.slots {
+		if s := &t.slots[i]; !s.start.Before(since) {
+			requests = append(requests, s.requests)
+			denied = append(denied, s.denied)
+		}
+	}
+	return Report{Since: since, Requests: merge(requests, n), Denied: merge(denied, n)}
+}
+
+// merge adds up the counts of the summaries and returns the n largest. A key missing
+// from a full summary may have been counted up to its smallest count there.
+func merge(summaries []*summary, n int) []Entry {
+	totals := make(map[string]*Entry)
+	for _, s := range summaries {
+		for key := range s.counters {
+			if totals[key] == nil {
+				totals[key] = &Entry{Key: key}
+			}
+		}
+	}
+	for _, e := range totals {
+		for _, s := range summaries {
+			if c, ok := s.counters[e.Key]; ok {
+				e.Count += c.count
+				e.Error += c.error
+			} else {
+				e.Count += s.min()
+				e.Error += s.min()
+			}
+		}
+	}
+
+	entries := make([]Entry, 0, len(totals))
+	for _, e := range totals {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	return entries[:min(n, len(entries))]
+}
+
+// summary counts keys with the space-saving algorithm: when all counters are taken,
+// a new key replaces the key with the smallest count and inherits that count.
+type summary struct {
+	capacity int
+	counters map[string]*counter
+	heap     counterHeap
+}
+
+type counter struct {
+	key   string
+	count uint64
+	error uint64 // How much of count may belong to keys replaced before.
+	index int    // Position in the heap.
+}
+
+func newSummary(capacity int) *summary {
+	return &summary{capacity: capacity, counters: make(map[string]*counter)}
+}
+
+func (s *summary) add(key string) {
+	if c, ok := s.counters[key]; ok {
+		c.count++
+		heap.Fix(&s.heap, c.index)
+		return
+	}
+	if len(s.heap) < s.capacity {
+		c := &counter{key: key, count: 1}
+		s.counters[key] = c
+		heap.Push(&s.heap, c)
+		return
+	}
+
+	// The new key may have had as many requests as the key it replaces.
+	c := s.heap[0]
+	delete(s.counters, c.key)
+	c.key, c.error = key, c.count
+	c.count++
+	s.counters[key] = c
+	heap.Fix(&s.heap, 0)
+}
+
+// min returns the most a key without a counter may have been counted.
+func (s *summary) min() uint64 {
+	if len(s.heap) < s.capacity {
+		return 0
+	}
+	return s.heap[0].count
+}
+
+func (s *summary) reset() {
+	clear(s.counters)
+	s.heap = s.heap[:0]
+}
+
+// counterHeap is a min-heap of counters by count.
+type counterHeap []*counter
+
+func (h counterHeap) Len() int           { return len(h) }
+func (h counterHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h counterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *counterHeap) Push(x any) {
+	c := x.(*counter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *counterHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
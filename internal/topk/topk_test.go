@@ -0,0 +1,101 @@
+package topk
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func newTestTracker(k int, period time.Duration) (*Tracker, *time.Time) {
+	t := New(k, period)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	t.now = func() time.Time { return now }
+	return t, &now
+}
+
+func TestTopFindsHeavyHitters(t *testing.T) {
+	tracker, _ := newTestTracker(5, time.Minute)
+
+	// Five heavy keys with 30% of the requests hidden among many light ones. With 50
+	// counters a key's count is off by at most 50000/50 = 1000, well below theirs.
+	r := rand.New(rand.NewSource(1))
+	counts := make(map[string]uint64)
+	for i := 0; i < 50_000; i++ {
+		key := fmt.Sprintf("light-%d", r.Intn(10_000))
+		if i%10 < 3 {
+			key = fmt.Sprintf("heavy-%d", r.Intn(5))
+		}
+		counts[key]++
+		tracker.Record(key, true)
+	}
+
+	report := tracker.Top(5)
+	if len(report.Requests) != 5 {
+		t.Fatalf("expected 5 entries but got %v", report.Requests)
+	}
+	for _, e := range report.Requests {
+		if e.Key[:5] != "heavy" {
+			t.Errorf("expected only heavy keys but got %+v", e)
+		}
+		if exact := counts[e.Key]; e.Count < exact || e.Count-e.Error > exact {
+			t.Errorf("expected %s's count %d within [%d, %d]", e.Key, exact, e.Count-e.Error, e.Count)
+		}
+	}
+	if len(report.Denied) != 0 {
+		t.Errorf("expected no denied keys but got %v", report.Denied)
+	}
+}
+
+func TestTopDenied(t *testing.T) {
+	tracker, _ := newTestTracker(2, time.Minute)
+
+	for i := 0; i < 10; i++ {
+		tracker.Record("busy", true)
+	}
+	for i := 0; i < 3; i++ {
+		tracker.Record("throttled", false)
+	}
+	tracker.Record("unlucky", false)
+
+	report := tracker.Top(2)
+	if len(report.Requests) != 2 || report.Requests[0] != (Entry{Key: "busy", Count: 10}) {
+		t.Errorf("expected busy to make the most requests but got %v", report.Requests)
+	}
+	want := []Entry{{Key: "throttled", Count: 3}, {Key: "unlucky", Count: 1}}
+	if len(report.Denied) != 2 || report.Denied[0] != want[0] || report.Denied[1] != want[1] {
+		t.Errorf("expected %v but got %v", want, report.Denied)
+	}
+}
+
+func TestTopSlidingPeriod(t *testing.T) {
+	tracker, now := newTestTracker(2, time.Minute)
+
+	tracker.Record("old", false)
+	*now = now.Add(30 * time.Second)
+	tracker.Record("new", false)
+
+	if report := tracker.Top(2); len(report.Denied) != 2 {
+		t.Fatalf("expected both keys within the period but got %v", report.Denied)
+	}
+
+	// A minute after the first request its slot has left the period.
+	*now = now.Add(30 * time.Second)
+	report := tracker.Top(2)
+	if len(report.Denied) != 1 || report.Denied[0].Key != "new" {
+		t.Errorf("expected only the newer key but got %v", report.Denied)
+	}
+	if !report.Since.Equal(now.Add(-50 * time.Second)) {
+		t.Errorf("expected the report to start 50s ago but got %v", report.Since)
+	}
+
+	*now = now.Add(time.Hour)
+	if report := tracker.Top(2); len(report.Requests) != 0 {
+		t.Errorf("expected nothing after an hour but got %v", report.Requests)
+	}
+}
+
+func TestNilTracker(t *testing.T) {
+	var tracker *Tracker
+	tracker.Record("ignored", false)
+}
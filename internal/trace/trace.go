@@ -0,0 +1,149 @@
+// Package trace reads recorded traffic: timestamped requests, each with the key it is rate limited by.
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"time"
+	"unicode"
+)
+
+// Request is a single recorded request.
+type Request struct {
+	Time time.Time
+	Key  string
+}
+
+// jsonRequest is the JSONL form of a Request. The time is either an RFC 3339
+// timestamp or a number of seconds, e.g. since the Unix epoch or the start of the trace.
+type jsonRequest struct {
+	Time json.RawMessage `json:"time"`
+	Key  string          `json:"key"`
+}
+
+// ReadJSONL reads one JSON request per line, such as
+//
+//	{"time": "2026-10-18T12:00:00.250Z", "key": "192.168.1.1"}
+//	{"time": 1.5, "key": "192.168.1.2"}
+//
+// Blank lines are skipped. The requests are returned in time order.
+func ReadJSONL(r io.Reader) ([]Request, error) {
+	var requests []Request
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var raw jsonRequest
+		if err := json.Unmarshal(line, &raw); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		t, err := parseTime(raw.Time)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		requests = append(requests, Request{Time: t, Key: raw.Key})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	Sort(requests)
+	return requests, nil
+}
+
+// Sort orders requests by time, keeping the recorded order of simultaneous requests.
+func Sort(requests []Request) {
+	sort.SliceStable(requests, func(i, j int) bool {
+		return requests[i].Time.Before(requests[j].Time)
+	})
+}
+
+// parseTime parses a timestamp string or a number of seconds.
+func parseTime(raw json.RawMessage) (time.Time, error) {
+	if len(raw) == 0 {
+		return time.Time{}, fmt.Errorf("missing time")
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return time.Parse(time.RFC3339Nano, s)
+	}
+
+	var seconds float64
+	if err := json.Unmarshal(raw, &seconds); err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %s", raw)
+	}
+	whole, frac := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(frac*1e9)).UTC(), nil
+}
+
+// commonLogLine matches the host and timestamp of a Common Log Format line, e.g.
+//
+//	127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326
+var commonLogLine = regexp.MustCompile(`^(\S+) \S+ \S+ \[([^\]]+)\]`)
+
+// ReadCommonLog reads an access log in Common Log Format (or Combined Log Format,
+// which extends it), keying each request by the client host. The requests are
+// returned in time order.
+func ReadCommonLog(r io.Reader) ([]Request, error) {
+	var requests []Request
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if len(line) == 0 {
+			continue
+		}
+
+		match := commonLogLine.FindStringSubmatch(line)
+		if match == nil {
+			return nil, fmt.Errorf("line %d: not in common log format", lineNo)
+		}
+		t, err := time.Parse("02/Jan/2006:15:04:05 -0700", match[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		requests = append(requests, Request{Time: t, Key: match[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	Sort(requests)
+	return requests, nil
+}
+
+// Read reads a trace in either format, telling them apart by the first character:
+// JSONL lines start with '{'.
+func Read(r io.Reader) ([]Request, error) {
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			if err == io.EOF {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if !unicode.IsSpace(rune(b[0])) {
+			break
+		}
+		br.ReadByte()
+	}
+
+	if b, _ := br.Peek(1); b[0] == '{' {
+		return ReadJSONL(br)
+	}
+	return ReadCommonLog(br)
+}
@@ -0,0 +1,82 @@
+package trace
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadJSONL(t *testing.T) {
+	requests, err := ReadJSONL(strings.NewReader(`{"time": "2026-10-18T12:00:01Z", "key": "b"}
+{"time": "2026-10-18T12:00:00.5Z", "key": "a"}
+
+{"time": 1792324800.25, "key": "c"}
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []Request{
+		{Time: time.Date(2026, 10, 18, 12, 0, 0, 250_000_000, time.UTC), Key: "c"},
+		{Time: time.Date(2026, 10, 18, 12, 0, 0, 500_000_000, time.UTC), Key: "a"},
+		{Time: time.Date(2026, 10, 18, 12, 0, 1, 0, time.UTC), Key: "b"},
+	}
+	if len(requests) != len(expected) {
+		t.Fatalf("expected %d requests but got %d", len(expected), len(requests))
+	}
+	for i := range expected {
+		if !requests[i].Time.Equal(expected[i].Time) || requests[i].Key != expected[i].Key {
+			t.Errorf("request %d: expected %+v but got %+v", i, expected[i], requests[i])
+		}
+	}
+}
+
+func TestReadJSONLErrors(t *testing.T) {
+	for _, input := range []string{
+		`{"key": "a"}`,
+		`{"time": "yesterday", "key": "a"}`,
+		`{"time": true, "key": "a"}`,
+		`not json`,
+	} {
+		if _, err := ReadJSONL(strings.NewReader(input)); err == nil {
+			t.Errorf("expected an error reading %q", input)
+		}
+	}
+}
+
+func TestReadCommonLog(t *testing.T) {
+	requests, err := ReadCommonLog(strings.NewReader(`192.168.1.1 - frank [18/Oct/2026:13:55:36 -0700] "GET /a HTTP/1.0" 200 2326
+192.168.1.2 - - [18/Oct/2026:13:55:35 -0700] "GET /b HTTP/1.1" 429 0 "-" "curl/8.0"
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(requests) != 2 || requests[0].Key != "192.168.1.2" || requests[1].Key != "192.168.1.1" {
+		t.Fatalf("unexpected requests %+v", requests)
+	}
+	if expected := time.Date(2026, 10, 18, 20, 55, 36, 0, time.UTC); !requests[1].Time.Equal(expected) {
+		t.Errorf("expected %v but got %v", expected, requests[1].Time)
+	}
+
+	if _, err := ReadCommonLog(strings.NewReader("garbage")); err == nil {
+		t.Error("expected an error for a line not in common log format")
+	}
+}
+
+func TestReadDetectsFormat(t *testing.T) {
+	jsonl, err := Read(strings.NewReader(`
+  {"time": 0, "key": "a"}`))
+	if err != nil || len(jsonl) != 1 || jsonl[0].Key != "a" {
+		t.Errorf("expected JSONL to be detected but got %+v, %v", jsonl, err)
+	}
+
+	clf, err := Read(strings.NewReader(`10.0.0.1 - - [18/Oct/2026:13:55:36 +0000] "GET / HTTP/1.1" 200 1`))
+	if err != nil || len(clf) != 1 || clf[0].Key != "10.0.0.1" {
+		t.Errorf("expected common log format to be detected but got %+v, %v", clf, err)
+	}
+
+	if empty, err := Read(strings.NewReader("")); err != nil || len(empty) != 0 {
+		t.Errorf("expected no requests from empty input but got %+v, %v", empty, err)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nesyor/ratelimiter/internal/admin"
+)
+
+// keyState is what the admin API shows for a single IP.
+type keyState struct {
+	Water    float64   `json:"water"`
+	Capacity float64   `json:"capacity"`
+	FillRate float64   `json:"fill_rate"`
+	Credit   int       `json:"credit"`
+	Override *override `json:"override,omitempty"`
+}
+
+// override holds per-IP bucket parameters, e.g. {"capacity": 20, "fill_rate": 5}.
+type override struct {
+	Capacity float64 `json:"capacity"`
+	FillRate float64 `json:"fill_rate"`
+}
+
+// overrideFor returns the bucket parameters for ip. The caller must hold rl.mu.
+func (rl *IPRateLimiter) overrideFor(ip string) override {
+	if o, ok := rl.overrides[ip]; ok {
+		return o
+	}
+	return override{Capacity: rl.capacity, FillRate: rl.fillRate}
+}
+
+// Keys returns the IPs that have a bucket.
+func (rl *IPRateLimiter) Keys() []string {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	keys := make([]string, 0, len(rl.buckets))
+	for ip := range rl.buckets {
+		keys = append(keys, ip)
+	}
+	return keys
+}
+
+// State returns the bucket state of ip, after leaking the water due by now.
+func (rl *IPRateLimiter) State(ip string) (any, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	bucket, exists := rl.buckets[ip]
+	if !exists {
+		return nil, admin.ErrUnknownKey
+	}
+
+	bucket.LeakWater()
+	water, capacity, fillRate := bucket.snapshot()
+	state := keyState{
+		Water:    water,
+		Capacity: capacity,
+		FillRate: fillRate,
+		Credit:   rl.credits.Remaining(ip),
+	}
+	if o, ok := rl.overrides[ip]; ok {
+		state.Override = &o
+	}
+	return state, nil
+}
+
+// Reset removes ip's bucket, so its next request starts with an empty one.
+// Any credit granted to ip is cleared as well.
+func (rl *IPRateLimiter) Reset(ip string) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.credits.Clear(ip)
+	if _, exists := rl.buckets[ip]; !exists {
+		return admin.ErrUnknownKey
+	}
+	delete(rl.buckets, ip)
+	return nil
+}
+
+// Grant allows ip amount requests beyond its bucket until ttl from now.
+func (rl *IPRateLimiter) Grant(ip string, amount int, ttl time.Duration) {
+	rl.credits.Grant(ip, amount, ttl)
+}
+
+// SetOverride gives ip its own bucket capacity and fill rate.
+func (rl *IPRateLimiter) SetOverride(ip string, raw json.RawMessage) error {
+	var o override
+	if err := json.Unmarshal(raw, &o); err != nil {
+		return err
+	}
+	if o.Capacity <= 0 || o.FillRate <= 0 {
+		return fmt.Errorf("override needs a positive capacity and fill_rate")
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.overrides[ip] = o
+	rl.configure(ip, o)
+	return nil
+}
+
+// ClearOverride returns ip to the default bucket parameters.
+func (rl *IPRateLimiter) ClearOverride(ip string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	delete(rl.overrides, ip)
+	rl.configure(ip, rl.overrideFor(ip))
+}
+
+// configure applies bucket parameters to ip's existing bucket, if any. The caller must hold rl.mu.
+func (rl *IPRateLimiter) configure(ip string, o override) {
+	bucket, exists := rl.buckets[ip]
+	if !exists {
+		return
+	}
+
+	// Leak at the old rate up to now before switching to the new one.
+	bucket.LeakWater()
+
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+
+	bucket.Capacity = o.Capacity
+	bucket.FillRate = o.FillRate
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestIPRateLimiterAdmin(t *testing.T) {
+	limiter := NewIPRateLimiter(1, 1)
+	ip := "192.168.1.1"
+
+	if _, err := limiter.State(ip); err == nil {
+		t.Fatal("expected an error for an untracked IP")
+	}
+
+	limiter.AllowRequest(ip)
+	if limiter.AllowRequest(ip) {
+		t.Fatal("expected request to be denied once the bucket is full")
+	}
+	state, _ := limiter.State(ip)
+	if s := state.(keyState); s.Water < 0.9 || s.Capacity != 1 {
+		t.Fatalf("unexpected state %+v", s)
+	}
+
+	// Credit covers requests the bucket would deny.
+	limiter.Grant(ip, 1, time.Minute)
+	if !limiter.AllowRequest(ip) || limiter.AllowRequest(ip) {
+		t.Fatal("expected exactly one request to be covered by credit")
+	}
+
+	// Overrides apply to the existing bucket.
+	if err := limiter.SetOverride(ip, json.RawMessage(`{"capacity": 3, "fill_rate": 1}`)); err != nil {
+		t.Fatalf("unexpected error setting override: %v", err)
+	}
+	if !limiter.AllowRequest(ip) || !limiter.AllowRequest(ip) {
+		t.Fatal("expected the larger capacity to allow two more requests")
+	}
+	if err := limiter.SetOverride(ip, json.RawMessage(`{"capacity": 3}`)); err == nil {
+		t.Fatal("expected an override without fill_rate to be rejected")
+	}
+	limiter.ClearOverride(ip)
+
+	// Reset starts over with an empty bucket and no credit.
+	limiter.Grant(ip, 5, time.Minute)
+	if err := limiter.Reset(ip); err != nil {
+		t.Fatalf("unexpected error resetting: %v", err)
+	}
+	if credit := limiter.credits.Remaining(ip); credit != 0 {
+		t.Fatalf("expected reset to clear credit but %d is left", credit)
+	}
+	if len(limiter.Keys()) != 0 || !limiter.AllowRequest(ip) {
+		t.Fatal("expected an empty bucket after reset")
+	}
+}
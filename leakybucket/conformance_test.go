@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nesyor/ratelimiter/internal/conformance"
+)
+
+// ipLimiter adapts IPRateLimiter to the suite's Limiter interface.
+type ipLimiter struct {
+	*IPRateLimiter
+}
+
+func (l ipLimiter) Allow(key string) bool {
+	return l.AllowRequest(key)
+}
+
+// Test the rate limiter against the conformance suite. A leaky bucket used as a meter
+// is a token bucket counting the room left instead of the water in it.
+func TestIPRateLimiterConformance(t *testing.T) {
+	spec := conformance.Spec{Burst: 5, Rate: 2, Model: conformance.TokenBucket(2, 5)}
+	conformance.Run(t, spec, func(clock *conformance.Clock) conformance.Limiter {
+		rl := NewIPRateLimiter(5, 2)
+		rl.now = clock.Now
+		return ipLimiter{rl}
+	})
+}
@@ -4,15 +4,19 @@ import (
 	"fmt"
 	"sync"
 	"time"
+
+	"github.com/nesyor/ratelimiter/internal/admin"
+	"github.com/nesyor/ratelimiter/internal/audit"
 )
 
 // LeakyBucket represents the structure of a rate limiter using the leaky bucket algorithm.
 type LeakyBucket struct {
-	Capacity    float64    // Maximum amount of water (requests) the bucket can hold.
-	FillRate    float64    // Rate at which the water leaks out of the bucket.
-	Water       float64    // Current amount of water in the bucket.
-	lastChecked time.Time  // Last time we checked or updated the bucket.
-	mu          sync.Mutex // Mutex to ensure concurrent access to the bucket is safe.
+	Capacity    float64          // Maximum amount of water (requests) the bucket can hold.
+	FillRate    float64          // Rate at which the water leaks out of the bucket.
+	Water       float64          // Current amount of water in the bucket.
+	lastChecked time.Time        // Time up to which water has leaked out.
+	now         func() time.Time // Clock, replaceable in tests.
+	mu          sync.Mutex       // Mutex to ensure concurrent access to the bucket is safe.
 }
 
 // NewLeakyBucket creates and initializes a new leaky bucket with the specified capacity and fill rate.
@@ -21,6 +25,7 @@ func NewLeakyBucket(capacity, fillRate float64) *LeakyBucket {
 		Capacity:    capacity,
 		FillRate:    fillRate,
 		lastChecked: time.Now(),
+		now:         time.Now,
 	}
 }
 
@@ -29,16 +34,7 @@ func (b *LeakyBucket) AddWater(amount float64) bool {
 	b.mu.Lock()         // Lock to ensure safe concurrent access.
 	defer b.mu.Unlock() // Unlock once we're done.
 
-	now := time.Now() // Get the current time.
-
-	// Calculate how much time has passed since the last check and how much water has leaked out in that time.
-	elapsed := now.Sub(b.lastChecked).Seconds()
-	leakage := elapsed * b.FillRate
-
-	b.Water -= leakage // Reduce the water in the bucket by the leaked amount.
-	if b.Water < 0 {
-		b.Water = 0
-	}
+	b.leak(b.now())
 
 	// Check if there's enough space to add the new water.
 	if b.Water+amount > b.Capacity {
@@ -46,40 +42,61 @@ func (b *LeakyBucket) AddWater(amount float64) bool {
 	}
 
 	b.Water += amount
-	b.lastChecked = now
 	return true
 }
 
+// LeakWater lets out the water that has leaked since the bucket was last updated.
+func (b *LeakyBucket) LeakWater() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.leak(b.now())
+}
+
+// leak lets out the water that leaked between lastChecked and now, and moves
+// lastChecked to now so that the same interval is never leaked twice, whether or not
+// water is added afterwards. If the clock went back, nothing leaks, and leaking
+// carries on from now. The caller must hold b.mu.
+func (b *LeakyBucket) leak(now time.Time) {
+	if elapsed := now.Sub(b.lastChecked).Seconds(); elapsed > 0 {
+		b.Water = max(b.Water-elapsed*b.FillRate, 0)
+	}
+	b.lastChecked = now
+}
+
 // IPRateLimiter is a structure to rate limit requests based on IP addresses using leaky buckets.
 type IPRateLimiter struct {
-	buckets map[string]*LeakyBucket // Map of IP addresses to their respective leaky buckets.
-	mu      sync.Mutex              // Mutex to ensure concurrent access to the map is safe.
+	audit.Sink    // Optional log of decisions, see SetAuditHandler.
+	admin.TopKeys // Optional tracker of the busiest keys, see SetTopK.
+
+	capacity  float64                 // Capacity of each IP's bucket.
+	fillRate  float64                 // Leak rate of each IP's bucket.
+	buckets   map[string]*LeakyBucket // Map of IP addresses to their respective leaky buckets.
+	overrides map[string]override     // Per-IP bucket parameters set through the admin API.
+	credits   admin.Credits           // Extra requests granted through the admin API.
+	now       func() time.Time        // Clock of the buckets the limiter creates.
+	mu        sync.Mutex              // Mutex to ensure concurrent access to the map is safe.
 }
 
 // NewIPRateLimiter initializes a new IP-based rate limiter.
 func NewIPRateLimiter(capacity, fillRate float64) *IPRateLimiter {
 	return &IPRateLimiter{
-		buckets: make(map[string]*LeakyBucket),
+		capacity:  capacity,
+		fillRate:  fillRate,
+		buckets:   make(map[string]*LeakyBucket),
+		overrides: make(map[string]override),
+		now:       time.Now,
 	}
 }
 
-func (b *LeakyBucket) LeakWater() {
+// snapshot returns the current amount of water in the bucket along with its parameters.
+func (b *LeakyBucket) snapshot() (water, capacity, fillRate float64) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	now := time.Now()
-	elapsed := now.Sub(b.lastChecked).Seconds()
-	leakage := elapsed * b.FillRate
-
-	b.Water -= leakage
-	if b.Water < 0 {
-		b.Water = 0
-	}
-
-	b.lastChecked = now
+	return b.Water, b.Capacity, b.FillRate
 }
 
-
 // AllowRequest checks if a request from a given IP is allowed. If the IP doesn't have a bucket, one is created.
 func (rl *IPRateLimiter) AllowRequest(ip string) bool {
 	rl.mu.Lock() // Lock to ensure safe concurrent access.
@@ -87,13 +104,39 @@ func (rl *IPRateLimiter) AllowRequest(ip string) bool {
 	// Fetch the bucket for this IP or create a new one if it doesn't exist.
 	bucket, exists := rl.buckets[ip]
 	if !exists {
-		bucket = NewLeakyBucket(5, 1)
+		o := rl.overrideFor(ip)
+		bucket = NewLeakyBucket(o.Capacity, o.FillRate)
+		bucket.now = rl.now
+		bucket.lastChecked = rl.now()
 		rl.buckets[ip] = bucket
 	}
 
 	rl.mu.Unlock() // Unlock once we've fetched the bucket.
 
-	return bucket.AddWater(1)
+	allowed := bucket.AddWater(1)
+	if !allowed && rl.credits.Take(ip) {
+		// Credit granted through the admin API covers the request.
+		allowed = true
+	}
+	rl.RecordTop(ip, allowed)
+
+	if auditLog := rl.AuditLogger(); auditLog != nil {
+		water, capacity, fillRate := bucket.snapshot()
+		record := audit.Record{
+			Key:       ip,
+			Rule:      fmt.Sprintf("%g/%g per second", capacity, fillRate),
+			Algorithm: "leakybucket",
+			Allowed:   allowed,
+			Remaining: max(capacity-water, 0),
+			Cost:      1,
+		}
+		if !allowed {
+			// Enough water has to leak out to make room for the request.
+			record.RetryAfter = time.Duration((water + 1 - capacity) / fillRate * float64(time.Second))
+		}
+		auditLog.Log(record)
+	}
+	return allowed
 }
 
 func main() {
@@ -1,13 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/nesyor/ratelimiter/internal/conformance"
 )
 
+// newTestBucket creates a bucket that takes the time from clock.
+func newTestBucket(capacity, fillRate float64, clock *conformance.Clock) *LeakyBucket {
+	bucket := NewLeakyBucket(capacity, fillRate)
+	bucket.now = clock.Now
+	bucket.lastChecked = clock.Now()
+	return bucket
+}
+
 func TestLeakyBucket(t *testing.T) {
-	bucket := NewLeakyBucket(5, 1)
+	clock := conformance.NewClock()
+	bucket := newTestBucket(5, 1, clock)
 
 	// Initially, the bucket should be empty
 	if bucket.Water != 0 {
@@ -25,13 +39,87 @@ func TestLeakyBucket(t *testing.T) {
 	}
 
 	// After 3 seconds, 3 units of water should have leaked out
-	time.Sleep(3 * time.Second)
+	clock.Advance(3 * time.Second)
 	bucket.LeakWater()
 	if bucket.Water != 0 {
 		t.Fatalf("expected water to be 0 after 3 seconds but got %f", bucket.Water)
 	}
 }
 
+// Test that rejected requests do not make the bucket leak the same time twice
+func TestLeakyBucketRejectionLeaksOnce(t *testing.T) {
+	clock := conformance.NewClock()
+	bucket := newTestBucket(5, 1, clock)
+
+	if !bucket.AddWater(5) {
+		t.Fatal("expected to be able to fill the bucket")
+	}
+
+	// Half a unit leaks out, which is not enough room for a whole one...
+	clock.Advance(500 * time.Millisecond)
+	if bucket.AddWater(1) {
+		t.Fatal("expected a request to be denied with half a unit of room")
+	}
+	// ...and asking again without time passing must not leak that half unit again.
+	if bucket.AddWater(1) {
+		t.Fatal("expected a repeated request to be denied without time passing")
+	}
+	if bucket.Water != 4.5 {
+		t.Fatalf("expected 4.5 units of water but got %g", bucket.Water)
+	}
+
+	// Leaking by hand does not leak the same time twice either.
+	bucket.LeakWater()
+	bucket.LeakWater()
+	if bucket.Water != 4.5 {
+		t.Fatalf("expected 4.5 units of water after leaking without time passing but got %g", bucket.Water)
+	}
+}
+
+// Test that the clock going back neither adds water nor stops the leak
+func TestLeakyBucketClockGoesBack(t *testing.T) {
+	clock := conformance.NewClock()
+	bucket := newTestBucket(5, 1, clock)
+
+	if !bucket.AddWater(5) {
+		t.Fatal("expected to be able to fill the bucket")
+	}
+	clock.Advance(-time.Hour)
+	bucket.LeakWater()
+	if bucket.Water != 5 {
+		t.Fatalf("expected 5 units of water after the clock went back but got %g", bucket.Water)
+	}
+
+	// Leaking carries on from the new time rather than from an hour later.
+	clock.Advance(time.Second)
+	if !bucket.AddWater(1) {
+		t.Fatal("expected room for a request a second after the clock went back")
+	}
+}
+
+// Test that under sustained overload requests get through at exactly the fill rate
+func TestLeakyBucketSustainedOverload(t *testing.T) {
+	for _, fillRate := range []float64{1, 2, 3, 10} {
+		clock := conformance.NewClock()
+		bucket := newTestBucket(5, fillRate, clock)
+
+		// Ask a hundred times a second for a minute after filling the bucket.
+		for bucket.AddWater(1) {
+		}
+		allowed := 0
+		for i := 0; i < 6000; i++ {
+			clock.Advance(10 * time.Millisecond)
+			if bucket.AddWater(1) {
+				allowed++
+			}
+		}
+
+		if expected := int(60 * fillRate); allowed < expected-1 || allowed > expected {
+			t.Errorf("expected %d requests in a minute at a fill rate of %g but got %d", expected, fillRate, allowed)
+		}
+	}
+}
+
 func TestIPRateLimiter(t *testing.T) {
 	limiter := NewIPRateLimiter(5, 1)
 	ip := "192.168.1.1"
@@ -83,3 +171,25 @@ func TestMultipleIPs(t *testing.T) {
 		t.Fatal("expected request to be denied after capacity exceeded for both IPs")
 	}
 }
+
+func TestIPRateLimiterAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	limiter := NewIPRateLimiter(1, 1)
+	limiter.SetAuditHandler(slog.NewJSONHandler(&buf, nil), 0)
+
+	ip := "192.168.1.1"
+	limiter.AllowRequest(ip)
+	limiter.AllowRequest(ip)
+
+	// Only the denial is logged with a sample rate of 0
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("expected a single JSON audit record but got %q", buf.String())
+	}
+	if record["decision"] != "deny" || record["key"] != ip || record["algorithm"] != "leakybucket" {
+		t.Fatalf("unexpected audit record %v", record)
+	}
+	if retryAfter := record["retry_after"].(float64); retryAfter <= 0 || retryAfter > float64(time.Second) {
+		t.Fatalf("expected retry_after of up to one second but got %v", retryAfter)
+	}
+}
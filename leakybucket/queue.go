@@ -0,0 +1,252 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/nesyor/ratelimiter/internal/audit"
+)
+
+// OverflowPolicy decides which request is dropped when a LeakyQueue is full.
+type OverflowPolicy int
+
+const (
+	// DropTail rejects the newly submitted request and keeps the queue as it is.
+	DropTail OverflowPolicy = iota
+	// DropHead evicts the oldest waiting request to make room for the new one.
+	DropHead
+)
+
+var (
+	// ErrQueueFull is returned by Submit when the queue is full and the policy is DropTail.
+	ErrQueueFull = errors.New("leakybucket: queue full")
+	// ErrDropped is returned to a waiting request that was evicted by a DropHead overflow.
+	ErrDropped = errors.New("leakybucket: dropped from queue head")
+	// ErrMaxWait is returned when a request waited longer than the queue's MaxWait.
+	ErrMaxWait = errors.New("leakybucket: max queue wait exceeded")
+	// ErrQueueClosed is returned when the queue is closed while a request is waiting.
+	ErrQueueClosed = errors.New("leakybucket: queue closed")
+)
+
+// LeakyQueue is a leaky bucket used as a queue rather than as a meter. Submitted
+// requests wait in a bounded FIFO and are released one at a time at exactly
+// FillRate requests per second, smoothing bursts into a constant output rate.
+type LeakyQueue struct {
+	audit.Sink // Optional log of decisions, see SetAuditHandler.
+
+	Capacity int            // Maximum number of requests that may wait in the queue.
+	FillRate float64        // Number of requests released from the queue per second.
+	Policy   OverflowPolicy // What to drop when a request arrives at a full queue.
+	MaxWait  time.Duration  // Longest a request may wait before giving up; zero means no limit.
+
+	interval    time.Duration // Time between two releases, 1/FillRate seconds.
+	waiting     *list.List    // FIFO of *queuedRequest waiting to be released.
+	lastRelease time.Time     // Time the most recent request left the queue.
+	wake        chan struct{} // Signals the release loop that the queue is no longer empty.
+	done        chan struct{} // Closed by Close to stop the release loop.
+	closed      bool
+	now         func() time.Time                                      // Clock releases are scheduled by.
+	timer       func(d time.Duration) (<-chan time.Time, func() bool) // Starts a timer, returning its channel and stop function.
+	mu          sync.Mutex                                            // Mutex to ensure concurrent access to the queue is safe.
+}
+
+// queuedRequest is a single request waiting in a LeakyQueue.
+type queuedRequest struct {
+	result chan error    // Receives nil when released or the reason the request was dropped.
+	elem   *list.Element // Position in the queue; nil once the request has left it.
+}
+
+// NewLeakyQueue creates a queue holding up to capacity requests and releasing them at fillRate per second.
+// The capacity must be positive. The queue runs a background goroutine until Close is called.
+func NewLeakyQueue(capacity int, fillRate float64, policy OverflowPolicy, maxWait time.Duration) (*LeakyQueue, error) {
+	return newLeakyQueue(capacity, fillRate, policy, maxWait, time.Now, func(d time.Duration) (<-chan time.Time, func() bool) {
+		timer := time.NewTimer(d)
+		return timer.C, timer.Stop
+	})
+}
+
+// newLeakyQueue creates a queue that schedules its releases by now and waits for them,
+// and for MaxWait, with timer.
+func newLeakyQueue(capacity int, fillRate float64, policy OverflowPolicy, maxWait time.Duration,
+	now func() time.Time, timer func(time.Duration) (<-chan time.Time, func() bool)) (*LeakyQueue, error) {
+	if capacity <= 0 {
+		return nil, fmt.Errorf("leakybucket: queue capacity must be positive, got %d", capacity)
+	}
+	// The interval between releases has to be a positive duration that fits in an int64.
+	if !(fillRate > 0) || float64(time.Second)/fillRate >= math.MaxInt64 {
+		return nil, fmt.Errorf("leakybucket: fill rate must be positive and at least %g per second, got %g", float64(time.Second)/math.MaxInt64, fillRate)
+	}
+
+	q := &LeakyQueue{
+		Capacity: capacity,
+		FillRate: fillRate,
+		Policy:   policy,
+		MaxWait:  maxWait,
+		interval: max(time.Duration(float64(time.Second)/fillRate), 1),
+		waiting:  list.New(),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		now:      now,
+		timer:    timer,
+	}
+	go q.run()
+	return q, nil
+}
+
+// Submit enqueues a request and blocks until it is released by the leak, dropped,
+// the context is cancelled or MaxWait elapses. A nil error means the caller may proceed.
+// The queue is shared by all callers, so its audit records carry no key.
+func (q *LeakyQueue) Submit(ctx context.Context) error {
+	err := q.submit(ctx)
+
+	if logger := q.AuditLogger(); logger != nil {
+		record := audit.Record{
+			Rule:      fmt.Sprintf("queue of %d at %g per second", q.Capacity, q.FillRate),
+			Algorithm: "leakyqueue",
+			Allowed:   err == nil,
+			Remaining: float64(max(q.Capacity-q.Len(), 0)),
+			Cost:      1,
+		}
+		if errors.Is(err, ErrQueueFull) {
+			// A place in the queue opens up with the next release.
+			record.RetryAfter = q.interval
+		}
+		logger.Log(record)
+	}
+	return err
+}
+
+// submit does the work of Submit.
+func (q *LeakyQueue) submit(ctx context.Context) error {
+	req := &queuedRequest{result: make(chan error, 1)}
+
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return ErrQueueClosed
+	}
+	if q.waiting.Len() >= q.Capacity {
+		if q.Policy == DropTail {
+			q.mu.Unlock()
+			return ErrQueueFull
+		}
+		// Drop the oldest waiting request to make room for this one.
+		head := q.waiting.Remove(q.waiting.Front()).(*queuedRequest)
+		head.elem = nil
+		head.result <- ErrDropped
+	}
+	req.elem = q.waiting.PushBack(req)
+	q.mu.Unlock()
+
+	// Let the release loop know there is work to do.
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	var timeout <-chan time.Time
+	if q.MaxWait > 0 {
+		fired, stop := q.timer(q.MaxWait)
+		defer stop()
+		timeout = fired
+	}
+
+	select {
+	case err := <-req.result:
+		return err
+	case <-ctx.Done():
+		return q.abandon(req, ctx.Err())
+	case <-timeout:
+		return q.abandon(req, ErrMaxWait)
+	}
+}
+
+// abandon removes a request that stopped waiting. If the request already left the
+// queue in the meantime, its outcome wins over the abandon reason.
+func (q *LeakyQueue) abandon(req *queuedRequest, reason error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if req.elem == nil {
+		return <-req.result
+	}
+	q.waiting.Remove(req.elem)
+	req.elem = nil
+	return reason
+}
+
+// Len returns the number of requests currently waiting in the queue.
+func (q *LeakyQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.waiting.Len()
+}
+
+// Close stops the queue and fails every waiting request with ErrQueueClosed.
+func (q *LeakyQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+	close(q.done)
+
+	for e := q.waiting.Front(); e != nil; e = q.waiting.Front() {
+		req := q.waiting.Remove(e).(*queuedRequest)
+		req.elem = nil
+		req.result <- ErrQueueClosed
+	}
+}
+
+// run is the leak: it releases the head of the queue once every 1/FillRate seconds.
+func (q *LeakyQueue) run() {
+	for {
+		// Wait until there is something to release.
+		if q.Len() == 0 {
+			select {
+			case <-q.wake:
+				continue
+			case <-q.done:
+				return
+			}
+		}
+
+		now := q.now()
+		if q.lastRelease.After(now) {
+			// The clock went back, e.g. after an NTP correction. Wait one interval from
+			// now rather than until the clock catches up again.
+			q.lastRelease = now
+		}
+
+		// The next release happens one interval after the previous one, but never in the past.
+		next := q.lastRelease.Add(q.interval)
+		if wait := next.Sub(now); wait > 0 {
+			fired, stop := q.timer(wait)
+			select {
+			case <-fired:
+			case <-q.done:
+				stop()
+				return
+			}
+		} else {
+			next = now
+		}
+
+		q.mu.Lock()
+		if front := q.waiting.Front(); front != nil {
+			req := q.waiting.Remove(front).(*queuedRequest)
+			req.elem = nil
+			req.result <- nil
+			q.lastRelease = next
+		}
+		q.mu.Unlock()
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nesyor/ratelimiter/internal/conformance"
+)
+
+// fakeTimer is a timer started by fakeTimers. It fires when the test sends on fire.
+type fakeTimer struct {
+	d    time.Duration
+	fire chan time.Time
+}
+
+// fakeTimers starts timers that fire only when the test says so, reporting each one
+// on started.
+type fakeTimers struct {
+	started chan *fakeTimer
+}
+
+func newFakeTimers() *fakeTimers {
+	return &fakeTimers{started: make(chan *fakeTimer, 100)}
+}
+
+func (f *fakeTimers) timer(d time.Duration) (<-chan time.Time, func() bool) {
+	// Buffered, so firing a timer nobody waits for any more does not block the test.
+	t := &fakeTimer{d: d, fire: make(chan time.Time, 1)}
+	f.started <- t
+	return t.fire, func() bool { return true }
+}
+
+// newFakeLeakyQueue creates a queue driven by a fake clock and fake timers.
+func newFakeLeakyQueue(t *testing.T, capacity int, fillRate float64, policy OverflowPolicy, maxWait time.Duration) (*LeakyQueue, *conformance.Clock, *fakeTimers) {
+	t.Helper()
+	clock := conformance.NewClock()
+	timers := newFakeTimers()
+	queue, err := newLeakyQueue(capacity, fillRate, policy, maxWait, clock.Now, timers.timer)
+	if err != nil {
+		t.Fatalf("failed to create queue: %v", err)
+	}
+	return queue, clock, timers
+}
+
+// mustNewLeakyQueue creates a queue or fails the test.
+func mustNewLeakyQueue(t *testing.T, capacity int, fillRate float64, policy OverflowPolicy, maxWait time.Duration) *LeakyQueue {
+	t.Helper()
+	queue, err := NewLeakyQueue(capacity, fillRate, policy, maxWait)
+	if err != nil {
+		t.Fatalf("failed to create queue: %v", err)
+	}
+	return queue
+}
+
+func TestLeakyQueueReleasesAtFillRate(t *testing.T) {
+	queue, clock, timers := newFakeLeakyQueue(t, 10, 20, DropTail, 0) // One release every 50ms.
+	defer queue.Close()
+
+	// The first request leaves immediately...
+	if err := queue.Submit(context.Background()); err != nil {
+		t.Fatalf("expected first request to be released but got %v", err)
+	}
+
+	const requests = 5
+	released := make(chan time.Time, requests)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := queue.Submit(context.Background()); err != nil {
+				t.Errorf("expected request to be released but got %v", err)
+				return
+			}
+			released <- clock.Now()
+		}()
+	}
+	waitForLen(t, queue, requests)
+
+	// ...and the rest are spaced exactly one interval apart. The second timer fires
+	// 10ms late, so the release after it waits 10ms less to keep to the schedule.
+	for i := 0; i < requests; i++ {
+		expected, late := 50*time.Millisecond, time.Duration(0)
+		switch i {
+		case 1:
+			late = 10 * time.Millisecond
+		case 2:
+			expected -= 10 * time.Millisecond
+		}
+		timer := <-timers.started
+		if timer.d != expected {
+			t.Fatalf("expected release %d to wait %v but it waited %v", i+2, expected, timer.d)
+		}
+		clock.Advance(expected + late)
+		timer.fire <- clock.Now()
+		<-released
+	}
+	wg.Wait()
+
+	select {
+	case timer := <-timers.started:
+		t.Fatalf("expected no more timers once the queue is empty but one was started for %v", timer.d)
+	default:
+	}
+}
+
+func TestLeakyQueueClockGoesBack(t *testing.T) {
+	queue, clock, timers := newFakeLeakyQueue(t, 10, 20, DropTail, 0) // One release every 50ms.
+	defer queue.Close()
+
+	if err := queue.Submit(context.Background()); err != nil {
+		t.Fatalf("expected first request to be released but got %v", err)
+	}
+
+	// After the clock goes back an hour the next release is one interval away, not an
+	// hour and an interval.
+	clock.Advance(-time.Hour)
+	released := make(chan error, 1)
+	go func() { released <- queue.Submit(context.Background()) }()
+	timer := <-timers.started
+	if timer.d != 50*time.Millisecond {
+		t.Fatalf("expected the release to wait 50ms but it waited %v", timer.d)
+	}
+	clock.Advance(50 * time.Millisecond)
+	timer.fire <- clock.Now()
+	if err := <-released; err != nil {
+		t.Fatalf("expected request to be released but got %v", err)
+	}
+}
+
+func TestNewLeakyQueueRejectsInvalidFillRate(t *testing.T) {
+	for _, fillRate := range []float64{0, -1, math.NaN(), 1e-12} {
+		if _, err := NewLeakyQueue(10, fillRate, DropTail, 0); err == nil {
+			t.Errorf("expected an error for a fill rate of %g", fillRate)
+		}
+	}
+}
+
+func TestNewLeakyQueueRejectsInvalidCapacity(t *testing.T) {
+	for _, capacity := range []int{0, -1} {
+		if _, err := NewLeakyQueue(capacity, 1, DropTail, 0); err == nil {
+			t.Errorf("expected an error for a capacity of %d", capacity)
+		}
+	}
+}
+
+func TestLeakyQueueIsFIFO(t *testing.T) {
+	queue, clock, timers := newFakeLeakyQueue(t, 10, 50, DropTail, 0)
+	defer queue.Close()
+
+	// The first request leaves immediately, the rest queue up in order.
+	if err := queue.Submit(context.Background()); err != nil {
+		t.Fatalf("expected first request to be released but got %v", err)
+	}
+	order := make(chan int, 5)
+	for i := 0; i < 5; i++ {
+		go func(i int) {
+			if err := queue.Submit(context.Background()); err == nil {
+				order <- i
+			}
+		}(i)
+		// Make sure each request is enqueued before the next one.
+		waitForLen(t, queue, i+1)
+	}
+
+	for expected := 0; expected < 5; expected++ {
+		timer := <-timers.started
+		clock.Advance(timer.d)
+		timer.fire <- clock.Now()
+		if i := <-order; i != expected {
+			t.Fatalf("expected request %d to be released next but got %d", expected, i)
+		}
+	}
+}
+
+func TestLeakyQueueDropTail(t *testing.T) {
+	queue := mustNewLeakyQueue(t, 2, 1, DropTail, 0)
+	defer queue.Close()
+
+	// The first request is released right away, the next two fill the queue.
+	if err := queue.Submit(context.Background()); err != nil {
+		t.Fatalf("expected first request to be released but got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		go queue.Submit(context.Background())
+	}
+	waitForLen(t, queue, 2)
+
+	if err := queue.Submit(context.Background()); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected ErrQueueFull but got %v", err)
+	}
+}
+
+func TestLeakyQueueDropHead(t *testing.T) {
+	queue := mustNewLeakyQueue(t, 1, 1, DropHead, 0)
+	defer queue.Close()
+
+	if err := queue.Submit(context.Background()); err != nil {
+		t.Fatalf("expected first request to be released but got %v", err)
+	}
+
+	head := make(chan error, 1)
+	go func() { head <- queue.Submit(context.Background()) }()
+	waitForLen(t, queue, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queue.Submit(ctx)
+
+	if err := <-head; !errors.Is(err, ErrDropped) {
+		t.Fatalf("expected head of queue to be dropped but got %v", err)
+	}
+}
+
+func TestLeakyQueueMaxWait(t *testing.T) {
+	queue, clock, timers := newFakeLeakyQueue(t, 5, 1, DropTail, 50*time.Millisecond)
+	defer queue.Close()
+
+	if err := queue.Submit(context.Background()); err != nil {
+		t.Fatalf("expected first request to be released but got %v", err)
+	}
+	// Forget the first request's MaxWait timer.
+	<-timers.started
+	result := make(chan error, 1)
+	go func() { result <- queue.Submit(context.Background()) }()
+
+	// The request's MaxWait timer and the next release's timer start in either order.
+	var maxWait *fakeTimer
+	for maxWait == nil {
+		if timer := <-timers.started; timer.d == 50*time.Millisecond {
+			maxWait = timer
+		}
+	}
+	clock.Advance(50 * time.Millisecond)
+	maxWait.fire <- clock.Now()
+
+	if err := <-result; !errors.Is(err, ErrMaxWait) {
+		t.Fatalf("expected ErrMaxWait but got %v", err)
+	}
+	if n := queue.Len(); n != 0 {
+		t.Fatalf("expected timed out request to leave the queue but %d are waiting", n)
+	}
+}
+
+func TestLeakyQueueContextCancel(t *testing.T) {
+	queue := mustNewLeakyQueue(t, 5, 1, DropTail, 0)
+	defer queue.Close()
+
+	if err := queue.Submit(context.Background()); err != nil {
+		t.Fatalf("expected first request to be released but got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := queue.Submit(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context deadline error but got %v", err)
+	}
+}
+
+func TestLeakyQueueClose(t *testing.T) {
+	queue := mustNewLeakyQueue(t, 5, 1, DropTail, 0)
+	queue.Submit(context.Background())
+
+	result := make(chan error, 1)
+	go func() { result <- queue.Submit(context.Background()) }()
+	waitForLen(t, queue, 1)
+
+	queue.Close()
+	if err := <-result; !errors.Is(err, ErrQueueClosed) {
+		t.Fatalf("expected ErrQueueClosed but got %v", err)
+	}
+	if err := queue.Submit(context.Background()); !errors.Is(err, ErrQueueClosed) {
+		t.Fatalf("expected ErrQueueClosed after close but got %v", err)
+	}
+}
+
+// waitForLen waits until the queue holds n requests.
+func waitForLen(t *testing.T, queue *LeakyQueue, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for queue.Len() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d waiting requests but got %d", n, queue.Len())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLeakyQueueAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	queue := mustNewLeakyQueue(t, 1, 1, DropTail, 0)
+	defer queue.Close()
+
+	// One request is released and one waits, filling the queue.
+	queue.Submit(context.Background())
+	go queue.Submit(context.Background())
+	waitForLen(t, queue, 1)
+	queue.SetAuditHandler(slog.NewJSONHandler(&buf, nil), 0)
+
+	// Without room to wait, the request is dropped and only the denial is logged.
+	if err := queue.Submit(context.Background()); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected ErrQueueFull but got %v", err)
+	}
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("expected a single JSON audit record but got %q", buf.String())
+	}
+	if record["decision"] != "deny" || record["algorithm"] != "leakyqueue" || record["retry_after"] != float64(time.Second) {
+		t.Fatalf("unexpected audit record %v", record)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Admin(t *testing.T) {
+	rl := NewRateLimiter(1, time.Second)
+	ip := "192.168.1.1"
+
+	if _, err := rl.State(ip); err == nil {
+		t.Fatal("Expected an error for an untracked IP")
+	}
+
+	rl.Allow(ip)
+	if rl.Allow(ip) {
+		t.Fatal("Expected request to be denied after the limit")
+	}
+	state, _ := rl.State(ip)
+	if s := state.(keyState); s.LogLength != 1 || s.Limit != 1 {
+		t.Fatalf("Unexpected state %+v", s)
+	}
+
+	// Credit covers requests the log would deny
+	rl.Grant(ip, 1, time.Minute)
+	if !rl.Allow(ip) || rl.Allow(ip) {
+		t.Fatal("Expected exactly one request to be covered by credit")
+	}
+
+	// Overrides raise the limit
+	if err := rl.SetOverride(ip, json.RawMessage(`{"limit": 3}`)); err != nil {
+		t.Fatalf("Unexpected error setting override: %v", err)
+	}
+	if !rl.Allow(ip) || !rl.Allow(ip) || rl.Allow(ip) {
+		t.Fatal("Expected the override to allow two more requests")
+	}
+	if err := rl.SetOverride(ip, json.RawMessage(`{"limit": 0}`)); err == nil {
+		t.Fatal("Expected a zero limit to be rejected")
+	}
+	rl.ClearOverride(ip)
+
+	// Reset forgets the log and credit
+	rl.Grant(ip, 5, time.Minute)
+	if err := rl.Reset(ip); err != nil {
+		t.Fatalf("Unexpected error resetting: %v", err)
+	}
+	if credit := rl.credits.Remaining(ip); credit != 0 {
+		t.Fatalf("Expected reset to clear credit but %d is left", credit)
+	}
+	if len(rl.Keys()) != 0 || !rl.Allow(ip) {
+		t.Fatal("Expected an empty log after reset")
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nesyor/ratelimiter/internal/conformance"
+)
+
+func TestRateLimiterConformance(t *testing.T) {
+	spec := conformance.Spec{Burst: 5, Rate: 5, Model: conformance.SlidingLog(5, time.Second)}
+	conformance.Run(t, spec, func(clock *conformance.Clock) conformance.Limiter {
+		rl := NewRateLimiter(5, time.Second)
+		rl.now = clock.Now
+		return rl
+	})
+}
@@ -1,31 +1,85 @@
 package main
 
 import (
+	"fmt"
+	"math"
 	"net/http"
+	"os"
+	"strconv"
 	"sync"
 	"time"
+
+	"github.com/nesyor/ratelimiter/internal/admin"
+	"github.com/nesyor/ratelimiter/internal/audit"
+	"github.com/nesyor/ratelimiter/internal/keys"
+	"github.com/nesyor/ratelimiter/internal/topk"
 )
 
 type RateLimiter struct {
-	rate   int
-	window time.Duration
-	logs   map[string][]time.Time
-	mu     sync.RWMutex
+	audit.Sink    // Optional log of decisions, see SetAuditHandler.
+	admin.TopKeys // Optional tracker of the busiest keys, see SetTopK.
+
+	rate      int
+	window    time.Duration
+	logs      map[string][]time.Time
+	overrides map[string]int // Per-key rates set through the admin API.
+	credits   admin.Credits  // Extra requests granted through the admin API.
+	now       func() time.Time
+	mu        sync.RWMutex
 }
 
 func NewRateLimiter(rate int, window time.Duration) *RateLimiter {
 	return &RateLimiter{
-		rate:   rate,
-		window: window,
-		logs:   make(map[string][]time.Time),
+		rate:      rate,
+		window:    window,
+		logs:      make(map[string][]time.Time),
+		overrides: make(map[string]int),
+		now:       time.Now,
 	}
 }
 
 func (rl *RateLimiter) Allow(ip string) bool {
+	logger := rl.AuditLogger()
+	allowed, record := rl.decide(ip, logger != nil)
+	if record != nil {
+		// Logged after rl.mu is released, since the handler may do I/O.
+		logger.Log(*record)
+	}
+	return allowed
+}
+
+// decide makes the decision for Allow, describing it in a record if audited.
+func (rl *RateLimiter) decide(ip string, audited bool) (bool, *audit.Record) {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
-	now := time.Now()
+	now := rl.now()
+	allowed := rl.allow(ip, now)
+	if !allowed && rl.credits.Take(ip) {
+		// Credit granted through the admin API covers the request.
+		allowed = true
+	}
+	rl.RecordTop(ip, allowed)
+
+	if !audited {
+		return allowed, nil
+	}
+	record := &audit.Record{
+		Key:       ip,
+		Rule:      fmt.Sprintf("%d/%s", rl.rateFor(ip), rl.window),
+		Algorithm: "slidinglog",
+		Allowed:   allowed,
+		Remaining: float64(max(rl.rateFor(ip)-len(rl.logs[ip]), 0)),
+		Cost:      1,
+	}
+	if !allowed {
+		record.RetryAfter = rl.retryAfter(ip, now)
+	}
+	return allowed, record
+}
+
+// allow makes the decision for Allow. The caller must hold rl.mu.
+func (rl *RateLimiter) allow(ip string, now time.Time) bool {
 	if _, exists := rl.logs[ip]; !exists {
 		rl.logs[ip] = []time.Time{}
 	}
@@ -34,6 +88,11 @@ func (rl *RateLimiter) Allow(ip string) bool {
 	validTime := now.Add(-rl.window)
 	j := 0
 	for _, timestamp := range rl.logs[ip] {
+		if timestamp.After(now) {
+			// The clock went back, e.g. after an NTP correction. Count the request as made
+			// now, so it does not keep ip limited until the clock catches up again.
+			timestamp = now
+		}
 		if timestamp.After(validTime) {
 			rl.logs[ip][j] = timestamp
 			j++
@@ -41,7 +100,7 @@ func (rl *RateLimiter) Allow(ip string) bool {
 	}
 	rl.logs[ip] = rl.logs[ip][:j]
 
-	if len(rl.logs[ip]) >= rl.rate {
+	if len(rl.logs[ip]) >= rl.rateFor(ip) {
 		return false
 	}
 
@@ -49,12 +108,60 @@ func (rl *RateLimiter) Allow(ip string) bool {
 	return true
 }
 
-func requestHandler(rl *RateLimiter) http.HandlerFunc {
+// rateFor returns the number of requests ip may make per window. The caller must hold rl.mu.
+func (rl *RateLimiter) rateFor(ip string) int {
+	if rate, ok := rl.overrides[ip]; ok {
+		return rate
+	}
+	return rl.rate
+}
+
+// RetryAfter returns how long ip has to wait until its next request would be allowed.
+func (rl *RateLimiter) RetryAfter(ip string) time.Duration {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+
+	return rl.retryAfter(ip, rl.now())
+}
+
+// retryAfter implements RetryAfter. The caller must hold rl.mu.
+func (rl *RateLimiter) retryAfter(ip string, now time.Time) time.Duration {
+	log := rl.logs[ip]
+	rate := rl.rateFor(ip)
+	if rate <= 0 || len(log) < rate {
+		return 0
+	}
+
+	// A slot frees up once the oldest timestamp that keeps the log full leaves the window.
+	oldest := log[len(log)-rate]
+	return max(oldest.Add(rl.window).Sub(now), 0)
+}
+
+// requestHandler rate limits requests per key from extract, or per client IP if it
+// finds none. Requests keyed by something else also count against the client IP's log
+// in ceiling, if it is not nil, so that clients cannot get around the per-IP limit by
+// making up keys. If pb is not nil, keys and client IPs that keep exceeding their
+// limit are banned and rejected until the ban expires.
+func requestHandler(rl, ceiling *RateLimiter, pb *PenaltyBox, extract keys.Extractor) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ip := r.RemoteAddr // Simplified, may want to extract X-Forwarded-For or similar in a real setup
+		ip, _ := keys.ClientIP()(r)
+		key := keys.Key(extract, r)
 
-		if !rl.Allow(ip) {
-			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		if pb != nil {
+			for _, k := range []string{ip, key} {
+				if banned, remaining := pb.Banned(k); banned {
+					tooManyRequests(w, remaining)
+					return
+				}
+			}
+		}
+
+		if key != ip && ceiling != nil && !ceiling.Allow(ip) {
+			reject(w, ceiling, pb, ip)
+			return
+		}
+		if !rl.Allow(key) {
+			reject(w, rl, pb, key)
 			return
 		}
 
@@ -63,8 +170,51 @@ func requestHandler(rl *RateLimiter) http.HandlerFunc {
 	}
 }
 
+// reject turns down a request that exceeded the limit of rl for key, counting it as
+// a violation of key in pb if it is not nil.
+func reject(w http.ResponseWriter, rl *RateLimiter, pb *PenaltyBox, key string) {
+	retryAfter := rl.RetryAfter(key)
+	if pb != nil {
+		if banned, remaining := pb.Violation(key); banned {
+			retryAfter = remaining
+		}
+	}
+	tooManyRequests(w, retryAfter)
+}
+
+// tooManyRequests rejects the request, telling the client when to retry in whole seconds.
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+}
+
 func main() {
 	rl := NewRateLimiter(5, time.Second) // 5 requests per second
-	http.HandleFunc("/", requestHandler(rl))
+	// Ban clients for 1, 5 and then 30 minutes after 10 violations within a minute
+	pb := NewPenaltyBox(10, time.Minute, time.Minute, 5*time.Minute, 30*time.Minute)
+	// Limit by e.g. API key or JWT claim instead of client IP, see keys.Parse
+	var secret []byte
+	if s := os.Getenv("RATELIMIT_JWT_SECRET"); s != "" {
+		secret = []byte(s)
+	}
+	spec := os.Getenv("RATELIMIT_KEY")
+	if spec == "" {
+		spec = "ip"
+	}
+	extract, err := keys.Parse(spec, secret)
+	if err != nil {
+		fmt.Println("Invalid RATELIMIT_KEY:", err)
+		return
+	}
+	// Requests keyed by something other than the client IP are capped per IP as well
+	ceiling := NewRateLimiter(20, time.Second)
+	http.HandleFunc("/", requestHandler(rl, ceiling, pb, extract))
+	// Inspect and adjust clients' logs, if an admin token is configured
+	if token := os.Getenv("RATELIMIT_ADMIN_TOKEN"); token != "" {
+		// Report the 10 busiest clients of the last 5 minutes at /admin/top
+		rl.SetTopK(topk.New(10, 5*time.Minute))
+		http.Handle("/admin/", http.StripPrefix("/admin", admin.Handler(rl, token)))
+	}
 	http.ListenAndServe(":8080", nil)
 }
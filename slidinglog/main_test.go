@@ -3,10 +3,17 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
+
+	"github.com/nesyor/ratelimiter/internal/keys"
 )
 
 func TestRateLimiter_Allow(t *testing.T) {
@@ -38,23 +45,119 @@ func TestRequestHandler(t *testing.T) {
 	rate := 2
 	window := 500 * time.Millisecond // Using a shorter window for testing
 	rl := NewRateLimiter(rate, window)
-	handler := requestHandler(rl)
+	handler := requestHandler(rl, nil, nil, nil)
 
 	req, _ := http.NewRequest("GET", "/", nil)
-	recorder := httptest.NewRecorder()
 
 	// Make `rate` requests
 	for i := 0; i < rate; i++ {
+		recorder := httptest.NewRecorder() // Fresh recorder so each status code is checked
 		handler(recorder, req)
 		if status := recorder.Code; status != http.StatusOK {
 			t.Fatalf("Expected status code %d but got %d on request %d", http.StatusOK, status, i+1)
 		}
-		recorder.Body.Reset() // Clear body for next check
 	}
 
 	// Make an additional request which should be rate limited
+	recorder := httptest.NewRecorder()
 	handler(recorder, req)
 	if status := recorder.Code; status != http.StatusTooManyRequests {
 		t.Fatalf("Expected status code %d but got %d after exceeding rate limit", http.StatusTooManyRequests, status)
 	}
+	if retryAfter := recorder.Header().Get("Retry-After"); retryAfter != "1" {
+		t.Fatalf("Expected Retry-After of 1 second but got %q", retryAfter)
+	}
+}
+
+func TestRequestHandler_PenaltyBox(t *testing.T) {
+	rl := NewRateLimiter(1, time.Second)
+	pb := NewPenaltyBox(2, time.Minute, 10*time.Minute)
+	handler := requestHandler(rl, nil, pb, nil)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	status := func() (int, string) {
+		recorder := httptest.NewRecorder()
+		handler(recorder, req)
+		return recorder.Code, recorder.Header().Get("Retry-After")
+	}
+
+	if code, _ := status(); code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d on first request", http.StatusOK, code)
+	}
+
+	// The first violation is only rate limited, the second one bans the client.
+	if code, retryAfter := status(); code != http.StatusTooManyRequests || retryAfter != "1" {
+		t.Fatalf("Expected 429 with Retry-After 1 but got %d with %q", code, retryAfter)
+	}
+	if code, retryAfter := status(); code != http.StatusTooManyRequests || retryAfter != "600" {
+		t.Fatalf("Expected 429 with Retry-After 600 but got %d with %q", code, retryAfter)
+	}
+
+	// Banned clients stay rejected even once the rate limit window has passed.
+	time.Sleep(time.Second)
+	if code, _ := status(); code != http.StatusTooManyRequests {
+		t.Fatalf("Expected banned client to be rejected but got %d", code)
+	}
+
+	ip, _, _ := net.SplitHostPort(req.RemoteAddr)
+	pb.Unban(ip)
+	if code, _ := status(); code != http.StatusOK {
+		t.Fatalf("Expected status code %d after unban but got %d", http.StatusOK, code)
+	}
+}
+
+func TestRequestHandler_IPCeiling(t *testing.T) {
+	rl := NewRateLimiter(1, time.Minute)
+	ceiling := NewRateLimiter(3, time.Minute)
+	pb := NewPenaltyBox(2, time.Minute, 10*time.Minute)
+	handler := requestHandler(rl, ceiling, pb, keys.Header("X-API-Key"))
+
+	status := func(apiKey string) (int, string) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-API-Key", apiKey)
+		recorder := httptest.NewRecorder()
+		handler(recorder, req)
+		return recorder.Code, recorder.Header().Get("Retry-After")
+	}
+
+	// Made-up keys each get a fresh log, but the client IP runs into the ceiling.
+	for i := 0; i < 3; i++ {
+		if code, _ := status(fmt.Sprintf("made-up-%d", i)); code != http.StatusOK {
+			t.Fatalf("Expected status code %d but got %d on request %d", http.StatusOK, code, i+1)
+		}
+	}
+	if code, _ := status("made-up-3"); code != http.StatusTooManyRequests {
+		t.Fatalf("Expected the ceiling to reject a fourth key from the same IP but got %d", code)
+	}
+
+	// Going on past the ceiling bans the client IP, whatever key it sends.
+	if code, retryAfter := status("made-up-4"); code != http.StatusTooManyRequests || retryAfter != "600" {
+		t.Fatalf("Expected 429 with Retry-After 600 but got %d with %q", code, retryAfter)
+	}
+	ceiling.Grant("192.0.2.1", 10, time.Minute)
+	if code, _ := status("made-up-5"); code != http.StatusTooManyRequests {
+		t.Fatalf("Expected the banned IP to be rejected but got %d", code)
+	}
+}
+
+func TestRateLimiter_AuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	rl := NewRateLimiter(1, time.Second)
+	rl.SetAuditHandler(slog.NewJSONHandler(&buf, nil), 0)
+
+	ip := "192.168.1.1"
+	rl.Allow(ip)
+	rl.Allow(ip)
+
+	// Only the denial is logged with a sample rate of 0
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Expected a single JSON audit record but got %q", buf.String())
+	}
+	if record["decision"] != "deny" || record["key"] != ip || record["algorithm"] != "slidinglog" || record["remaining"] != 0.0 {
+		t.Errorf("Unexpected audit record %v", record)
+	}
+	if retryAfter := record["retry_after"].(float64); retryAfter <= 0 || retryAfter > float64(time.Second) {
+		t.Errorf("Expected retry_after within the window but got %v", retryAfter)
+	}
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultForgetAfter is how long a PenaltyBox remembers a key's bans after the last
+// one ended, unless SetForgetAfter says otherwise.
+const DefaultForgetAfter = 24 * time.Hour
+
+// PenaltyBox bans keys that keep violating the rate limit, fail2ban-style. Once a
+// key collects threshold violations within window it is banned, and every further
+// ban lasts longer than the previous one, until the key has behaved for a while.
+type PenaltyBox struct {
+	threshold    int
+	window       time.Duration
+	banDurations []time.Duration
+	forgetAfter  time.Duration // How long bans are remembered for escalation after the last one ended.
+	offenders    map[string]*offender
+	lastPrune    time.Time // When offenders with nothing left to remember were last removed.
+	now          func() time.Time
+	mu           sync.Mutex
+}
+
+// offender tracks the violations and bans of a single key.
+type offender struct {
+	violations  []time.Time // Violations within the counting window, oldest first.
+	bans        int         // Number of bans handed out so far, used for escalation.
+	bannedUntil time.Time
+}
+
+// NewPenaltyBox creates a penalty box that bans a key after threshold violations within window.
+// Successive bans use the given durations in order; the last one repeats.
+func NewPenaltyBox(threshold int, window time.Duration, banDurations ...time.Duration) *PenaltyBox {
+	return &PenaltyBox{
+		threshold:    threshold,
+		window:       window,
+		banDurations: banDurations,
+		forgetAfter:  DefaultForgetAfter,
+		offenders:    make(map[string]*offender),
+		now:          time.Now,
+	}
+}
+
+// SetForgetAfter sets how long a key's bans are remembered after the last one ended.
+// A key banned again within that time gets the next, longer ban; after it, the key
+// starts over with the first one. It is never shorter than the violation window.
+func (pb *PenaltyBox) SetForgetAfter(d time.Duration) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	pb.forgetAfter = d
+}
+
+// expired reports whether o has nothing left to remember at now: it has no violations
+// within window, and it was never banned or its last ban ended at least forgetAfter ago.
+func (o *offender) expired(now time.Time, window, forgetAfter time.Duration) bool {
+	if n := len(o.violations); n > 0 && now.Sub(o.violations[n-1]) < window {
+		return false
+	}
+	return o.bans == 0 || now.Sub(o.bannedUntil) >= max(forgetAfter, window)
+}
+
+// prune removes offenders that have expired, at most once per window, so keys that
+// stopped misbehaving do not stay in memory forever. The caller must hold pb.mu.
+func (pb *PenaltyBox) prune(now time.Time) {
+	if now.Sub(pb.lastPrune) < pb.window {
+		return
+	}
+	pb.lastPrune = now
+
+	for key, o := range pb.offenders {
+		if o.expired(now, pb.window, pb.forgetAfter) {
+			delete(pb.offenders, key)
+		}
+	}
+}
+
+// Banned reports whether key is currently banned and, if so, how long the ban has left.
+func (pb *PenaltyBox) Banned(key string) (bool, time.Duration) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	now := pb.now()
+	o, exists := pb.offenders[key]
+	if !exists {
+		return false, 0
+	}
+	if o.expired(now, pb.window, pb.forgetAfter) {
+		delete(pb.offenders, key)
+		return false, 0
+	}
+	if remaining := o.bannedUntil.Sub(now); remaining > 0 {
+		return true, remaining
+	}
+	return false, 0
+}
+
+// Violation records that key exceeded its rate limit. It reports whether the key
+// is now banned and for how long.
+func (pb *PenaltyBox) Violation(key string) (bool, time.Duration) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	now := pb.now()
+	pb.prune(now)
+	o, exists := pb.offenders[key]
+	if !exists {
+		o = &offender{}
+		pb.offenders[key] = o
+	}
+
+	// Requests made while banned do not escalate the ban further.
+	if remaining := o.bannedUntil.Sub(now); remaining > 0 {
+		return true, remaining
+	}
+
+	// Forget violations that are out of window
+	validTime := now.Add(-pb.window)
+	j := 0
+	for _, timestamp := range o.violations {
+		if timestamp.After(validTime) {
+			o.violations[j] = timestamp
+			j++
+		}
+	}
+	o.violations = append(o.violations[:j], now)
+
+	if len(o.violations) < pb.threshold || len(pb.banDurations) == 0 {
+		return false, 0
+	}
+
+	// Escalate: each ban is at least as long as the previous one.
+	duration := pb.banDurations[min(o.bans, len(pb.banDurations)-1)]
+	o.bans++
+	o.violations = o.violations[:0]
+	o.bannedUntil = now.Add(duration)
+	return true, duration
+}
+
+// Unban lifts any ban on key and forgets its violation history.
+func (pb *PenaltyBox) Unban(key string) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	delete(pb.offenders, key)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nesyor/ratelimiter/internal/conformance"
+)
+
+func TestPenaltyBox_Escalation(t *testing.T) {
+	pb := NewPenaltyBox(2, time.Second, 100*time.Millisecond, 300*time.Millisecond)
+	key := "192.168.1.1"
+
+	if banned, _ := pb.Violation(key); banned {
+		t.Fatal("Key was banned before reaching the violation threshold")
+	}
+	banned, duration := pb.Violation(key)
+	if !banned || duration != 100*time.Millisecond {
+		t.Fatalf("Expected a 100ms ban but got banned=%v for %v", banned, duration)
+	}
+
+	// Violations while banned do not extend the ban.
+	if _, remaining := pb.Violation(key); remaining > 100*time.Millisecond {
+		t.Fatalf("Ban was extended to %v while already banned", remaining)
+	}
+
+	// The ban expires on its own.
+	time.Sleep(100 * time.Millisecond)
+	if banned, _ := pb.Banned(key); banned {
+		t.Fatal("Key is still banned after the ban expired")
+	}
+
+	// The next ban is longer, and the last duration repeats after that.
+	pb.Violation(key)
+	if _, duration := pb.Violation(key); duration != 300*time.Millisecond {
+		t.Fatalf("Expected second ban to last 300ms but got %v", duration)
+	}
+	pb.Unban(key)
+	if banned, _ := pb.Banned(key); banned {
+		t.Fatal("Key is still banned after a manual unban")
+	}
+}
+
+func TestPenaltyBox_ViolationWindow(t *testing.T) {
+	pb := NewPenaltyBox(2, 100*time.Millisecond, time.Minute)
+	key := "192.168.1.1"
+
+	pb.Violation(key)
+	time.Sleep(150 * time.Millisecond)
+
+	// The first violation has left the window, so this one does not trigger a ban.
+	if banned, _ := pb.Violation(key); banned {
+		t.Fatal("Key was banned for violations spread beyond the window")
+	}
+}
+
+func TestPenaltyBox_ForgetsOldOffenders(t *testing.T) {
+	clock := conformance.NewClock()
+	pb := NewPenaltyBox(2, time.Second, time.Minute, time.Hour)
+	pb.now = clock.Now
+
+	// One violation each from many keys, and a ban for one of them.
+	for i := 0; i < 100; i++ {
+		pb.Violation(fmt.Sprintf("192.0.2.%d", i))
+	}
+	pb.Violation("192.0.2.0")
+
+	// Once the violation window has passed, only the banned key is remembered.
+	clock.Advance(time.Second)
+	pb.Violation("198.51.100.1")
+	if n := len(pb.offenders); n != 2 {
+		t.Fatalf("Expected the banned key and the new offender to be remembered but got %d offenders", n)
+	}
+
+	// A key that waits out its ban and pauses for longer than the window still
+	// escalates when it floods again...
+	clock.Advance(time.Minute + 5*time.Second)
+	if banned, _ := pb.Banned("192.0.2.0"); banned {
+		t.Fatal("Key is still banned after the ban expired")
+	}
+	pb.Violation("192.0.2.0")
+	if _, duration := pb.Violation("192.0.2.0"); duration != time.Hour {
+		t.Fatalf("Expected the second ban to last an hour but got %v", duration)
+	}
+
+	// ...until its last ban ended longer ago than the bans are remembered.
+	clock.Advance(time.Hour + DefaultForgetAfter - time.Second)
+	pb.Violation("198.51.100.1")
+	if _, exists := pb.offenders["192.0.2.0"]; !exists {
+		t.Fatal("Expected the bans of 192.0.2.0 to be remembered until they are forgotten")
+	}
+	clock.Advance(time.Second)
+	if banned, _ := pb.Banned("192.0.2.0"); banned {
+		t.Fatal("Key is still banned after the ban expired")
+	}
+	if _, exists := pb.offenders["192.0.2.0"]; exists {
+		t.Fatal("Expected a key whose last ban ended a day ago to be forgotten")
+	}
+	pb.Violation("192.0.2.0")
+	if _, duration := pb.Violation("192.0.2.0"); duration != time.Minute {
+		t.Fatalf("Expected a forgotten key to start over with a one minute ban but got %v", duration)
+	}
+}
+
+func TestPenaltyBox_SetForgetAfter(t *testing.T) {
+	clock := conformance.NewClock()
+	pb := NewPenaltyBox(1, time.Second, time.Minute, time.Hour)
+	pb.now = clock.Now
+	pb.SetForgetAfter(10 * time.Minute)
+
+	pb.Violation("192.0.2.1")
+	clock.Advance(time.Minute + 9*time.Minute)
+	if _, duration := pb.Violation("192.0.2.1"); duration != time.Hour {
+		t.Fatalf("Expected a ban within 10 minutes of the last to escalate but got %v", duration)
+	}
+	clock.Advance(time.Hour + 10*time.Minute)
+	if _, duration := pb.Violation("192.0.2.1"); duration != time.Minute {
+		t.Fatalf("Expected a ban 10 minutes after the last to start over but got %v", duration)
+	}
+}
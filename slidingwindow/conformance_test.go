@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nesyor/ratelimiter/internal/conformance"
+)
+
+func TestRateLimiterConformance(t *testing.T) {
+	// Requests still count when exactly a window old, which is a log whose window is
+	// one nanosecond longer. A client polling in steps therefore gets its next request
+	// a step after a window has passed, and sustains slightly less than the rate.
+	spec := conformance.Spec{Burst: 5, Rate: 5, Slack: 5, Model: conformance.SlidingLog(5, time.Second+time.Nanosecond)}
+	conformance.Run(t, spec, func(clock *conformance.Clock) conformance.Limiter {
+		rl := NewRateLimiter(5, time.Second)
+		rl.now = clock.Now
+		return rl
+	})
+}
@@ -1,30 +1,89 @@
 package main
 
 import (
+	"fmt"
 	"sync"
 	"time"
+
+	"github.com/nesyor/ratelimiter/internal/admin"
+	"github.com/nesyor/ratelimiter/internal/audit"
 )
 
 type RateLimiter struct {
+	audit.Sink    // Optional log of decisions, see SetAuditHandler.
+	admin.TopKeys // Optional tracker of the busiest keys, see SetTopK.
+
 	mu          sync.Mutex
 	requestsMap map[string][]time.Time
 	limit       int
 	window      time.Duration
+	overrides   map[string]int // Per-key limits set through the admin API.
+	credits     admin.Credits  // Extra requests granted through the admin API.
+	now         func() time.Time
 }
 
 func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
 	return &RateLimiter{
 		requestsMap: make(map[string][]time.Time),
+		overrides:   make(map[string]int),
+		now:         time.Now,
 		limit:       limit,
 		window:      window,
 	}
 }
 
 func (rl *RateLimiter) Allow(ip string) bool {
+	logger := rl.AuditLogger()
+	allowed, record := rl.decide(ip, logger != nil)
+	if record != nil {
+		// Logged after rl.mu is released, since the handler may do I/O.
+		logger.Log(*record)
+	}
+	return allowed
+}
+
+// decide makes the decision for Allow, describing it in a record if audited.
+func (rl *RateLimiter) decide(ip string, audited bool) (bool, *audit.Record) {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
-	now := time.Now()
+	now := rl.now()
+	allowed := rl.allow(ip, now)
+	if !allowed && rl.credits.Take(ip) {
+		// Credit granted through the admin API covers the request.
+		allowed = true
+	}
+	rl.RecordTop(ip, allowed)
+
+	if !audited {
+		return allowed, nil
+	}
+	requests := rl.requestsMap[ip]
+	record := &audit.Record{
+		Key:       ip,
+		Rule:      fmt.Sprintf("%d/%s", rl.limitFor(ip), rl.window),
+		Algorithm: "slidingwindow",
+		Allowed:   allowed,
+		Remaining: float64(max(rl.limitFor(ip)-len(requests), 0)),
+		Cost:      1,
+	}
+	if limit := rl.limitFor(ip); !allowed && limit > 0 && len(requests) >= limit {
+		// The oldest request that keeps the window full has to slide out first.
+		record.RetryAfter = requests[len(requests)-limit].Add(rl.window).Sub(now)
+	}
+	return allowed, record
+}
+
+// limitFor returns the number of requests ip may make per window. The caller must hold rl.mu.
+func (rl *RateLimiter) limitFor(ip string) int {
+	if limit, ok := rl.overrides[ip]; ok {
+		return limit
+	}
+	return rl.limit
+}
+
+// allow makes the decision for Allow. The caller must hold rl.mu.
+func (rl *RateLimiter) allow(ip string, now time.Time) bool {
 	if _, exists := rl.requestsMap[ip]; !exists {
 		rl.requestsMap[ip] = []time.Time{}
 	}
@@ -32,6 +91,11 @@ func (rl *RateLimiter) Allow(ip string) bool {
 	// Remove timestamps outside the current window
 	j := 0
 	for _, requestTime := range rl.requestsMap[ip] {
+		if requestTime.After(now) {
+			// The clock went back, e.g. after an NTP correction. Count the request as made
+			// now, so it does not keep ip limited until the clock catches up again.
+			requestTime = now
+		}
 		if now.Sub(requestTime) <= rl.window {
 			rl.requestsMap[ip][j] = requestTime
 			j++
@@ -40,7 +104,7 @@ func (rl *RateLimiter) Allow(ip string) bool {
 	rl.requestsMap[ip] = rl.requestsMap[ip][:j]
 
 	// Check if adding another request would exceed the limit
-	if len(rl.requestsMap[ip]) >= rl.limit {
+	if len(rl.requestsMap[ip]) >= rl.limitFor(ip) {
 		return false
 	}
 
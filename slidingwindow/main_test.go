@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -58,3 +62,26 @@ func TestRateLimiter_ConcurrentAllow(t *testing.T) {
 		t.Errorf("Expected 5 requests to be allowed, but got %d", allowedCount)
 	}
 }
+
+func TestRateLimiter_AuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	rl := NewRateLimiter(1, time.Second)
+	rl.SetAuditHandler(slog.NewJSONHandler(&buf, nil), 1)
+
+	ip := "192.168.1.1"
+	rl.Allow(ip)
+	rl.Allow(ip)
+
+	// With a sample rate of 1 both decisions are logged
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 audit records but got %d", len(lines))
+	}
+	var record map[string]any
+	if err := json.Unmarshal([]byte(lines[1]), &record); err != nil {
+		t.Fatalf("Expected a JSON audit record but got %q", lines[1])
+	}
+	if record["decision"] != "deny" || record["key"] != ip || record["algorithm"] != "slidingwindow" {
+		t.Errorf("Unexpected audit record %v", record)
+	}
+}
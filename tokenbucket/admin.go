@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nesyor/ratelimiter/internal/admin"
+)
+
+// keyState is what the admin API shows for a single IP.
+type keyState struct {
+	Tokens   int    `json:"tokens"`
+	Rate     int    `json:"rate"`
+	Capacity int    `json:"capacity"`
+	Credit   int    `json:"credit"`
+	Plan     string `json:"plan,omitempty"`
+	Override *Rule  `json:"override,omitempty"`
+}
+
+// Keys returns the IPs that have a token bucket.
+func (rl *RateLimiter) Keys() []string {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	keys := make([]string, 0, len(rl.buckets))
+	for ip := range rl.buckets {
+		keys = append(keys, ip)
+	}
+	return keys
+}
+
+// State returns the token bucket state of ip.
+func (rl *RateLimiter) State(ip string) (any, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	bucket, exists := rl.buckets[ip]
+	if !exists {
+		return nil, admin.ErrUnknownKey
+	}
+
+	bucket.mu.Lock()
+	bucket.refillInternal()
+	state := keyState{
+		Tokens:   bucket.tokens,
+		Rate:     bucket.rate,
+		Capacity: bucket.capacity,
+		Credit:   rl.credits.Remaining(ip),
+	}
+	bucket.mu.Unlock()
+
+	if rl.plans != nil {
+		if plan, ok := rl.plans.For(ip); ok {
+			state.Plan = plan.Name
+		}
+	}
+	if override, ok := rl.overrides[ip]; ok {
+		state.Override = &override
+	}
+	return state, nil
+}
+
+// Reset removes ip's token bucket, so its next request starts with a full bucket.
+// Any credit granted to ip is cleared as well.
+func (rl *RateLimiter) Reset(ip string) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.credits.Clear(ip)
+	if _, exists := rl.buckets[ip]; !exists {
+		return admin.ErrUnknownKey
+	}
+	delete(rl.buckets, ip)
+	return nil
+}
+
+// Grant allows ip amount requests beyond its bucket until ttl from now.
+func (rl *RateLimiter) Grant(ip string, amount int, ttl time.Duration) {
+	rl.credits.Grant(ip, amount, ttl)
+}
+
+// SetOverride gives ip its own rate and capacity, e.g. {"rate": 10, "capacity": 20}.
+func (rl *RateLimiter) SetOverride(ip string, override json.RawMessage) error {
+	var rule Rule
+	if err := json.Unmarshal(override, &rule); err != nil {
+		return err
+	}
+	if rule.Rate <= 0 || rule.Capacity <= 0 {
+		return fmt.Errorf("override needs a positive rate and capacity")
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.overrides[ip] = rule
+	return nil
+}
+
+// ClearOverride returns ip to the network or default rule.
+func (rl *RateLimiter) ClearOverride(ip string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	delete(rl.overrides, ip)
+}
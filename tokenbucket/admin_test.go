@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nesyor/ratelimiter/internal/admin"
+	"github.com/nesyor/ratelimiter/internal/topk"
+)
+
+// Test inspecting and adjusting buckets through the admin API
+func TestAdminAPI(t *testing.T) {
+	rl := NewRateLimiter(1, 1)
+	handler := admin.Handler(rl, "secret")
+	ip := "192.168.1.1"
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	rl.Allow(ip)
+	if rl.Allow(ip) {
+		t.Fatal("Expected second request to be denied")
+	}
+
+	var shown admin.KeyState
+	json.Unmarshal(do("GET", "/keys/"+ip, "").Body.Bytes(), &shown)
+	if state := shown.State.(map[string]any); state["tokens"] != 0.0 || state["capacity"] != 1.0 {
+		t.Errorf("Unexpected state %v", state)
+	}
+
+	// Credit covers requests the bucket would deny
+	if code := do("POST", "/keys/"+ip+"/credit", `{"amount": 1, "ttl": "1m"}`).Code; code != http.StatusNoContent {
+		t.Fatalf("Expected credit to be granted but got %d", code)
+	}
+	if !rl.Allow(ip) || rl.Allow(ip) {
+		t.Error("Expected exactly one request to be covered by credit")
+	}
+
+	// Reset starts over with a full bucket and no credit
+	rl.Grant(ip, 5, time.Minute)
+	if code := do("POST", "/keys/"+ip+"/reset", "").Code; code != http.StatusNoContent {
+		t.Fatalf("Expected reset to succeed but got %d", code)
+	}
+	if credit := rl.credits.Remaining(ip); credit != 0 {
+		t.Fatalf("Expected reset to clear credit but %d is left", credit)
+	}
+	if !rl.Allow(ip) {
+		t.Error("Expected request to be allowed after reset")
+	}
+
+	// Overrides change the key's capacity
+	do("POST", "/keys/"+ip+"/reset", "")
+	if code := do("PUT", "/keys/"+ip+"/override", `{"rate": 1, "capacity": 3}`).Code; code != http.StatusNoContent {
+		t.Fatalf("Expected override to be set but got %d", code)
+	}
+	for i := 0; i < 3; i++ {
+		if !rl.Allow(ip) {
+			t.Fatalf("Expected request %d to be allowed with the override", i+1)
+		}
+	}
+	if code := do("PUT", "/keys/"+ip+"/override", `{"rate": 0, "capacity": 3}`).Code; code != http.StatusBadRequest {
+		t.Errorf("Expected invalid override to be rejected but got %d", code)
+	}
+	do("DELETE", "/keys/"+ip+"/override", "")
+	if keys := rl.Keys(); len(keys) != 1 || keys[0] != ip {
+		t.Errorf("Expected %s to be the only tracked key but got %v", ip, keys)
+	}
+}
+
+// Test reporting the most throttled keys through the admin API
+func TestAdminTop(t *testing.T) {
+	rl := NewRateLimiter(1, 1)
+	handler := admin.Handler(rl, "secret")
+
+	top := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/top?n=1", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+	if code := top().Code; code != http.StatusNotFound {
+		t.Fatalf("Expected 404 without tracking but got %d", code)
+	}
+
+	rl.SetTopK(topk.New(1, time.Minute))
+	for i := 0; i < 3; i++ {
+		rl.Allow("192.168.1.1")
+	}
+	rl.Allow("192.168.1.2")
+
+	var report topk.Report
+	if err := json.Unmarshal(top().Body.Bytes(), &report); err != nil {
+		t.Fatalf("Expected a report: %v", err)
+	}
+	if len(report.Denied) != 1 || report.Denied[0].Key != "192.168.1.1" || report.Denied[0].Count != 2 {
+		t.Errorf("Expected 192.168.1.1 to be denied twice but got %v", report.Denied)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Action is what happens to requests from a network matched by a NetworkRule.
+type Action int
+
+const (
+	ActionLimit Action = iota // Rate limit using the rule's rate and capacity.
+	ActionAllow               // Exempt from rate limiting.
+	ActionDeny                // Always reject.
+)
+
+// Rule holds token bucket parameters.
+type Rule struct {
+	Rate     int  `json:"rate"`             // Number of tokens added per second.
+	Capacity int  `json:"capacity"`         // Maximum number of tokens the bucket can hold.
+	Shadow   bool `json:"shadow,omitempty"` // Record would-be denials but allow every request.
+}
+
+// NetworkRule applies an action to every address within a prefix.
+type NetworkRule struct {
+	Prefix netip.Prefix
+	Action Action
+	Rule   Rule // Only used with ActionLimit.
+}
+
+// CIDRMatcher finds the most specific NetworkRule for an address. Rules are kept
+// in a binary prefix tree per address family, so a lookup walks at most 32 (IPv4)
+// or 128 (IPv6) nodes regardless of the number of rules.
+type CIDRMatcher struct {
+	v4 *prefixNode
+	v6 *prefixNode
+}
+
+// prefixNode is one bit of a prefix tree. A node carries a rule if a prefix ends there.
+type prefixNode struct {
+	children [2]*prefixNode
+	rule     *NetworkRule
+}
+
+// NewCIDRMatcher creates a matcher containing the given rules.
+func NewCIDRMatcher(rules ...NetworkRule) *CIDRMatcher {
+	m := &CIDRMatcher{v4: &prefixNode{}, v6: &prefixNode{}}
+	for _, rule := range rules {
+		m.Insert(rule)
+	}
+	return m
+}
+
+// Insert adds a rule, replacing any existing rule for the same prefix.
+func (m *CIDRMatcher) Insert(rule NetworkRule) {
+	if addr := rule.Prefix.Addr(); addr.Is4In6() && rule.Prefix.Bits() >= 96 {
+		rule.Prefix = netip.PrefixFrom(addr.Unmap(), rule.Prefix.Bits()-96)
+	}
+	rule.Prefix = rule.Prefix.Masked()
+	addr := rule.Prefix.Addr()
+
+	node := m.root(addr)
+	for i := 0; i < rule.Prefix.Bits(); i++ {
+		bit := addrBit(addr, i)
+		if node.children[bit] == nil {
+			node.children[bit] = &prefixNode{}
+		}
+		node = node.children[bit]
+	}
+	node.rule = &rule
+}
+
+// Lookup returns the rule with the longest prefix containing addr.
+func (m *CIDRMatcher) Lookup(addr netip.Addr) (NetworkRule, bool) {
+	addr = addr.Unmap()
+
+	var match *NetworkRule
+	node := m.root(addr)
+	for i := 0; node != nil; i++ {
+		if node.rule != nil {
+			match = node.rule
+		}
+		if i == addr.BitLen() {
+			break
+		}
+		node = node.children[addrBit(addr, i)]
+	}
+
+	if match == nil {
+		return NetworkRule{}, false
+	}
+	return *match, true
+}
+
+// LookupString is like Lookup but takes an address in string form.
+func (m *CIDRMatcher) LookupString(ip string) (NetworkRule, bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return NetworkRule{}, false
+	}
+	return m.Lookup(addr)
+}
+
+// root returns the tree for addr's address family.
+func (m *CIDRMatcher) root(addr netip.Addr) *prefixNode {
+	if addr.Is4() {
+		return m.v4
+	}
+	return m.v6
+}
+
+// addrBit returns bit i of addr, counting from the most significant bit.
+func addrBit(addr netip.Addr, i int) int {
+	b := addr.AsSlice()
+	return int(b[i/8]>>(7-i%8)) & 1
+}
+
+// LoadCIDRFile reads network rules from a file. See ParseCIDRRules for the format.
+func LoadCIDRFile(path string) (*CIDRMatcher, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseCIDRRules(f)
+}
+
+// ParseCIDRRules reads one rule per line. Blank lines and lines starting with # are ignored.
+//
+//	allow 10.0.0.0/8
+//	deny  203.0.113.0/24
+//	limit 198.51.100.0/24 100 200   # rate and capacity
+//	limit 192.0.2.0/24 5 5 shadow   # evaluated but not enforced
+func ParseCIDRRules(r io.Reader) (*CIDRMatcher, error) {
+	m := NewCIDRMatcher()
+
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		rule, err := parseNetworkRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		m.Insert(rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// parseNetworkRule parses the fields of a single rule line.
+func parseNetworkRule(fields []string) (NetworkRule, error) {
+	if len(fields) < 2 {
+		return NetworkRule{}, fmt.Errorf("expected an action and a prefix")
+	}
+
+	prefix, err := netip.ParsePrefix(fields[1])
+	if err != nil {
+		// A bare address is a single host prefix.
+		addr, addrErr := netip.ParseAddr(fields[1])
+		if addrErr != nil {
+			return NetworkRule{}, err
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	rule := NetworkRule{Prefix: prefix}
+
+	switch fields[0] {
+	case "allow":
+		rule.Action = ActionAllow
+	case "deny":
+		rule.Action = ActionDeny
+	case "limit":
+		if len(fields) == 5 && fields[4] == "shadow" {
+			rule.Rule.Shadow = true
+		} else if len(fields) != 4 {
+			return NetworkRule{}, fmt.Errorf("limit needs a rate, a capacity and optionally shadow")
+		}
+		rule.Action = ActionLimit
+		if rule.Rule.Rate, err = strconv.Atoi(fields[2]); err != nil {
+			return NetworkRule{}, fmt.Errorf("invalid rate: %w", err)
+		}
+		if rule.Rule.Capacity, err = strconv.Atoi(fields[3]); err != nil {
+			return NetworkRule{}, fmt.Errorf("invalid capacity: %w", err)
+		}
+		if rule.Rule.Rate <= 0 || rule.Rule.Capacity <= 0 {
+			return NetworkRule{}, fmt.Errorf("rate and capacity must be positive, got %d and %d", rule.Rule.Rate, rule.Rule.Capacity)
+		}
+	default:
+		return NetworkRule{}, fmt.Errorf("unknown action %q", fields[0])
+	}
+	return rule, nil
+}
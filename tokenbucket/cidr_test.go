@@ -0,0 +1,241 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/nesyor/ratelimiter/internal/keys"
+)
+
+// Test longest-prefix matching for IPv4 and IPv6 networks
+func TestCIDRMatcherLookup(t *testing.T) {
+	m := NewCIDRMatcher(
+		NetworkRule{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Action: ActionAllow},
+		NetworkRule{Prefix: netip.MustParsePrefix("10.1.0.0/16"), Action: ActionDeny},
+		NetworkRule{Prefix: netip.MustParsePrefix("10.1.2.0/24"), Action: ActionLimit, Rule: Rule{Rate: 10, Capacity: 20}},
+		NetworkRule{Prefix: netip.MustParsePrefix("2001:db8::/32"), Action: ActionDeny},
+		NetworkRule{Prefix: netip.MustParsePrefix("2001:db8:1::/48"), Action: ActionAllow},
+	)
+
+	tests := []struct {
+		ip     string
+		found  bool
+		action Action
+	}{
+		{"10.9.9.9", true, ActionAllow},
+		{"10.1.9.9", true, ActionDeny},
+		{"10.1.2.3", true, ActionLimit},
+		{"::ffff:10.1.2.3", true, ActionLimit}, // IPv4-mapped IPv6 matches the IPv4 rule
+		{"11.0.0.1", false, 0},
+		{"2001:db8:2::1", true, ActionDeny},
+		{"2001:db8:1::1", true, ActionAllow},
+		{"2001:db9::1", false, 0},
+		{"not an ip", false, 0},
+	}
+
+	for _, test := range tests {
+		rule, found := m.LookupString(test.ip)
+		if found != test.found || (found && rule.Action != test.action) {
+			t.Errorf("Lookup(%s) = %v, %v; expected %v, %v", test.ip, rule.Action, found, test.action, test.found)
+		}
+	}
+
+	if rule, _ := m.LookupString("10.1.2.3"); rule.Rule.Capacity != 20 {
+		t.Errorf("Expected the /24 rule with capacity 20 but got %+v", rule)
+	}
+}
+
+// Test parsing rules from the file format
+func TestParseCIDRRules(t *testing.T) {
+	m, err := ParseCIDRRules(strings.NewReader(`
+# internal networks
+allow 10.0.0.0/8
+deny  203.0.113.0/24
+limit 198.51.100.0/24 100 200  # partner
+deny  192.0.2.1
+`))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing rules: %v", err)
+	}
+
+	if rule, ok := m.LookupString("198.51.100.7"); !ok || rule.Rule != (Rule{Rate: 100, Capacity: 200}) {
+		t.Errorf("Expected partner rule but got %+v", rule)
+	}
+	if rule, ok := m.LookupString("192.0.2.1"); !ok || rule.Action != ActionDeny {
+		t.Error("Expected bare address to be denied")
+	}
+	if _, ok := m.LookupString("192.0.2.2"); ok {
+		t.Error("Expected bare address rule to match a single host only")
+	}
+
+	for _, bad := range []string{"block 10.0.0.0/8", "allow", "limit 10.0.0.0/8 1", "allow 10.0.0.0/33",
+		"limit 10.0.0.0/8 0 10", "limit 10.0.0.0/8 10 -1"} {
+		if _, err := ParseCIDRRules(strings.NewReader(bad)); err == nil {
+			t.Errorf("Expected an error parsing %q", bad)
+		}
+	}
+}
+
+// Test that network rules are consulted before the per-IP buckets
+func TestRateLimiterNetworks(t *testing.T) {
+	rl := NewRateLimiter(1, 1)
+	rl.SetNetworks(NewCIDRMatcher(
+		NetworkRule{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Action: ActionAllow},
+		NetworkRule{Prefix: netip.MustParsePrefix("203.0.113.0/24"), Action: ActionDeny},
+		NetworkRule{Prefix: netip.MustParsePrefix("198.51.100.0/24"), Action: ActionLimit, Rule: Rule{Rate: 1, Capacity: 3}},
+	))
+
+	for i := 0; i < 10; i++ {
+		if !rl.Allow("10.0.0.1") {
+			t.Fatal("Expected allowed network to be exempt from rate limiting")
+		}
+	}
+	if rl.Allow("203.0.113.5") || rl.Network("203.0.113.5") != ActionDeny {
+		t.Error("Expected denied network to be blocked")
+	}
+
+	// Partner network gets a capacity of 3 instead of 1
+	for i := 0; i < 3; i++ {
+		if !rl.Allow("198.51.100.1") {
+			t.Fatalf("Expected request %d from partner network to be allowed", i+1)
+		}
+	}
+	if rl.Allow("198.51.100.1") {
+		t.Error("Expected partner network to be limited after its capacity")
+	}
+
+	// Other addresses use the default rule
+	if !rl.Allow("192.0.2.1") || rl.Allow("192.0.2.1") {
+		t.Error("Expected default rule with capacity 1")
+	}
+}
+
+// Test the HTTP handler's responses for denied and limited clients
+func TestLimitHandlerNetworks(t *testing.T) {
+	rl := NewRateLimiter(1, 1)
+	rl.SetNetworks(NewCIDRMatcher(NetworkRule{Prefix: netip.MustParsePrefix("203.0.113.0/24"), Action: ActionDeny}))
+	handler := limitHandler(rl, nil, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	status := func(remoteAddr string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	if code := status("203.0.113.5:1234"); code != http.StatusForbidden {
+		t.Errorf("Expected %d for denied network but got %d", http.StatusForbidden, code)
+	}
+	if code := status("192.0.2.1:1234"); code != http.StatusOK {
+		t.Errorf("Expected %d for first request but got %d", http.StatusOK, code)
+	}
+	if code := status("192.0.2.1:1234"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected %d after capacity but got %d", http.StatusTooManyRequests, code)
+	}
+}
+
+// Test that clients behind the same IP are limited separately by API key
+func TestLimitHandlerAPIKey(t *testing.T) {
+	rl := NewRateLimiter(1, 1)
+	rl.SetNetworks(NewCIDRMatcher(NetworkRule{Prefix: netip.MustParsePrefix("203.0.113.0/24"), Action: ActionDeny}))
+	handler := limitHandler(rl, nil, keys.Header("X-API-Key"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	status := func(remoteAddr, apiKey string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	if code := status("192.0.2.1:1234", "alice"); code != http.StatusOK {
+		t.Errorf("Expected %d for alice but got %d", http.StatusOK, code)
+	}
+	if code := status("192.0.2.1:1234", "bob"); code != http.StatusOK {
+		t.Errorf("Expected %d for bob behind the same IP but got %d", http.StatusOK, code)
+	}
+	if code := status("192.0.2.2:1234", "alice"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected %d for alice from another IP but got %d", http.StatusTooManyRequests, code)
+	}
+	// Requests without a key fall back to the client IP
+	if code := status("192.0.2.1:1234", ""); code != http.StatusOK {
+		t.Errorf("Expected %d for the first unkeyed request but got %d", http.StatusOK, code)
+	}
+	// Denied networks stay denied whatever the key
+	if code := status("203.0.113.5:1234", "carol"); code != http.StatusForbidden {
+		t.Errorf("Expected %d for denied network but got %d", http.StatusForbidden, code)
+	}
+}
+
+// Test shadow network rules from the file format
+func TestParseCIDRRulesShadow(t *testing.T) {
+	m, err := ParseCIDRRules(strings.NewReader("limit 192.0.2.0/24 1 1 shadow"))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing rules: %v", err)
+	}
+
+	rl := NewRateLimiter(10, 10)
+	rl.SetNetworks(m)
+	for i := 0; i < 3; i++ {
+		if !rl.Allow("192.0.2.1") {
+			t.Fatalf("Expected shadow network rule to allow request %d", i+1)
+		}
+	}
+	if stats := rl.ShadowStats(); stats.WouldDeny != 2 {
+		t.Errorf("Expected 2 would-be denials but got %+v", stats)
+	}
+}
+
+// Test that network rules and the per-IP ceiling apply to requests keyed by API key
+func TestLimitHandlerAPIKeyNetworks(t *testing.T) {
+	networks := NewCIDRMatcher(
+		NetworkRule{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Action: ActionAllow},
+		NetworkRule{Prefix: netip.MustParsePrefix("198.51.100.0/24"), Action: ActionLimit, Rule: Rule{Rate: 1, Capacity: 1}},
+	)
+	rl := NewRateLimiter(1, 1)
+	rl.SetNetworks(networks)
+	ceiling := NewRateLimiter(1, 3)
+	ceiling.SetNetworks(networks)
+	handler := limitHandler(rl, ceiling, keys.Header("X-API-Key"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	status := func(remoteAddr, apiKey string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-API-Key", apiKey)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	// Allowed networks are exempt whatever the key
+	for i := 0; i < 5; i++ {
+		if code := status("10.0.0.1:1234", "alice"); code != http.StatusOK {
+			t.Fatalf("Expected %d for request %d from an allowed network but got %d", http.StatusOK, i+1, code)
+		}
+	}
+
+	// A network limit rule caps the IP over all its keys
+	if code := status("198.51.100.1:1234", "bob"); code != http.StatusOK {
+		t.Errorf("Expected %d for the first request from the limited network but got %d", http.StatusOK, code)
+	}
+	if code := status("198.51.100.1:1234", "carol"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected %d for another key from the limited network but got %d", http.StatusTooManyRequests, code)
+	}
+
+	// Made-up keys do not get around the ceiling of other IPs
+	for i, key := range []string{"k1", "k2", "k3"} {
+		if code := status("192.0.2.1:1234", key); code != http.StatusOK {
+			t.Fatalf("Expected %d for key %d within the ceiling but got %d", http.StatusOK, i+1, code)
+		}
+	}
+	if code := status("192.0.2.1:1234", "k4"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected %d for a new key over the ceiling but got %d", http.StatusTooManyRequests, code)
+	}
+}
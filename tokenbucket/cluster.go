@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nesyor/ratelimiter/internal/failover"
+)
+
+// defaultReplicas is the number of points each node gets on the hash ring.
+const defaultReplicas = 100
+
+// Ring assigns keys to nodes with consistent hashing, so adding or removing a node
+// only moves the keys that node gains or loses.
+type Ring struct {
+	replicas int
+	hashes   []uint32          // Sorted points on the ring.
+	owners   map[uint32]string // Node owning each point.
+	nodes    map[string]bool
+}
+
+// NewRing creates a ring with the given nodes and replicas points per node.
+// A replicas value of 0 or less uses a default suited to small clusters.
+func NewRing(replicas int, nodes ...string) *Ring {
+	if replicas <= 0 {
+		replicas = defaultReplicas
+	}
+	r := &Ring{
+		replicas: replicas,
+		owners:   make(map[uint32]string),
+		nodes:    make(map[string]bool),
+	}
+	for _, node := range nodes {
+		r.Add(node)
+	}
+	return r
+}
+
+// ringHash hashes s onto the ring. FNV alone clusters similar strings such as
+// neighbouring IPs, so its result is run through the murmur3 finalizer.
+func ringHash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+// Add places node on the ring. Adding a node twice has no effect.
+func (r *Ring) Add(node string) {
+	if r.nodes[node] {
+		return
+	}
+	r.nodes[node] = true
+	for i := 0; i < r.replicas; i++ {
+		point := ringHash(node + "#" + strconv.Itoa(i))
+		if _, taken := r.owners[point]; taken {
+			// Keep collisions deterministic regardless of insertion order.
+			if r.owners[point] < node {
+				continue
+			}
+		} else {
+			r.hashes = append(r.hashes, point)
+		}
+		r.owners[point] = node
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+}
+
+// Remove takes node off the ring.
+func (r *Ring) Remove(node string) {
+	if !r.nodes[node] {
+		return
+	}
+	delete(r.nodes, node)
+
+	// Rebuild from the remaining nodes so collided points go back to their other owner.
+	nodes := r.Nodes()
+	r.hashes = nil
+	r.owners = make(map[uint32]string)
+	r.nodes = make(map[string]bool)
+	for _, n := range nodes {
+		r.Add(n)
+	}
+}
+
+// Nodes returns the nodes on the ring in sorted order.
+func (r *Ring) Nodes() []string {
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// Owner returns the node that owns key, or "" if the ring is empty.
+func (r *Ring) Owner(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := ringHash(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+// allowResponse is the body of a forwarded decision.
+type allowResponse struct {
+	Allowed bool `json:"allowed"`
+}
+
+// Cluster shares one limit per key across several servers. Each key is owned by one
+// node on a consistent hash ring and only the owner keeps its token bucket; the
+// other nodes forward their decisions to the owner over HTTP.
+//
+// Nodes are identified by their base URL, e.g. "http://10.0.0.1:8080", and every node
+// serves Handler under /cluster/. Forwarded decisions carry a secret shared by all
+// nodes, so clients cannot spend other keys' requests by calling Handler themselves.
+//
+// Keys this node does not own only get a bucket here while their owner is unreachable.
+// The limiter forgets such buckets once they have refilled, like any other idle bucket.
+type Cluster struct {
+	self     string
+	secret   string
+	limiter  *RateLimiter
+	client   *http.Client
+	ring     *Ring
+	failover failover.Options
+	guards   map[string]*failover.Guard // Per peer, so one failing peer does not trip the others.
+	mu       sync.RWMutex
+}
+
+// NewCluster creates the cluster node self, sharing limits with peers. Nodes
+// authenticate forwarded decisions with secret, which must be the same on every node;
+// an empty secret rejects them all. Decisions for keys this node owns are made by
+// limiter. self is added to the ring if peers omits it. Until SetFailover is called,
+// decisions for keys whose owner cannot be reached are made by limiter as well.
+func NewCluster(self string, peers []string, secret string, limiter *RateLimiter) *Cluster {
+	c := &Cluster{
+		self:     self,
+		secret:   secret,
+		limiter:  limiter,
+		client:   &http.Client{Timeout: time.Second},
+		failover: failover.Options{Local: limiter.Allow},
+	}
+	c.SetPeers(peers)
+	return c
+}
+
+// SetFailover sets what happens to requests whose owner fails or times out.
+func (c *Cluster) SetFailover(opts failover.Options) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.failover = opts
+	c.guards = make(map[string]*failover.Guard)
+	for _, node := range c.ring.Nodes() {
+		c.guards[node] = failover.New(opts)
+	}
+}
+
+// FailoverStats returns the calls forwarded to the current peers and the fallbacks taken so far.
+func (c *Cluster) FailoverStats() failover.Stats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var total failover.Stats
+	for _, g := range c.guards {
+		s := g.Stats()
+		total.Calls += s.Calls
+		total.Failures += s.Failures
+		total.Timeouts += s.Timeouts
+		total.ShortCircuit += s.ShortCircuit
+		total.Fallbacks += s.Fallbacks
+		total.BreakerOpens += s.BreakerOpens
+	}
+	return total
+}
+
+// SetPeers replaces the cluster membership. Keys move to their new owners, and this
+// node drops the buckets of keys it no longer owns; their new owners start them afresh.
+func (c *Cluster) SetPeers(peers []string) {
+	ring := NewRing(defaultReplicas, peers...)
+	ring.Add(c.self)
+
+	c.mu.Lock()
+	c.ring = ring
+	guards := make(map[string]*failover.Guard)
+	for _, node := range ring.Nodes() {
+		// Peers that stay in the cluster keep their breaker state.
+		if g, ok := c.guards[node]; ok {
+			guards[node] = g
+		} else {
+			guards[node] = failover.New(c.failover)
+		}
+	}
+	c.guards = guards
+	c.mu.Unlock()
+
+	c.limiter.forget(func(ip string) bool { return ring.Owner(ip) != c.self })
+}
+
+// Owner returns the node that owns ip.
+func (c *Cluster) Owner(ip string) string {
+	owner, _ := c.route(ip)
+	return owner
+}
+
+// route returns the node that owns ip and the guard for calls to it.
+func (c *Cluster) route(ip string) (string, *failover.Guard) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	owner := c.ring.Owner(ip)
+	return owner, c.guards[owner]
+}
+
+// Network returns the action of the network rule covering the given IP. Network rules
+// are configured on every node, so this is always answered locally.
+func (c *Cluster) Network(ip string) Action {
+	return c.limiter.Network(ip)
+}
+
+// Allow asks the owner of ip whether a request from it is allowed. If the owner
+// cannot be reached the failover policy decides.
+func (c *Cluster) Allow(ip string) bool {
+	owner, guard := c.route(ip)
+	if owner == c.self {
+		return c.limiter.Allow(ip)
+	}
+
+	return guard.Allow(ip, func(ctx context.Context) (bool, error) {
+		return c.forward(ctx, owner, ip)
+	})
+}
+
+// forward asks owner for the decision on ip, giving up when ctx is done.
+func (c *Cluster) forward(ctx context.Context, owner, ip string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, owner+"/cluster/allow?key="+url.QueryEscape(ip), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.secret)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s answered %s", owner, resp.Status)
+	}
+	var body allowResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return false, fmt.Errorf("decode answer from %s: %w", owner, err)
+	}
+	return body.Allowed, nil
+}
+
+// Handler serves the decisions forwarded by other nodes at POST /allow?key=<ip>.
+// Mount it under /cluster/ with http.StripPrefix. Requests without the cluster secret
+// as their bearer token are rejected. Forwarded requests are always decided locally,
+// so nodes that briefly disagree about membership cannot loop.
+func (c *Cluster) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "missing or invalid cluster secret", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/allow" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ip := r.URL.Query().Get("key")
+		if ip == "" {
+			http.Error(w, "missing key", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(allowResponse{Allowed: c.limiter.Allow(ip)})
+	})
+}
+
+// authorized checks the request's bearer token against the cluster secret in constant time.
+func (c *Cluster) authorized(r *http.Request) bool {
+	given, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return found && c.secret != "" && subtle.ConstantTimeCompare([]byte(given), []byte(c.secret)) == 1
+}
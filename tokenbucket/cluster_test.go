@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nesyor/ratelimiter/internal/failover"
+)
+
+func TestRingOwner(t *testing.T) {
+	nodes := []string{"http://a", "http://b", "http://c"}
+	r1 := NewRing(0, nodes...)
+	r2 := NewRing(0, nodes[2], nodes[0], nodes[1])
+
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		owner := r1.Owner(key)
+		if owner != r2.Owner(key) {
+			t.Fatalf("expected ownership of %s not to depend on insertion order", key)
+		}
+		counts[owner]++
+	}
+	for _, node := range nodes {
+		// Each node should own a reasonable share of the keys.
+		if counts[node] < 500 {
+			t.Errorf("expected %s to own a fair share of keys but got %d", node, counts[node])
+		}
+	}
+
+	if NewRing(0).Owner("10.0.0.1") != "" {
+		t.Error("expected an empty ring to have no owner")
+	}
+}
+
+func TestRingRebalance(t *testing.T) {
+	r := NewRing(0, "http://a", "http://b", "http://c")
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		before[key] = r.Owner(key)
+	}
+
+	// Removing a node only moves the keys it owned.
+	r.Remove("http://b")
+	for key, owner := range before {
+		now := r.Owner(key)
+		if owner == "http://b" && now == "http://b" {
+			t.Fatalf("expected %s to move off the removed node", key)
+		}
+		if owner != "http://b" && now != owner {
+			t.Fatalf("expected %s to stay on %s but it moved to %s", key, owner, now)
+		}
+	}
+
+	// Adding it back restores the original ownership.
+	r.Add("http://b")
+	for key, owner := range before {
+		if r.Owner(key) != owner {
+			t.Fatalf("expected %s to return to %s", key, owner)
+		}
+	}
+}
+
+// startNodes starts n in-process cluster nodes on localhost, each allowing capacity requests per key.
+func startNodes(t *testing.T, n, capacity int) []*Cluster {
+	servers := make([]*httptest.Server, n)
+	muxes := make([]*http.ServeMux, n)
+	urls := make([]string, n)
+	for i := range servers {
+		muxes[i] = http.NewServeMux()
+		servers[i] = httptest.NewServer(muxes[i])
+		urls[i] = servers[i].URL
+		t.Cleanup(servers[i].Close)
+	}
+
+	nodes := make([]*Cluster, n)
+	for i := range nodes {
+		// A rate of 0 never refills, which keeps the counts exact.
+		nodes[i] = NewCluster(urls[i], urls, "secret", NewRateLimiter(0, capacity))
+		muxes[i].Handle("/cluster/", http.StripPrefix("/cluster", nodes[i].Handler()))
+	}
+	return nodes
+}
+
+func TestClusterSharedLimit(t *testing.T) {
+	nodes := startNodes(t, 3, 5)
+
+	for _, ip := range []string{"192.168.1.1", "192.168.1.2", "10.1.2.3"} {
+		// Spread the requests over every node; together they only get one bucket.
+		allowed := 0
+		for i := 0; i < 15; i++ {
+			if nodes[i%len(nodes)].Allow(ip) {
+				allowed++
+			}
+		}
+		if allowed != 5 {
+			t.Errorf("expected 5 requests from %s allowed across the cluster but got %d", ip, allowed)
+		}
+
+		// Only the owner keeps a bucket for the key.
+		for _, node := range nodes {
+			_, err := node.limiter.State(ip)
+			if owns := node.Owner(ip) == node.self; owns != (err == nil) {
+				t.Errorf("expected only the owner of %s to track it, %s owns: %v, tracks: %v", ip, node.self, owns, err == nil)
+			}
+		}
+	}
+}
+
+func TestClusterMembershipChange(t *testing.T) {
+	nodes := startNodes(t, 3, 1)
+
+	// Find a key owned by the last node and use up its bucket.
+	var ip string
+	for i := 0; ; i++ {
+		ip = fmt.Sprintf("10.0.0.%d", i)
+		if nodes[0].Owner(ip) == nodes[2].self {
+			break
+		}
+	}
+	nodes[0].Allow(ip)
+	if nodes[1].Allow(ip) {
+		t.Fatal("expected the shared bucket to be empty")
+	}
+
+	// Drop the last node from the cluster; the key moves to a surviving node.
+	survivors := []string{nodes[0].self, nodes[1].self}
+	nodes[0].SetPeers(survivors)
+	nodes[1].SetPeers(survivors)
+	owner := nodes[0].Owner(ip)
+	if owner == nodes[2].self || owner != nodes[1].Owner(ip) {
+		t.Fatalf("expected the survivors to agree on a new owner but got %q", owner)
+	}
+
+	// The new owner starts the key with a fresh bucket.
+	if !nodes[0].Allow(ip) {
+		t.Error("expected the new owner to allow the first request")
+	}
+	if nodes[1].Allow(ip) {
+		t.Error("expected the new owner's bucket to be shared by the survivors")
+	}
+}
+
+func TestClusterUnreachableOwner(t *testing.T) {
+	// The peer listens on a port nothing is bound to.
+	node := NewCluster("http://127.0.0.1:8080", []string{"http://127.0.0.1:1"}, "secret", NewRateLimiter(0, 1))
+
+	var ip string
+	for i := 0; ; i++ {
+		ip = fmt.Sprintf("10.0.0.%d", i)
+		if node.Owner(ip) != node.self {
+			break
+		}
+	}
+
+	// The decision falls back to the local bucket.
+	if !node.Allow(ip) {
+		t.Error("expected the local bucket to allow the first request")
+	}
+	if node.Allow(ip) {
+		t.Error("expected the local bucket to deny the second request")
+	}
+}
+
+func TestClusterFailOpen(t *testing.T) {
+	node := NewCluster("http://127.0.0.1:8080", []string{"http://127.0.0.1:1"}, "secret", NewRateLimiter(0, 1))
+	node.SetFailover(failover.Options{Policy: failover.FailOpen})
+
+	var ip string
+	for i := 0; ; i++ {
+		ip = fmt.Sprintf("10.0.0.%d", i)
+		if node.Owner(ip) != node.self {
+			break
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if !node.Allow(ip) {
+			t.Fatal("expected requests to be allowed while their owner is down")
+		}
+	}
+	if s := node.FailoverStats(); s.Failures != 3 || s.Fallbacks != 3 {
+		t.Errorf("expected every call to fail over but got %+v", s)
+	}
+}
+
+func TestClusterHandlerRequiresSecret(t *testing.T) {
+	node := NewCluster("http://127.0.0.1:8080", nil, "secret", NewRateLimiter(0, 1))
+
+	for auth, expected := range map[string]int{
+		"":               http.StatusUnauthorized,
+		"Bearer wrong":   http.StatusUnauthorized,
+		"Bearer secret":  http.StatusOK,
+		"Basic c2VjcmV0": http.StatusUnauthorized,
+	} {
+		req := httptest.NewRequest("POST", "/allow?key=10.0.0.1", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		recorder := httptest.NewRecorder()
+		node.Handler().ServeHTTP(recorder, req)
+		if recorder.Code != expected {
+			t.Errorf("expected %d for authorization %q but got %d", expected, auth, recorder.Code)
+		}
+	}
+
+	// Only the authorized request used up the key's bucket.
+	if node.limiter.Allow("10.0.0.1") {
+		t.Error("expected only the authorized request to be counted")
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nesyor/ratelimiter/internal/conformance"
+)
+
+// Test the rate limiter against the conformance suite, including concurrent use
+func TestRateLimiterConformance(t *testing.T) {
+	spec := conformance.Spec{Burst: 10, Rate: 5, Model: conformance.TokenBucket(5, 10)}
+	conformance.Run(t, spec, func(clock *conformance.Clock) conformance.Limiter {
+		rl := NewRateLimiter(5, 10)
+		rl.now = clock.Now
+		return rl
+	})
+}
+
+// Test a rate that does not divide a second evenly
+func TestRateLimiterConformanceUnevenRate(t *testing.T) {
+	spec := conformance.Spec{Burst: 4, Rate: 3, Model: conformance.TokenBucket(3, 4)}
+	conformance.Run(t, spec, func(clock *conformance.Clock) conformance.Limiter {
+		rl := NewRateLimiter(3, 4)
+		rl.now = clock.Now
+		return rl
+	})
+}
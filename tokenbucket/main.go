@@ -1,29 +1,47 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
+
+	"github.com/nesyor/ratelimiter/internal/admin"
+	"github.com/nesyor/ratelimiter/internal/audit"
+	"github.com/nesyor/ratelimiter/internal/failover"
+	"github.com/nesyor/ratelimiter/internal/keys"
+	"github.com/nesyor/ratelimiter/internal/netlimit"
+	"github.com/nesyor/ratelimiter/internal/redis"
+	"github.com/nesyor/ratelimiter/internal/shape"
+	"github.com/nesyor/ratelimiter/internal/topk"
 )
 
 // TokenBucket struct represents a token bucket for rate limiting.
 type TokenBucket struct {
-	rate       int        // Number of tokens added per second.
-	capacity   int        // Maximum number of tokens the bucket can hold.
-	tokens     int        // Current number of tokens in the bucket.
-	lastRefill time.Time  // The last time tokens were added to the bucket.
-	mu         sync.Mutex // Mutex for synchronizing concurrent access to the bucket.
+	rate       int              // Number of tokens added per second.
+	capacity   int              // Maximum number of tokens the bucket can hold.
+	tokens     int              // Current number of tokens in the bucket.
+	lastRefill time.Time        // The time the bucket's tokens were last brought up to date.
+	now        func() time.Time // Clock the bucket refills by.
+	mu         sync.Mutex       // Mutex for synchronizing concurrent access to the bucket.
 }
 
-// newTokenBucket initializes a new token bucket with a given rate and capacity.
-func newTokenBucket(rate, capacity int) *TokenBucket {
+// newTokenBucket initializes a new token bucket with a given rate and capacity, refilling it by now.
+func newTokenBucket(rate, capacity int, now func() time.Time) *TokenBucket {
 	return &TokenBucket{
 		rate:       rate,
 		capacity:   capacity,
 		tokens:     capacity,
-		lastRefill: time.Now(),
+		lastRefill: now(),
+		now:        now,
 	}
 }
 
@@ -35,19 +53,64 @@ func (tb *TokenBucket) Refill() {
 	tb.refillInternal()
 }
 
-// Internal Refill to avoid dedalocks
+// Internal Refill to avoid dedalocks. Only whole tokens are added, and the time spent
+// towards the next one carries over to the next refill. While the bucket is full no
+// time carries over, since a full bucket cannot hold the token it would earn.
 func (tb *TokenBucket) refillInternal() {
+	now := tb.now()
+	if tb.rate <= 0 || tb.tokens >= tb.capacity {
+		// A full bucket saves up nothing for later.
+		tb.lastRefill = now
+		return
+	}
+
 	// Calculate time elapsed since the last refill.
-	elapsed := time.Since(tb.lastRefill).Seconds()
+	elapsed := now.Sub(tb.lastRefill)
+	if elapsed < 0 {
+		// The clock went back, e.g. after an NTP correction. Nothing was earned, and
+		// refilling carries on from now rather than once the clock catches up again.
+		tb.lastRefill = now
+		return
+	}
+	if untilFull := time.Duration(tb.capacity-tb.tokens) * time.Second / time.Duration(tb.rate); elapsed >= untilFull {
+		tb.tokens = tb.capacity
+		tb.lastRefill = now
+		return
+	}
 
-	// Compute the number of tokens to add based on the elapsed time.
-	newTokens := int(elapsed * float64(tb.rate))
+	// Compute the number of whole tokens earned, and move the last refill time forward by
+	// exactly the time they took, so the time spent towards the next token is not lost.
+	newTokens := int64(elapsed) * int64(tb.rate) / int64(time.Second)
+	tb.tokens += int(newTokens)
+	tb.lastRefill = tb.lastRefill.Add(time.Duration(newTokens * int64(time.Second) / int64(tb.rate)))
+}
 
-	// Ensure the total tokens don't exceed the bucket's capacity.
-	tb.tokens = min(tb.tokens+newTokens, tb.capacity)
+// configure changes the bucket's rate and capacity, keeping the tokens it already has up to the new capacity.
+func (tb *TokenBucket) configure(rate, capacity int) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
 
-	// Update the last refill time to the current time.
-	tb.lastRefill = time.Now()
+	tb.refillInternal()
+	tb.rate = rate
+	tb.capacity = capacity
+	tb.tokens = min(tb.tokens, capacity)
+}
+
+// full reports whether the bucket has refilled completely, so that it behaves like a new one.
+func (tb *TokenBucket) full() bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refillInternal()
+	return tb.tokens >= tb.capacity
+}
+
+// remaining returns the number of tokens currently in the bucket.
+func (tb *TokenBucket) remaining() int {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	return tb.tokens
 }
 
 // Allow checks if a token can be consumed and consumes one if available.
@@ -66,59 +129,483 @@ func (tb *TokenBucket) Allow() bool {
 	return false
 }
 
+// pruneInterval is how often a RateLimiter looks for buckets it can forget.
+const pruneInterval = time.Minute
+
 // RateLimiter holds a map of IP addresses to their respective token buckets.
+// Buckets that have refilled completely are forgotten, as a request would get a
+// full bucket anyway, so keys that stop making requests do not use memory forever.
 type RateLimiter struct {
-	rate     int
-	capacity int
-	buckets  map[string]*TokenBucket
-	mu       sync.Mutex
+	audit.Sink    // Optional log of decisions, see SetAuditHandler.
+	admin.TopKeys // Optional tracker of the busiest keys, see SetTopK.
+
+	rate      int
+	capacity  int
+	shadow    bool // Whether the default rule only records would-be denials.
+	buckets   map[string]*TokenBucket
+	networks  *CIDRMatcher // Optional network rules consulted before the per-IP buckets.
+	plans     *Plans       // Optional plans giving keys their own rate and capacity.
+	stats     ShadowStats
+	overrides map[string]Rule // Per-key rules set through the admin API.
+	credits   admin.Credits   // Extra requests granted through the admin API.
+	lastPrune time.Time       // When full buckets were last removed.
+	now       func() time.Time
+	mu        sync.Mutex
 }
 
 // NewRateLimiter initializes a new rate limiter with the given rate and capacity.
 func NewRateLimiter(rate, capacity int) *RateLimiter {
 	return &RateLimiter{
-		rate:     rate,
-		capacity: capacity,
-		buckets:  make(map[string]*TokenBucket),
+		rate:      rate,
+		capacity:  capacity,
+		buckets:   make(map[string]*TokenBucket),
+		overrides: make(map[string]Rule),
+		now:       time.Now,
+	}
+}
+
+// SetNetworks makes the limiter consult the network rules in m before the per-IP buckets.
+// Requests from allowed networks are never limited, requests from denied networks are always
+// rejected and other matching networks use their rule's rate and capacity. A nil m removes all rules.
+func (rl *RateLimiter) SetNetworks(m *CIDRMatcher) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.networks = m
+}
+
+// SetPlans gives keys the rate and capacity of their plan. Plans take precedence over
+// network limit rules, and the default plan replaces the limiter's own rate and
+// capacity. Existing buckets switch to the new parameters on their next request, so
+// plans can be reloaded at any time. A nil p removes all plans.
+func (rl *RateLimiter) SetPlans(p *Plans) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.plans = p
+}
+
+// SetShadow puts the default rule in shadow mode: requests are still counted against their
+// buckets and would-be denials are recorded, but every request is allowed.
+func (rl *RateLimiter) SetShadow(shadow bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.shadow = shadow
+}
+
+// ShadowStats counts the decisions made by rules in shadow mode.
+type ShadowStats struct {
+	Evaluated uint64 // Requests checked against a shadow rule.
+	WouldDeny uint64 // Requests a shadow rule would have denied.
+}
+
+// ShadowStats returns the decisions recorded by rules in shadow mode so far.
+func (rl *RateLimiter) ShadowStats() ShadowStats {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	return rl.stats
+}
+
+// Network returns the action of the network rule covering the given IP: ActionDeny for
+// denied networks, ActionAllow for exempt ones and ActionLimit for all others.
+func (rl *RateLimiter) Network(ip string) Action {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.networks == nil {
+		return ActionLimit
+	}
+	rule, ok := rl.networks.LookupString(ip)
+	if !ok {
+		return ActionLimit
+	}
+	return rule.Action
+}
+
+// forget drops the token buckets of the IPs for which drop returns true.
+func (rl *RateLimiter) forget(drop func(ip string) bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	for ip := range rl.buckets {
+		if drop(ip) {
+			delete(rl.buckets, ip)
+		}
+	}
+}
+
+// prune removes buckets that have refilled completely, at most once per pruneInterval.
+// The caller must hold rl.mu.
+func (rl *RateLimiter) prune() {
+	now := rl.now()
+	if now.Sub(rl.lastPrune) < pruneInterval {
+		return
+	}
+	rl.lastPrune = now
+
+	for ip, bucket := range rl.buckets {
+		if bucket.full() {
+			delete(rl.buckets, ip)
+		}
 	}
 }
 
 // Allow checks if a request from the given IP is allowed based on its token bucket.
 func (rl *RateLimiter) Allow(ip string) bool {
+	logger := rl.AuditLogger()
+	allowed, record := rl.decide(ip, logger != nil)
+	if record != nil {
+		// Logged after rl.mu is released, since the handler may do I/O.
+		logger.Log(*record)
+	}
+	return allowed
+}
+
+// decide makes the decision for Allow, describing it in a record if audited.
+func (rl *RateLimiter) decide(ip string, audited bool) (bool, *audit.Record) {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
+	rule, ruleName, action := rl.resolve(ip)
+	if action != ActionLimit {
+		return rl.decideNetwork(ip, ruleName, action, audited)
+	}
+
 	// Get the token bucket for the provided IP.
+	rl.prune()
 	bucket, exists := rl.buckets[ip]
 
 	// If no bucket exists for this IP, create one.
 	if !exists {
-		bucket = newTokenBucket(rl.rate, rl.capacity)
+		bucket = newTokenBucket(rule.Rate, rule.Capacity, rl.now)
 		rl.buckets[ip] = bucket
+	} else if bucket.rate != rule.Rate || bucket.capacity != rule.Capacity {
+		// The network rules changed since the bucket was created.
+		bucket.configure(rule.Rate, rule.Capacity)
 	}
 
 	// Check if the IP's bucket allows the request.
-	return bucket.Allow()
+	allowed := bucket.Allow()
+	var retryAfter time.Duration
+	if !allowed && rule.Rate > 0 {
+		// A new token arrives every 1/rate seconds.
+		retryAfter = time.Second / time.Duration(rule.Rate)
+	}
+	return rl.settle(ip, rule, ruleName, allowed, float64(bucket.remaining()), retryAfter, audited)
 }
 
-func main() {
-	limiter := NewRateLimiter(2, 5)
+// resolve returns the rule that applies to ip and its name in audit records. Requests
+// from networks with an allow or deny rule are decided by that action alone; for all
+// others the action is ActionLimit. The caller must hold rl.mu.
+func (rl *RateLimiter) resolve(ip string) (Rule, string, Action) {
+	// Network rules take precedence over the default rate and capacity, which come
+	// from the default plan if there is one.
+	rule := Rule{Rate: rl.rate, Capacity: rl.capacity, Shadow: rl.shadow}
+	ruleName := "default"
+	if rl.plans != nil {
+		if plan, ok := rl.plans.Default(); ok {
+			rule = Rule{Rate: plan.Rule.Rate, Capacity: plan.Rule.Capacity, Shadow: rl.shadow}
+			ruleName = "plan " + plan.Name
+		}
+	}
+	if rl.networks != nil {
+		if network, ok := rl.networks.LookupString(ip); ok {
+			ruleName = network.Prefix.String()
+			if network.Action != ActionLimit {
+				return Rule{}, ruleName, network.Action
+			}
+			rule = network.Rule
+		}
+	}
+
+	// A key's own plan takes precedence over network limit rules.
+	if rl.plans != nil {
+		if plan, ok := rl.plans.Lookup(ip); ok {
+			rule = Rule{Rate: plan.Rule.Rate, Capacity: plan.Rule.Capacity, Shadow: rl.shadow}
+			ruleName = "plan " + plan.Name
+		}
+	}
+
+	// Per-key overrides set through the admin API take precedence over everything else.
+	if override, ok := rl.overrides[ip]; ok {
+		rule = override
+		ruleName = "override"
+	}
+	return rule, ruleName, ActionLimit
+}
+
+// decideNetwork decides a request from a network with an allow or deny rule, describing
+// it in a record if audited. The caller must hold rl.mu.
+func (rl *RateLimiter) decideNetwork(ip, ruleName string, action Action, audited bool) (bool, *audit.Record) {
+	allowed := action == ActionAllow
+	rl.RecordTop(ip, allowed)
+	if !audited {
+		return allowed, nil
+	}
+	if allowed {
+		return true, &audit.Record{Key: ip, Rule: "allow " + ruleName, Algorithm: "tokenbucket", Allowed: true}
+	}
+	return false, &audit.Record{Key: ip, Rule: "deny " + ruleName, Algorithm: "tokenbucket"}
+}
+
+// settle completes a bucket's decision on a request from ip: credit covers denied
+// requests and shadow rules allow them, and the outcome is recorded and described in a
+// record if audited. The caller must hold rl.mu.
+func (rl *RateLimiter) settle(ip string, rule Rule, ruleName string, allowed bool, remaining float64, retryAfter time.Duration, audited bool) (bool, *audit.Record) {
+	if !allowed && !rule.Shadow && rl.credits.Take(ip) {
+		// Credit granted through the admin API covers the request.
+		allowed = true
+	}
+	rl.RecordTop(ip, allowed || rule.Shadow)
+
+	var record *audit.Record
+	if audited {
+		record = &audit.Record{
+			Key:       ip,
+			Rule:      fmt.Sprintf("%s %d/s burst %d", ruleName, rule.Rate, rule.Capacity),
+			Algorithm: "tokenbucket",
+			Allowed:   allowed || rule.Shadow,
+			Shadow:    !allowed && rule.Shadow,
+			Remaining: remaining,
+			Cost:      1,
+		}
+		if !allowed {
+			record.RetryAfter = retryAfter
+		}
+	}
+
+	if rule.Shadow {
+		// In shadow mode the decision is only counted and audited, never enforced.
+		rl.stats.Evaluated++
+		if !allowed {
+			rl.stats.WouldDeny++
+		}
+		return true, record
+	}
+	return allowed, record
+}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+// decider makes rate limiting decisions, locally with a RateLimiter, across a Cluster
+// or with buckets shared through Redis.
+type decider interface {
+	Allow(ip string) bool
+	Network(ip string) Action
+}
+
+// limitHandler rate limits requests to next by the key from extract, or by client IP
+// if it finds none. Network rules always apply to the client IP whatever the key:
+// denied networks are rejected and allowed networks are never limited. Requests keyed
+// by something else also count against the client IP's bucket in ceiling, if it is not
+// nil, so that clients cannot get around the per-IP limit by making up keys.
+func limitHandler(limiter decider, ceiling *RateLimiter, extract keys.Extractor, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Extract the client's IP address from the request.
 		ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+		key := keys.Key(extract, r)
 
-		// Use the rate limiter to decide if the request should be allowed.
-		if limiter.Allow(ip) {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("Hello, World!"))
-		} else {
+		tooMany := func() {
 			w.WriteHeader(http.StatusTooManyRequests)
 			w.Write([]byte("Too Many Requests!"))
 		}
+		switch action := limiter.Network(ip); {
+		case action == ActionDeny:
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Forbidden!"))
+			return
+		case action == ActionAllow:
+			// Decided by the network rule, which only matches the client IP.
+			key = ip
+		case key != ip && ceiling != nil && !ceiling.Allow(ip):
+			tooMany()
+			return
+		}
+
+		// Use the rate limiter to decide if the request should be allowed.
+		if !limiter.Allow(key) {
+			tooMany()
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func main() {
+	networksFile := flag.String("networks", "", "file with allow, deny and limit rules per network")
+	plansFile := flag.String("plans", "", "JSON or CSV file assigning keys to plans with their own rate and capacity; reloaded on SIGHUP")
+	shadow := flag.Bool("shadow", false, "only log requests that would be denied instead of denying them")
+	adminToken := flag.String("admin-token", os.Getenv("RATELIMIT_ADMIN_TOKEN"), "bearer token for the admin API under /admin/; empty disables it")
+	addr := flag.String("addr", ":8080", "address to listen on")
+	self := flag.String("cluster-self", "", "base URL other cluster nodes reach this server at, e.g. http://10.0.0.1:8080")
+	peers := flag.String("cluster-peers", "", "comma separated base URLs of the other cluster nodes")
+	clusterSecret := flag.String("cluster-secret", os.Getenv("RATELIMIT_CLUSTER_SECRET"), "secret shared by all cluster nodes to authenticate forwarded decisions")
+	redisAddr := flag.String("redis", "", "address of a Redis server to share buckets through, e.g. localhost:6379")
+	failPolicy := flag.String("fail-policy", "local", "what to do when Redis or a cluster peer fails: open, closed or local")
+	failScale := flag.Float64("fail-scale", 0.5, "fraction of the rate and capacity the local fallback limiter gets")
+	failTimeout := flag.Duration("fail-timeout", 500*time.Millisecond, "how long to wait for Redis or a cluster peer")
+	breakerThreshold := flag.Int("breaker-threshold", 5, "consecutive failures that stop calls to Redis or a peer; 0 disables the breaker")
+	breakerCooldown := flag.Duration("breaker-cooldown", 10*time.Second, "how long calls stay stopped before a retry")
+	connRate := flag.Int("conn-rate", 0, "new connections per second allowed per IP; 0 disables the limit")
+	maxConns := flag.Int("max-conns", 0, "open connections allowed per IP; 0 disables the cap")
+	bandwidth := flag.Int("bandwidth", 0, "bytes per second allowed per response body; 0 disables shaping")
+	totalBandwidth := flag.Int("total-bandwidth", 0, "bytes per second allowed for all response bodies together, with -bandwidth")
+	topKeys := flag.Int("top-keys", 10, "busiest keys to report at /admin/top, with -admin-token; 0 disables tracking")
+	topPeriod := flag.Duration("top-period", 5*time.Minute, "period the busiest keys are reported over")
+	keySpec := flag.String("key", "ip", "what to limit requests by, e.g. header:X-API-Key, jwt:tenant+route or cookie:session; falls back to the client IP")
+	ipCeiling := flag.Int("ip-ceiling", 20, "requests per second allowed per client IP over all the keys it sends, with -key; network limit rules replace it; 0 disables the ceiling")
+	jwtSecret := flag.String("jwt-secret", os.Getenv("RATELIMIT_JWT_SECRET"), "HS256 secret to verify tokens keyed by with -key jwt:<claim>; empty trusts them unverified")
+	flag.Parse()
+
+	var secret []byte
+	if *jwtSecret != "" {
+		secret = []byte(*jwtSecret)
+	}
+	extract, err := keys.Parse(*keySpec, secret)
+	if err != nil {
+		fmt.Println("Invalid -key:", err)
+		return
+	}
+
+	limiter := NewRateLimiter(2, 5)
+	limiter.SetShadow(*shadow)
+
+	// Each replica falls back on its own, so the fallback limiter gets a share of the limit.
+	fallback := NewRateLimiter(max(int(2**failScale), 1), max(int(5**failScale), 1))
+	fallback.SetShadow(*shadow)
+
+	if *shadow {
+		// Log would-be denials, and none of the allowed requests, to the standard logger.
+		limiter.SetAuditHandler(slog.Default().Handler(), 0)
+		fallback.SetAuditHandler(slog.Default().Handler(), 0)
+	}
+
+	// Requests keyed by something other than the client IP are capped per IP as well.
+	var ceiling *RateLimiter
+	if *ipCeiling > 0 {
+		ceiling = NewRateLimiter(*ipCeiling, *ipCeiling)
+	}
+
+	if *networksFile != "" {
+		networks, err := LoadCIDRFile(*networksFile)
+		if err != nil {
+			fmt.Println("Failed to load network rules:", err)
+			return
+		}
+		limiter.SetNetworks(networks)
+		fallback.SetNetworks(networks)
+		if ceiling != nil {
+			ceiling.SetNetworks(networks)
+		}
+	}
+
+	if *plansFile != "" {
+		plans, err := LoadPlansFile(*plansFile)
+		if err != nil {
+			fmt.Println("Failed to load plans:", err)
+			return
+		}
+		// The fallback limiter gets the same share of every plan as of the default rule.
+		setPlans := func(plans *Plans) {
+			limiter.SetPlans(plans)
+			fallback.SetPlans(plans.Scale(*failScale))
+		}
+		setPlans(plans)
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go reloadPlans(*plansFile, setPlans, hup)
+	}
+
+	policy, err := failover.ParsePolicy(*failPolicy)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	failoverOptions := failover.Options{
+		Policy:           policy,
+		Local:            fallback.Allow,
+		Timeout:          *failTimeout,
+		FailureThreshold: *breakerThreshold,
+		Cooldown:         *breakerCooldown,
+	}
+
+	var decisions decider = limiter
+	var failoverStats func() failover.Stats
+	switch {
+	case *redisAddr != "" && *self != "":
+		fmt.Println("Use either -redis or -cluster-self, not both")
+		return
+	case *redisAddr != "":
+		rl := NewRedisLimiter(redis.NewClient(*redisAddr, time.Second), limiter)
+		rl.SetFailover(failoverOptions)
+		failoverStats = rl.FailoverStats
+		decisions = rl
+	case *self != "" && *clusterSecret == "":
+		fmt.Println("Set -cluster-secret to the same secret on every cluster node")
+		return
+	case *self != "":
+		var peerList []string
+		if *peers != "" {
+			peerList = strings.Split(*peers, ",")
+		}
+		cluster := NewCluster(*self, peerList, *clusterSecret, limiter)
+		cluster.SetFailover(failoverOptions)
+		failoverStats = cluster.FailoverStats
+		http.Handle("/cluster/", http.StripPrefix("/cluster", cluster.Handler()))
+		decisions = cluster
+	}
+
+	var hello http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Hello, World!"))
 	})
+	if *bandwidth != 0 || *totalBandwidth != 0 {
+		var shared *shape.Bucket
+		if *totalBandwidth != 0 {
+			if shared, err = shape.NewBucket(float64(*totalBandwidth), *totalBandwidth); err != nil {
+				fmt.Println("Invalid -total-bandwidth:", err)
+				return
+			}
+		}
+		// Allow a second's worth of bytes at once.
+		if hello, err = shape.Handler(float64(*bandwidth), *bandwidth, shared, hello); err != nil {
+			fmt.Println("Invalid -bandwidth:", err)
+			return
+		}
+	}
+	http.Handle("/", limitHandler(decisions, ceiling, extract, hello))
+
+	if *adminToken != "" {
+		if *topKeys > 0 {
+			limiter.SetTopK(topk.New(*topKeys, *topPeriod))
+		}
+		http.Handle("/admin/", http.StripPrefix("/admin", admin.Handler(limiter, *adminToken)))
+		if failoverStats != nil {
+			// Calls to Redis or the cluster peers and the fallbacks taken.
+			http.Handle("/admin/failover", admin.RequireToken(*adminToken, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(failoverStats())
+			})))
+		}
+	}
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fmt.Println("Failed to listen:", err)
+		return
+	}
+	if *connRate > 0 || *maxConns > 0 {
+		opts := netlimit.Options{MaxConns: *maxConns}
+		if *connRate > 0 {
+			// Connections get their own token buckets, separate from the request limits.
+			opts.Rate = NewRateLimiter(*connRate, *connRate)
+		}
+		ln = netlimit.NewListener(ln, opts)
+	}
 
-	// Start the web server on port 8080.
-	fmt.Println("Server started on :8080")
-	http.ListenAndServe(":8080", nil)
+	// Start the web server, on port 8080 by default.
+	fmt.Println("Server started on", *addr)
+	http.Serve(ln, nil)
 }
@@ -3,15 +3,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/nesyor/ratelimiter/internal/conformance"
 )
 
 // Test the behavior of the TokenBucket
 func TestTokenBucket(t *testing.T) {
 	fmt.Println("Starting TestTokenBucket")
-	tb := newTokenBucket(1, 5)
+	tb := newTokenBucket(1, 5, time.Now)
 
 	fmt.Println("Checking first Allow()")
 	if tb.Allow() == false {
@@ -37,6 +46,60 @@ func TestTokenBucket(t *testing.T) {
 	fmt.Println("Finished TestTokenBucket")
 }
 
+// Test that time towards the next token carries over between refills, but not while
+// the bucket is full
+func TestTokenBucketRefill(t *testing.T) {
+	clock := conformance.NewClock()
+	tb := newTokenBucket(2, 5, clock.Now) // A token every 500ms.
+
+	// Time spent full earns nothing: 400ms after emptying the bucket there is no token.
+	clock.Advance(400 * time.Millisecond)
+	for tb.Allow() {
+	}
+	clock.Advance(400 * time.Millisecond)
+	if tb.Allow() {
+		t.Fatal("Expected no token 400ms after the bucket was emptied")
+	}
+
+	// The 100ms beyond the first token count towards the second.
+	clock.Advance(200 * time.Millisecond)
+	if !tb.Allow() {
+		t.Fatal("Expected a token 600ms after the bucket was emptied")
+	}
+	clock.Advance(400 * time.Millisecond)
+	if !tb.Allow() {
+		t.Fatal("Expected a second token 1s after the bucket was emptied")
+	}
+	if tb.Allow() {
+		t.Fatal("Expected no more tokens after the second")
+	}
+}
+
+// Test that the clock going back neither takes tokens away nor stops the refill
+func TestTokenBucketClockGoesBack(t *testing.T) {
+	clock := conformance.NewClock()
+	tb := newTokenBucket(5, 10, clock.Now)
+	for tb.Allow() {
+	}
+
+	// Half a token is earned, then the clock goes back an hour.
+	clock.Advance(100 * time.Millisecond)
+	tb.Refill()
+	clock.Advance(-time.Hour)
+	if tb.Allow() {
+		t.Fatal("expected request to be denied after the clock went back")
+	}
+	if tokens := tb.remaining(); tokens != 0 {
+		t.Fatalf("expected no tokens after the clock went back but got %d", tokens)
+	}
+
+	// Refilling carries on from the new time rather than from an hour later.
+	clock.Advance(200 * time.Millisecond)
+	if !tb.Allow() {
+		t.Fatal("expected a token to be earned 200ms after the clock went back")
+	}
+}
+
 // Test the behavior of the RateLimiter for distinct IPs
 func TestRateLimiter(t *testing.T) {
 	rl := NewRateLimiter(1, 2) // 1 token per second, 2 tokens max
@@ -65,45 +128,151 @@ func TestRateLimiter(t *testing.T) {
 	}
 }
 
-// Test concurrent access to the rate limiter
+// Test concurrent access to the rate limiter. The clock is fake, so every IP gets
+// exactly its capacity at first and its rate after that.
 func TestRateLimiterConcurrent(t *testing.T) {
+	clock := conformance.NewClock()
 	rl := NewRateLimiter(1, 2)
+	rl.now = clock.Now
 
-	var allowed int
-	var denied int
 	const numRoutines = 10
 	const numRequests = 10
 
-	ch := make(chan bool, numRoutines*numRequests)
-
-	// A function to simulate multiple requests from a single IP
-	f := func(ip string) {
-		for i := 0; i < numRequests; i++ {
-			if rl.Allow(ip) {
-				ch <- true
-			} else {
-				ch <- false
-			}
-			time.Sleep(50 * time.Millisecond)
+	// A function to simulate multiple requests from every IP, counting those allowed
+	allow := func() map[string]int {
+		var mu sync.Mutex
+		allowed := make(map[string]int)
+		var wg sync.WaitGroup
+		for i := 0; i < numRoutines; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < numRequests; j++ {
+					ip := fmt.Sprintf("192.168.1.%d", j)
+					if rl.Allow(ip) {
+						mu.Lock()
+						allowed[ip]++
+						mu.Unlock()
+					}
+				}
+			}()
 		}
+		wg.Wait()
+		return allowed
 	}
 
-	// Spawn multiple goroutines for multiple IPs
-	for i := 0; i < numRoutines; i++ {
-		go f(string(rune(i)))
+	allowed := allow()
+	for j := 0; j < numRequests; j++ {
+		if ip := fmt.Sprintf("192.168.1.%d", j); allowed[ip] != 2 {
+			t.Errorf("Expected %s to be allowed its capacity of 2 but got %d", ip, allowed[ip])
+		}
 	}
 
-	// Collect results
-	for i := 0; i < numRoutines*numRequests; i++ {
-		if <-ch {
-			allowed++
-		} else {
-			denied++
+	clock.Advance(time.Second)
+	allowed = allow()
+	for j := 0; j < numRequests; j++ {
+		if ip := fmt.Sprintf("192.168.1.%d", j); allowed[ip] != 1 {
+			t.Errorf("Expected %s to be allowed 1 more request a second later but got %d", ip, allowed[ip])
 		}
 	}
-	// Rough assertion: If the rate limiter works, the number of allowed requests should
-	// be significantly greater than the number of denied requests given our settings.
-	if allowed <= denied {
-		t.Errorf("Expected more allowed requests than denied. Got Allowed: %d, Denied: %d", allowed, denied)
+}
+
+// Test that buckets are forgotten once they have refilled
+func TestRateLimiterForgetsFullBuckets(t *testing.T) {
+	clock := conformance.NewClock()
+	rl := NewRateLimiter(1, 100)
+	rl.now = clock.Now
+
+	rl.Allow("192.168.1.1")
+	for rl.Allow("192.168.1.2") {
+	}
+
+	// A minute later the first bucket is full again, the second only has 60 tokens.
+	clock.Advance(pruneInterval)
+	rl.Allow("192.168.1.3")
+	keys := rl.Keys()
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "192.168.1.2" || keys[1] != "192.168.1.3" {
+		t.Errorf("Expected only the buckets that are not full to be kept but got %v", keys)
+	}
+}
+
+// Test that shadow rules record would-be denials but allow every request
+func TestRateLimiterShadow(t *testing.T) {
+	rl := NewRateLimiter(1, 2)
+	rl.SetShadow(true)
+
+	ip := "192.168.1.1"
+	for i := 0; i < 5; i++ {
+		if !rl.Allow(ip) {
+			t.Fatalf("Expected shadow rule to allow request %d", i+1)
+		}
+	}
+
+	stats := rl.ShadowStats()
+	if stats.Evaluated != 5 || stats.WouldDeny != 3 {
+		t.Errorf("Expected 5 evaluated and 3 would-be denials but got %+v", stats)
+	}
+
+	// Enforcing the rule again denies requests as usual
+	rl.SetShadow(false)
+	if rl.Allow(ip) {
+		t.Error("Expected request to be denied once shadow mode is off")
+	}
+}
+
+// Test that decisions are written to the audit log
+func TestRateLimiterAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	rl := NewRateLimiter(1, 1)
+	rl.SetAuditHandler(slog.NewJSONHandler(&buf, nil), 0)
+
+	ip := "192.168.1.1"
+	rl.Allow(ip)
+	rl.Allow(ip)
+
+	// Only the denial is logged with a sample rate of 0
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Expected a single JSON audit record but got %q", buf.String())
+	}
+	if record["decision"] != "deny" || record["key"] != ip || record["algorithm"] != "tokenbucket" || record["rule"] != "default 1/s burst 1" {
+		t.Errorf("Unexpected audit record %v", record)
+	}
+}
+
+// reentrantHandler is a slog handler that uses the limiter while handling a record,
+// as a handler doing slow I/O would hold up other requests.
+type reentrantHandler struct {
+	slog.Handler
+	rl      *RateLimiter
+	handled int
+}
+
+func (h *reentrantHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.rl.ShadowStats() // Takes the limiter's lock.
+	h.handled++
+	return nil
+}
+
+// Test that audit records are written without holding the limiter's lock
+func TestRateLimiterAuditLogOutsideLock(t *testing.T) {
+	rl := NewRateLimiter(1, 1)
+	handler := &reentrantHandler{Handler: slog.NewTextHandler(io.Discard, nil), rl: rl}
+	rl.SetAuditHandler(handler, 1)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rl.Allow("192.168.1.1")
+		rl.Allow("192.168.1.1")
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected logging a decision not to deadlock on the limiter's lock")
+	}
+	if handler.handled != 2 {
+		t.Errorf("Expected 2 records to be handled but got %d", handler.handled)
 	}
 }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/nesyor/ratelimiter/internal/keys"
+)
+
+// Plan is a named tier, such as Free, Pro or Enterprise, with its own bucket parameters.
+type Plan struct {
+	Name string
+	Rule Rule
+}
+
+// Plans assigns keys, usually API keys, to plans.
+type Plans struct {
+	plans       map[string]Rule   // Rules by plan name.
+	keys        map[string]string // Plan names by key.
+	source      string            // Key source the listed keys come from, e.g. "header:X-API-Key".
+	defaultPlan string            // Plan of keys that are not listed; empty for the limiter's default rule.
+}
+
+// plansFile is the JSON form of Plans:
+//
+//	{
+//	  "source": "header:X-API-Key",
+//	  "default": "free",
+//	  "plans": {"free": {"rate": 1, "capacity": 5}, "pro": {"rate": 10, "capacity": 50}},
+//	  "keys": {"k-3f9a": "pro"}
+//	}
+//
+// The source is written as in the -key flag. Without one, listed keys only match
+// limiter keys that are exactly the same, such as client IPs.
+type plansFile struct {
+	Source  string            `json:"source"`
+	Default string            `json:"default"`
+	Plans   map[string]Rule   `json:"plans"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// newPlans checks that every plan has usable parameters and every key a known plan.
+func newPlans(f plansFile) (*Plans, error) {
+	for name, rule := range f.Plans {
+		if rule.Rate <= 0 || rule.Capacity <= 0 {
+			return nil, fmt.Errorf("plan %q needs a positive rate and capacity", name)
+		}
+	}
+	for key, plan := range f.Keys {
+		if _, ok := f.Plans[plan]; !ok {
+			return nil, fmt.Errorf("key %q has unknown plan %q", key, plan)
+		}
+	}
+	if _, ok := f.Plans[f.Default]; f.Default != "" && !ok {
+		return nil, fmt.Errorf("unknown default plan %q", f.Default)
+	}
+	if f.Source != "" {
+		// A single source, without alternatives or combinations.
+		if _, err := keys.Parse(f.Source, nil); err != nil || strings.ContainsAny(f.Source, ",+") {
+			return nil, fmt.Errorf("invalid key source %q", f.Source)
+		}
+	}
+
+	p := &Plans{plans: f.Plans, keys: f.Keys, source: f.Source, defaultPlan: f.Default}
+	if p.plans == nil {
+		p.plans = make(map[string]Rule)
+	}
+	if p.keys == nil {
+		p.keys = make(map[string]string)
+	}
+	return p, nil
+}
+
+// Lookup returns the plan of key. Keys made by a key extractor, such as
+// "header:X-API-Key=k-3f9a", also match the plan of the value they carry from the
+// plans' source, but not of values from other sources.
+func (p *Plans) Lookup(key string) (Plan, bool) {
+	name, ok := p.keys[key]
+	if !ok && p.source != "" {
+		if value, found := keys.Value(key, p.source); found {
+			name, ok = p.keys[value]
+		}
+	}
+	if !ok {
+		return Plan{}, false
+	}
+	return Plan{Name: name, Rule: p.plans[name]}, true
+}
+
+// For returns the plan of key, or the default plan if key is not listed.
+func (p *Plans) For(key string) (Plan, bool) {
+	if plan, ok := p.Lookup(key); ok {
+		return plan, true
+	}
+	return p.Default()
+}
+
+// Default returns the plan of keys that are not listed, if there is one.
+func (p *Plans) Default() (Plan, bool) {
+	if p.defaultPlan == "" {
+		return Plan{}, false
+	}
+	return Plan{Name: p.defaultPlan, Rule: p.plans[p.defaultPlan]}, true
+}
+
+// Scale returns a copy of p whose plans have the given fraction of their rate and
+// capacity, but at least 1, like the fallback limiter gets of the default rule.
+func (p *Plans) Scale(fraction float64) *Plans {
+	scaled := *p
+	scaled.plans = make(map[string]Rule, len(p.plans))
+	for name, rule := range p.plans {
+		rule.Rate = max(int(float64(rule.Rate)*fraction), 1)
+		rule.Capacity = max(int(float64(rule.Capacity)*fraction), 1)
+		scaled.plans[name] = rule
+	}
+	return &scaled
+}
+
+// ParsePlansJSON reads plans in the JSON form shown at plansFile.
+func ParsePlansJSON(r io.Reader) (*Plans, error) {
+	var f plansFile
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, err
+	}
+	return newPlans(f)
+}
+
+// ParsePlansCSV reads plans from CSV records of four kinds. Lines starting with #
+// are ignored.
+//
+//	source,<key source>
+//	plan,<name>,<rate>,<capacity>
+//	default,<plan>
+//	key,<key>,<plan>
+func ParsePlansCSV(r io.Reader) (*Plans, error) {
+	f := plansFile{Plans: make(map[string]Rule), Keys: make(map[string]string)}
+
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+
+		switch {
+		case record[0] == "plan" && len(record) == 4:
+			var rule Rule
+			if rule.Rate, err = strconv.Atoi(record[2]); err != nil {
+				return nil, fmt.Errorf("line %d: invalid rate: %w", line, err)
+			}
+			if rule.Capacity, err = strconv.Atoi(record[3]); err != nil {
+				return nil, fmt.Errorf("line %d: invalid capacity: %w", line, err)
+			}
+			f.Plans[record[1]] = rule
+		case record[0] == "source" && len(record) == 2:
+			f.Source = record[1]
+		case record[0] == "default" && len(record) == 2:
+			f.Default = record[1]
+		case record[0] == "key" && len(record) == 3:
+			f.Keys[record[1]] = record[2]
+		default:
+			return nil, fmt.Errorf("line %d: expected a source, plan, default or key record", line)
+		}
+	}
+	return newPlans(f)
+}
+
+// LoadPlansFile reads plans from a .json or .csv file.
+func LoadPlansFile(path string) (*Plans, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	switch filepath.Ext(path) {
+	case ".json":
+		return ParsePlansJSON(file)
+	case ".csv":
+		return ParsePlansCSV(file)
+	default:
+		return nil, fmt.Errorf("plans file %s is neither .json nor .csv", path)
+	}
+}
+
+// reloadPlans loads the plans file and passes it to apply every time a signal
+// arrives, keeping the current plans if the file cannot be loaded.
+func reloadPlans(path string, apply func(*Plans), signals <-chan os.Signal) {
+	for range signals {
+		plans, err := LoadPlansFile(path)
+		if err != nil {
+			log.Printf("plans: keeping current plans, failed to reload %s: %v", path, err)
+			continue
+		}
+		apply(plans)
+		log.Printf("plans: reloaded %s", path)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nesyor/ratelimiter/internal/keys"
+)
+
+const testPlansJSON = `{
+	"source": "header:X-API-Key",
+	"default": "free",
+	"plans": {"free": {"rate": 1, "capacity": 1}, "pro": {"rate": 1, "capacity": 3}},
+	"keys": {"k-pro": "pro"}
+}`
+
+const testPlansCSV = `# Plans first, then keys
+source,header:X-API-Key
+plan,free,1,1
+plan,pro,1,3
+default,free
+key,k-pro,pro
+`
+
+// Test that both file formats describe the same plans
+func TestParsePlans(t *testing.T) {
+	fromJSON, err := ParsePlansJSON(strings.NewReader(testPlansJSON))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing JSON plans: %v", err)
+	}
+	fromCSV, err := ParsePlansCSV(strings.NewReader(testPlansCSV))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing CSV plans: %v", err)
+	}
+
+	for _, plans := range []*Plans{fromJSON, fromCSV} {
+		if plan, ok := plans.Lookup("k-pro"); !ok || plan.Name != "pro" || plan.Rule.Capacity != 3 {
+			t.Errorf("Expected k-pro on the pro plan but got %+v", plan)
+		}
+		// Keys from a key extractor match the API key they carry
+		if plan, ok := plans.Lookup("header:X-API-Key=k-pro"); !ok || plan.Name != "pro" {
+			t.Errorf("Expected the extracted key on the pro plan but got %+v", plan)
+		}
+		// Values from other sources do not, even when they are listed
+		for _, key := range []string{"query:X-API-Key=k-pro", "jwt:sub=k-pro", "cookie:session=k-pro|header:X-API-Key=k-free"} {
+			if plan, ok := plans.Lookup(key); ok {
+				t.Errorf("Expected no plan for %s but got %+v", key, plan)
+			}
+		}
+		if _, ok := plans.Lookup("k-unknown"); ok {
+			t.Error("Expected no plan for an unknown key")
+		}
+		if plan, ok := plans.For("k-unknown"); !ok || plan.Name != "free" {
+			t.Errorf("Expected unknown keys on the default plan but got %+v", plan)
+		}
+	}
+
+	invalid := []string{
+		`{"plans": {"free": {"rate": 0, "capacity": 1}}}`,
+		`{"plans": {"free": {"rate": 1, "capacity": 1}}, "keys": {"k": "gold"}}`,
+		`{"default": "gold"}`,
+		`{"tiers": {}}`,
+		`{"source": "bogus:X"}`,
+		`{"source": "header:X-API-Key+route"}`,
+	}
+	for _, doc := range invalid {
+		if _, err := ParsePlansJSON(strings.NewReader(doc)); err == nil {
+			t.Errorf("Expected an error for %s", doc)
+		}
+	}
+	for _, doc := range []string{"plan,free,1", "plan,free,x,1", "tier,free", "key,k,gold", "source,header"} {
+		if _, err := ParsePlansCSV(strings.NewReader(doc)); err == nil {
+			t.Errorf("Expected an error for %q", doc)
+		}
+	}
+}
+
+// Test that keys get their plan's capacity, ahead of network rules
+func TestRateLimiterPlans(t *testing.T) {
+	plans, _ := ParsePlansJSON(strings.NewReader(testPlansJSON))
+	rl := NewRateLimiter(1, 5)
+	rl.SetNetworks(NewCIDRMatcher(NetworkRule{Prefix: netip.MustParsePrefix("192.0.2.0/24"), Action: ActionLimit, Rule: Rule{Rate: 1, Capacity: 2}}))
+	rl.SetPlans(plans)
+
+	allowed := func(key string) int {
+		n := 0
+		for i := 0; i < 10; i++ {
+			if rl.Allow(key) {
+				n++
+			}
+		}
+		return n
+	}
+
+	if n := allowed("k-pro"); n != 3 {
+		t.Errorf("Expected 3 requests on the pro plan but got %d", n)
+	}
+	// The default plan replaces the limiter's capacity of 5
+	if n := allowed("k-other"); n != 1 {
+		t.Errorf("Expected 1 request on the default plan but got %d", n)
+	}
+	// Network rules still take precedence over the default plan
+	if n := allowed("192.0.2.1"); n != 2 {
+		t.Errorf("Expected 2 requests under the network rule but got %d", n)
+	}
+
+	rl.SetPlans(nil)
+	if n := allowed("k-new"); n != 5 {
+		t.Errorf("Expected the limiter's capacity without plans but got %d", n)
+	}
+}
+
+// Test that keys on a plan stay in shadow mode when the limiter is
+func TestRateLimiterPlansShadow(t *testing.T) {
+	plans, _ := ParsePlansJSON(strings.NewReader(testPlansJSON))
+	rl := NewRateLimiter(1, 5)
+	rl.SetPlans(plans)
+	rl.SetShadow(true)
+
+	for i := 0; i < 5; i++ {
+		if !rl.Allow("header:X-API-Key=k-pro") {
+			t.Fatalf("Expected shadow mode to allow request %d on the pro plan", i+1)
+		}
+	}
+	if stats := rl.ShadowStats(); stats.Evaluated != 5 || stats.WouldDeny != 2 {
+		t.Errorf("Expected 5 evaluated and 2 would-be denials but got %+v", stats)
+	}
+}
+
+// Test that an API key cannot pose as a client IP to get its plan
+func TestRateLimiterPlansSpoofing(t *testing.T) {
+	plans, err := ParsePlansCSV(strings.NewReader("source,ip\nplan,free,1,1\nplan,pro,1,3\ndefault,free\nkey,10.0.0.5,pro\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing plans: %v", err)
+	}
+	extract, err := keys.Parse("header:X-API-Key", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing the key: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-API-Key", "junk|10.0.0.5")
+	if plan, _ := plans.For(keys.Key(extract, req)); plan.Name != "free" {
+		t.Errorf("Expected the spoofed key to get the default plan but got %q", plan.Name)
+	}
+	if plan, _ := plans.For("10.0.0.5"); plan.Name != "pro" {
+		t.Errorf("Expected the client IP to get its plan but got %q", plan.Name)
+	}
+}
+
+// Test that the fallback limiter's share of the plans keeps at least one token
+func TestPlansScale(t *testing.T) {
+	plans, err := ParsePlansCSV(strings.NewReader(testPlansCSV + "plan,enterprise,10,20\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing plans: %v", err)
+	}
+	scaled := plans.Scale(0.5)
+
+	if plan, _ := scaled.For("header:X-API-Key=k-pro"); plan.Name != "pro" || plan.Rule != (Rule{Rate: 1, Capacity: 1}) {
+		t.Errorf("Expected the pro plan scaled to a rate and capacity of 1 but got %+v", plan)
+	}
+	if plan, _ := scaled.For("unlisted"); plan.Name != "free" || plan.Rule != (Rule{Rate: 1, Capacity: 1}) {
+		t.Errorf("Expected the default plan to be kept but got %+v", plan)
+	}
+	if rule := scaled.plans["enterprise"]; rule != (Rule{Rate: 5, Capacity: 10}) {
+		t.Errorf("Expected the enterprise plan to be halved but got %+v", rule)
+	}
+	if rule := plans.plans["enterprise"]; rule != (Rule{Rate: 10, Capacity: 20}) {
+		t.Errorf("Expected the original plans to be left alone but got %+v", rule)
+	}
+}
+
+// Test reloading the plans file on a signal
+func TestReloadPlans(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plans.csv")
+	if err := os.WriteFile(path, []byte(testPlansCSV), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	plans, err := LoadPlansFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error loading plans: %v", err)
+	}
+	rl := NewRateLimiter(1, 1)
+	rl.SetPlans(plans)
+
+	signals := make(chan os.Signal)
+	go reloadPlans(path, rl.SetPlans, signals)
+	defer close(signals)
+
+	plan := func(key string) string {
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+		p, _ := rl.plans.For(key)
+		return p.Name
+	}
+
+	// A broken file keeps the current plans
+	os.WriteFile(path, []byte("plan,free"), 0o644)
+	signals <- syscall.SIGHUP
+	signals <- syscall.SIGHUP // Returns once the first reload has finished.
+	if name := plan("k-new"); name != "free" {
+		t.Fatalf("Expected the current plans to be kept but got %q", name)
+	}
+
+	os.WriteFile(path, []byte(testPlansCSV+"key,k-new,pro\n"), 0o644)
+	signals <- syscall.SIGHUP
+	deadline := time.Now().Add(time.Second)
+	for plan("k-new") != "pro" {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected k-new to move to the pro plan after the reload")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
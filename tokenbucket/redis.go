@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/nesyor/ratelimiter/internal/failover"
+	"github.com/nesyor/ratelimiter/internal/redis"
+)
+
+// RedisLimiter keeps token buckets in Redis, so every replica pointed at the same
+// server shares one bucket per IP. The rule for each request is still resolved by the
+// local limiter, so network rules, plans, overrides, credit and shadow mode apply as
+// they do locally, and decisions are audited and tracked by it.
+type RedisLimiter struct {
+	local  *RateLimiter
+	bucket *redis.TokenBucket
+	guard  *failover.Guard // Decides requests when Redis cannot.
+	mu     sync.Mutex
+}
+
+// NewRedisLimiter creates a limiter that stores the buckets of local's default rule
+// in Redis through c. Until SetFailover is called, decisions fall back to local when
+// Redis cannot be reached.
+func NewRedisLimiter(c *redis.Client, local *RateLimiter) *RedisLimiter {
+	local.mu.Lock()
+	defer local.mu.Unlock()
+
+	return &RedisLimiter{
+		local:  local,
+		bucket: redis.NewTokenBucket(c, "ratelimit:tokenbucket:", float64(local.rate), local.capacity),
+		guard:  failover.New(failover.Options{Local: local.Allow}),
+	}
+}
+
+// SetFailover sets what happens to requests when Redis fails or times out.
+func (rl *RedisLimiter) SetFailover(opts failover.Options) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.guard = failover.New(opts)
+}
+
+// FailoverStats returns the calls made to Redis and the fallbacks taken so far.
+func (rl *RedisLimiter) FailoverStats() failover.Stats {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	return rl.guard.Stats()
+}
+
+// Network returns the action of the network rule covering the given IP.
+func (rl *RedisLimiter) Network(ip string) Action {
+	return rl.local.Network(ip)
+}
+
+// Allow spends a token from ip's shared bucket if one is available.
+func (rl *RedisLimiter) Allow(ip string) bool {
+	rl.mu.Lock()
+	guard := rl.guard
+	rl.mu.Unlock()
+
+	logger := rl.local.AuditLogger()
+	rl.local.mu.Lock()
+	rule, ruleName, action := rl.local.resolve(ip)
+	if action != ActionLimit {
+		allowed, record := rl.local.decideNetwork(ip, ruleName, action, logger != nil)
+		rl.local.mu.Unlock()
+		if record != nil {
+			logger.Log(*record)
+		}
+		return allowed
+	}
+	rl.local.mu.Unlock()
+
+	// Redis is not called with rl.local.mu held, so other requests are not held up.
+	var res redis.Result
+	answered := false
+	allowed := guard.Allow(ip, func(ctx context.Context) (bool, error) {
+		var err error
+		res, err = rl.bucket.AllowNWith(ctx, ip, 1, float64(rule.Rate), rule.Capacity)
+		answered = err == nil
+		return res.Allowed, err
+	})
+	if !answered {
+		// The failure policy decided, through the fallback limiter if it is local.
+		return allowed
+	}
+
+	rl.local.mu.Lock()
+	allowed, record := rl.local.settle(ip, rule, ruleName, res.Allowed, res.Remaining, res.RetryAfter, logger != nil)
+	rl.local.mu.Unlock()
+	if record != nil {
+		// Logged after rl.local.mu is released, since the handler may do I/O.
+		logger.Log(*record)
+	}
+	return allowed
+}
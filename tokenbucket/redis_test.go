@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/nesyor/ratelimiter/internal/conformance"
+	"github.com/nesyor/ratelimiter/internal/failover"
+	"github.com/nesyor/ratelimiter/internal/redis"
+)
+
+func TestRedisLimiterUnreachable(t *testing.T) {
+	local := NewRateLimiter(0, 1)
+	rl := NewRedisLimiter(redis.NewClient("127.0.0.1:1", 100*time.Millisecond), local)
+
+	// Without Redis the local buckets decide.
+	if !rl.Allow("192.168.1.1") {
+		t.Error("Expected the local bucket to allow the first request")
+	}
+	if rl.Allow("192.168.1.1") {
+		t.Error("Expected the local bucket to deny the second request")
+	}
+}
+
+func TestRedisLimiterFailClosed(t *testing.T) {
+	rl := NewRedisLimiter(redis.NewClient("127.0.0.1:1", 100*time.Millisecond), NewRateLimiter(0, 1))
+	rl.SetFailover(failover.Options{Policy: failover.FailClosed, FailureThreshold: 2, Cooldown: time.Minute})
+
+	for i := 0; i < 3; i++ {
+		if rl.Allow("192.168.1.1") {
+			t.Fatal("Expected requests to be denied while Redis is down")
+		}
+	}
+	if s := rl.FailoverStats(); s.Calls != 2 || s.ShortCircuit != 1 || s.Fallbacks != 3 {
+		t.Errorf("Expected the breaker to stop calls after two failures but got %+v", s)
+	}
+}
+
+// Test that network rules are applied without asking Redis
+func TestRedisLimiterNetworks(t *testing.T) {
+	local := NewRateLimiter(0, 1)
+	local.SetNetworks(NewCIDRMatcher(
+		NetworkRule{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Action: ActionAllow},
+		NetworkRule{Prefix: netip.MustParsePrefix("203.0.113.0/24"), Action: ActionDeny},
+	))
+	var buf bytes.Buffer
+	local.SetAuditHandler(slog.NewJSONHandler(&buf, nil), 0)
+	rl := NewRedisLimiter(redis.NewClient("127.0.0.1:1", 100*time.Millisecond), local)
+	rl.SetFailover(failover.Options{Policy: failover.FailClosed})
+
+	for i := 0; i < 3; i++ {
+		if !rl.Allow("10.0.0.1") {
+			t.Fatal("Expected allowed network to be exempt while Redis is down")
+		}
+	}
+	if rl.Allow("203.0.113.5") {
+		t.Error("Expected denied network to be blocked")
+	}
+	if s := rl.FailoverStats(); s.Calls != 0 {
+		t.Errorf("Expected no calls to Redis but got %+v", s)
+	}
+
+	// The denial is audited by the local limiter.
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Expected a single JSON audit record but got %q", buf.String())
+	}
+	if record["decision"] != "deny" || record["rule"] != "deny 203.0.113.0/24" {
+		t.Errorf("Unexpected audit record %v", record)
+	}
+}
+
+// Test that overrides, credit and shadow mode apply to buckets kept in Redis
+func TestRedisLimiterRules(t *testing.T) {
+	clock := conformance.NewClock()
+	server, err := redis.NewFakeServer(clock.Now)
+	if err != nil {
+		t.Fatalf("Unexpected error starting a fake Redis server: %v", err)
+	}
+	defer server.Close()
+	c := redis.NewClient(server.Addr(), time.Second)
+	defer c.Close()
+
+	local := NewRateLimiter(0, 1)
+	rl := NewRedisLimiter(c, local)
+	rl.bucket = redis.NewTokenBucket(c, "ratelimiter-test:", 0, 1)
+	ips := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}
+
+	// The override's capacity of 3 is used instead of the default of 1.
+	if err := local.SetOverride(ips[0], json.RawMessage(`{"rate": 1, "capacity": 3}`)); err != nil {
+		t.Fatalf("Unexpected error setting override: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if !rl.Allow(ips[0]) {
+			t.Fatalf("Expected request %d to be allowed by the override", i+1)
+		}
+	}
+	if rl.Allow(ips[0]) {
+		t.Error("Expected the override's capacity to be used up")
+	}
+
+	// Credit covers a request the shared bucket denies.
+	rl.Allow(ips[1])
+	local.Grant(ips[1], 1, time.Minute)
+	if !rl.Allow(ips[1]) || rl.Allow(ips[1]) {
+		t.Error("Expected exactly one request to be covered by credit")
+	}
+
+	// Shadow mode allows the request but records the would-be denial.
+	local.SetShadow(true)
+	rl.Allow(ips[2])
+	if !rl.Allow(ips[2]) {
+		t.Error("Expected shadow mode to allow the request")
+	}
+	if stats := local.ShadowStats(); stats.WouldDeny != 1 {
+		t.Errorf("Expected one would-be denial but got %+v", stats)
+	}
+}